@@ -0,0 +1,211 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"../clients"
+	"../model"
+)
+
+const (
+	//the most queries we will run in one batch
+	max_batch_size = 20
+	//how many of the queries in a batch are run at the same time
+	batch_workers = 4
+)
+
+var (
+	error_invalid_batch = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_batch", Message: fmt.Sprintf("the batch must be a JSON array of between 1 and %d queries, each with a query and a name of its own", max_batch_size)}
+	error_batch_limit   = &detailedError{Status: http.StatusBadRequest, Code: "query_batch_limit", Message: "each query in a batch that returns records must have a LIMIT e.g. LIMIT 100, the results of the whole batch are held in memory"}
+)
+
+type (
+	//one of the queries in a batch, its results are given under its name
+	batchQuery struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+
+	//the results of one of the queries in a batch, or why it couldn't be run
+	batchResult struct {
+		Status  int             `json:"status"`
+		Results json.RawMessage `json:"results,omitempty"`
+		Error   *detailedError  `json:"error,omitempty"`
+	}
+)
+
+//the queries in the body of the request
+func batchFrom(req *http.Request) ([]*batchQuery, *detailedError) {
+	defer req.Body.Close()
+	var queries []*batchQuery
+	if err := json.NewDecoder(req.Body).Decode(&queries); err != nil {
+		return nil, error_invalid_batch
+	}
+	if len(queries) == 0 || len(queries) > max_batch_size {
+		return nil, error_invalid_batch
+	}
+	names := map[string]bool{}
+	for _, query := range queries {
+		if query == nil || query.Name == "" || query.Query == "" || names[query.Name] {
+			return nil, error_invalid_batch
+		}
+		names[query.Name] = true
+	}
+	return queries, nil
+}
+
+//only looks each user up once no matter how many of the queries are for them
+func cachedGroupLookup(lookup groupLookup) groupLookup {
+	type found struct {
+		groupId string
+		err     *detailedError
+	}
+	cache := map[string]found{}
+	return func(field, queriedId string) (string, *detailedError) {
+		key := field + " " + queriedId
+		if f, ok := cache[key]; ok {
+			return f.groupId, f.err
+		}
+		groupId, detailedErr := lookup(field, queriedId)
+		if detailedErr != nil {
+			//the error may be changed by the next lookup that fails
+			copied := *detailedErr
+			detailedErr = &copied
+		}
+		cache[key] = found{groupId: groupId, err: detailedErr}
+		return groupId, detailedErr
+	}
+}
+
+//the result for a query that couldn't be run, the error is copied as the queries in the batch each give their own
+func failedBatchQuery(name string, err *detailedError, startedAt time.Time) *batchResult {
+	failed := *err
+	failed.Id = uuid.NewV4().String()
+
+	log.Println(QUERY_API_PREFIX, fmt.Sprintf("Batch: [%s][%s][%s] failed after [%.5f]secs with error [%s][%s] ", name, failed.Id, failed.Code, time.Now().Sub(startedAt).Seconds(), failed.Message, failed.InternalMessage))
+
+	return &batchResult{Status: failed.Status, Error: &failed}
+}
+
+//run the query giving all of its results as JSON
+func (a *Api) runBatchQuery(name string, qd *model.QueryData, start time.Time) *batchResult {
+	var results bytes.Buffer
+	if err := a.Store.StreamQuery(qd, result_formats[0].newWriter(&results, qd)); err != nil {
+		failed := *error_running_query
+		if err == clients.ErrTooManyValues {
+			failed = *error_too_many_values
+		}
+		failed.InternalMessage = err.Error()
+		return failedBatchQuery(name, &failed, start)
+	}
+	return &batchResult{Status: http.StatusOK, Results: json.RawMessage(results.Bytes())}
+}
+
+// BatchQuery runs each of the named queries in the body, giving the results of each under its name.
+// The users the queries are for are looked up and their permissions checked once for the whole batch,
+// and the queries are then run a few at a time. Each query that returns records must have a LIMIT, which the store caps
+// at its maxLimit, as all of the results are held until the batch is done. Aggregates give a row for each group or bucket
+// rather than the records so they don't need one.
+//
+// http.StatusOK - the results of each query, or why it couldn't be run
+// http.StatusBadRequest - the batch wasn't an array of named queries
+// http.StatusUnauthorized - you don't have a valid token
+func (a *Api) BatchQuery(res http.ResponseWriter, req *http.Request) {
+
+	start := time.Now()
+
+	if td := a.authorized(req); td != nil {
+
+		log.Println(QUERY_API_PREFIX, "Batch: starting ... ")
+
+		queries, detailedErr := batchFrom(req)
+		if detailedErr != nil {
+			jsonError(res, detailedErr, start)
+			return
+		}
+
+		lookup := cachedGroupLookup(a.viewableGroupLookup(td.UserID))
+		results := make(map[string]*batchResult, len(queries))
+		ready := map[string]*model.QueryData{}
+
+		for _, query := range queries {
+			log.Println(QUERY_API_PREFIX, "Batch: raw ", query.Name, query.Query)
+
+			errs, qd := model.BuildQuery(query.Query)
+			if len(errs) != 0 {
+				results[query.Name] = failedBatchQuery(query.Name, error_building_query.withParseErrors(errs), start)
+				continue
+			}
+			if qd.Limit == 0 && !qd.IsAggregate() {
+				results[query.Name] = failedBatchQuery(query.Name, error_batch_limit, start)
+				continue
+			}
+			if detailedErr := setQueriedGroups(qd, lookup, a.Deidentify); detailedErr != nil {
+				results[query.Name] = failedBatchQuery(query.Name, detailedErr, start)
+				continue
+			}
+			ready[query.Name] = qd
+		}
+
+		//run them with a few workers
+		names := make(chan string, len(ready))
+		for name := range ready {
+			names <- name
+		}
+		close(names)
+
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < batch_workers && i < len(ready); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for name := range names {
+					result := a.runBatchQuery(name, ready[name], start)
+					mutex.Lock()
+					results[name] = result
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		batch, err := json.Marshal(results)
+		if err != nil {
+			jsonError(res, error_internal_server.setInternalMessage(err), start)
+			return
+		}
+
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Batch: completed [%d] queries in [%.5f] secs", len(queries), time.Now().Sub(start).Seconds()))
+		res.Header().Set("content-type", content_json)
+		res.Write(batch)
+		return
+	}
+	jsonError(res, error_not_authorized, start)
+	return
+}
@@ -0,0 +1,116 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	commonClients "github.com/tidepool-org/go-common/clients"
+	"github.com/tidepool-org/go-common/clients/disc"
+)
+
+//the go-common version we build against has no way to list a user's groups or read a seagull collection,
+//so these wrap its clients and make those calls themselves against the same hosts
+type (
+	//the permissions the user has in each group, keyed by the group id
+	UsersPermissions map[string]commonClients.Permissions
+
+	TokenProvider interface {
+		TokenProvide() string
+	}
+
+	GatekeeperAdapter struct {
+		*commonClients.GatekeeperClient
+		hostGetter    disc.HostGetter
+		httpClient    *http.Client
+		tokenProvider TokenProvider
+	}
+
+	SeagullAdapter struct {
+		*commonClients.SeagullClient
+		hostGetter disc.HostGetter
+		httpClient *http.Client
+	}
+)
+
+var ErrNoHost = errors.New("no known host for the service")
+
+func NewGatekeeperAdapter(client *commonClients.GatekeeperClient, hostGetter disc.HostGetter, httpClient *http.Client, tokenProvider TokenProvider) *GatekeeperAdapter {
+	return &GatekeeperAdapter{
+		GatekeeperClient: client,
+		hostGetter:       hostGetter,
+		httpClient:       httpClient,
+		tokenProvider:    tokenProvider,
+	}
+}
+
+func NewSeagullAdapter(client *commonClients.SeagullClient, hostGetter disc.HostGetter, httpClient *http.Client) *SeagullAdapter {
+	return &SeagullAdapter{
+		SeagullClient: client,
+		hostGetter:    hostGetter,
+		httpClient:    httpClient,
+	}
+}
+
+//GET the path from the first host the service is known at and decode the JSON body into v, which is left as it is on a 404
+func getJSON(hostGetter disc.HostGetter, httpClient *http.Client, token string, v interface{}, parts ...string) error {
+	hosts := hostGetter.HostGet()
+	if len(hosts) == 0 {
+		return ErrNoHost
+	}
+	host := hosts[0]
+	host.Path = path.Join(append([]string{host.Path}, parts...)...)
+
+	req, err := http.NewRequest("GET", host.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add(SESSION_TOKEN, token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(res.Body).Decode(v)
+	case http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("unexpected status [%d] from [%s]", res.StatusCode, host.String())
+}
+
+//the groups the user is in and their permissions in each, none when gatekeeper doesn't know the user
+func (g *GatekeeperAdapter) GroupsForUser(userID string) (UsersPermissions, error) {
+	groups := UsersPermissions{}
+	if err := getJSON(g.hostGetter, g.httpClient, g.tokenProvider.TokenProvide(), &groups, "access", "groups", userID); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+//read the user's collection into v, which is left as it is when the user has no such collection
+func (s *SeagullAdapter) GetCollection(userID, collectionName, token string, v interface{}) error {
+	return getJSON(s.hostGetter, s.httpClient, token, v, userID, collectionName)
+}
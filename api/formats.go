@@ -0,0 +1,100 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package api
+
+import (
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"../clients"
+	"../model"
+)
+
+const (
+	content_json   = "application/json"
+	content_ndjson = "application/x-ndjson"
+	content_csv    = "text/csv"
+)
+
+type resultFormat struct {
+	contentType string
+	newWriter   func(w io.Writer, qd *model.QueryData) clients.RecordWriter
+}
+
+// the formats we can give the results in, the first is what we give when any will do
+var result_formats = []*resultFormat{
+	{contentType: content_json, newWriter: func(w io.Writer, qd *model.QueryData) clients.RecordWriter {
+		return clients.NewJSONWriter(w)
+	}},
+	{contentType: content_ndjson, newWriter: func(w io.Writer, qd *model.QueryData) clients.RecordWriter {
+		return clients.NewNDJSONWriter(w)
+	}},
+	{contentType: content_csv, newWriter: func(w io.Writer, qd *model.QueryData) clients.RecordWriter {
+		//the SELECTed fields or aggregates, when there aren't any all of those found
+		return clients.NewCSVWriter(w, qd.Columns())
+	}},
+}
+
+// the format with the records de-identified before they are written
+func (f *resultFormat) deidentified(config *clients.DeidentifyConfig) *resultFormat {
+	return &resultFormat{contentType: f.contentType, newWriter: func(w io.Writer, qd *model.QueryData) clients.RecordWriter {
+		return clients.NewDeidentifyingWriter(f.newWriter(w, qd), config, qd)
+	}}
+}
+
+// the first of our formats that matches the media range e.g. text/csv, text/* or */*
+func matchFormat(mediaRange string) *resultFormat {
+	for _, format := range result_formats {
+		if mediaRange == "*/*" || mediaRange == format.contentType {
+			return format
+		}
+		if strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(format.contentType, strings.TrimSuffix(mediaRange, "*")) {
+			return format
+		}
+	}
+	return nil
+}
+
+// the format most preferred by the Accept header, nil when we can't give any of those that are accepted
+func negotiateFormat(accept string) *resultFormat {
+	if strings.TrimSpace(accept) == "" {
+		return result_formats[0]
+	}
+
+	var best *resultFormat
+	bestQuality := 0.0
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		//the first given wins when they are equally preferred
+		if format := matchFormat(mediaRange); format != nil && quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+	return best
+}
@@ -0,0 +1,383 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"../clients"
+	"../model"
+)
+
+const (
+	//how often we look for jobs that have expired
+	job_expiry_interval = 10 * time.Minute
+)
+
+var (
+	//what we tell the user when their job fails, the reason is logged
+	error_job_failed = errors.New("the query failed, please submit it again")
+	//jobs that were waiting or running when the server stopped
+	error_job_abandoned = errors.New("the server stopped before the query finished, please submit it again")
+)
+
+type (
+	// JobRunner runs the queries of jobs in the background, no more of them at once than it has workers
+	JobRunner struct {
+		store clients.StoreClient
+		jobs  clients.JobStore
+		ttl   time.Duration
+		queue chan *jobTask
+		//how often expired jobs are removed, until the runner is stopped
+		ticker  *time.Ticker
+		stopped chan bool
+		//no jobs are queued once the runner has stopped
+		lock     sync.RWMutex
+		stopping bool
+	}
+
+	//a job with the query it runs and the format its results are given in
+	jobTask struct {
+		job    *model.Job
+		qd     *model.QueryData
+		format *resultFormat
+	}
+)
+
+// NewJobRunner that runs the queries against the store and keeps the jobs in the job store. Any jobs that were
+// waiting or running when the last runner stopped have failed.
+func NewJobRunner(store clients.StoreClient, jobs clients.JobStore, config *clients.JobsConfig) (*JobRunner, error) {
+	ttl, err := config.GetTTL()
+	if err != nil {
+		return nil, err
+	}
+	if config.Workers < 1 || config.QueueSize < 0 {
+		return nil, errors.New("there must be at least one worker and the queueSize can't be less than 0")
+	}
+
+	r := &JobRunner{store: store, jobs: jobs, ttl: ttl, queue: make(chan *jobTask, config.QueueSize)}
+	if err := r.abandon(time.Now()); err != nil {
+		return nil, err
+	}
+	for i := 0; i < config.Workers; i++ {
+		go r.work()
+	}
+	r.ticker = time.NewTicker(job_expiry_interval)
+	r.stopped = make(chan bool)
+	go r.expireEvery()
+	return r, nil
+}
+
+// Stop the runner, no more jobs are queued or expired. The workers still run the jobs that are waiting, any
+// that don't finish before the server exits are abandoned when the next runner starts.
+func (r *JobRunner) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stopping {
+		return
+	}
+	r.stopping = true
+	r.ticker.Stop()
+	close(r.stopped)
+	close(r.queue)
+}
+
+func (r *JobRunner) expireEvery() {
+	for {
+		select {
+		case now := <-r.ticker.C:
+			r.expire(now)
+		case <-r.stopped:
+			return
+		}
+	}
+}
+
+//queue the job to run, false when too many jobs are already waiting or the runner has stopped
+func (r *JobRunner) submit(task *jobTask) (bool, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.stopping {
+		return false, nil
+	}
+	if err := r.jobs.SaveJob(task.job); err != nil {
+		return false, err
+	}
+	select {
+	case r.queue <- task:
+		return true, nil
+	default:
+		return false, r.jobs.DeleteJob(task.job.Id)
+	}
+}
+
+func (r *JobRunner) work() {
+	for task := range r.queue {
+		r.run(task)
+	}
+}
+
+func (r *JobRunner) run(task *jobTask) {
+	start := time.Now()
+	task.job.Start(start)
+	if err := r.jobs.SaveJob(task.job); err != nil {
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Job [%s]: couldn't be saved as running with error [%s]", task.job.Id, err.Error()))
+	}
+
+	err := r.writeResults(task)
+	if err != nil {
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Job [%s]: failed after [%.5f] secs with error [%s]", task.job.Id, time.Now().Sub(start).Seconds(), err.Error()))
+		if err != clients.ErrTooManyValues {
+			err = error_job_failed
+		}
+	} else {
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Job [%s]: completed in [%.5f] secs", task.job.Id, time.Now().Sub(start).Seconds()))
+	}
+
+	task.job.Finish(time.Now(), r.ttl, err)
+	if err := r.jobs.SaveJob(task.job); err != nil {
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Job [%s]: couldn't be saved as finished with error [%s]", task.job.Id, err.Error()))
+	}
+}
+
+func (r *JobRunner) writeResults(task *jobTask) error {
+	results, err := r.jobs.ResultWriter(task.job.Id)
+	if err != nil {
+		return err
+	}
+	err = r.store.StreamQuery(task.qd, task.format.newWriter(results, task.qd))
+	if closeErr := results.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//remove the jobs that have expired along with their results
+func (r *JobRunner) expire(now time.Time) {
+	jobs, err := r.jobs.ListJobs()
+	if err != nil {
+		log.Println(QUERY_API_PREFIX, "Error listing the jobs to expire", err)
+		return
+	}
+	for _, job := range jobs {
+		if !job.IsExpired(now) {
+			continue
+		}
+		if err := r.jobs.DeleteJob(job.Id); err != nil {
+			log.Println(QUERY_API_PREFIX, fmt.Sprintf("Job [%s]: couldn't be expired with error [%s]", job.Id, err.Error()))
+		}
+	}
+}
+
+//fail the jobs that were left waiting or running, we don't have their queries to run them again
+func (r *JobRunner) abandon(now time.Time) error {
+	jobs, err := r.jobs.ListJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.IsFinished() {
+			continue
+		}
+		job.Finish(now, r.ttl, error_job_abandoned)
+		if err := r.jobs.SaveJob(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//the job with the id, as long as the authenticated user submitted it
+func (a *Api) ownedJob(userId, id string) (*model.Job, *detailedError) {
+	if a.Jobs == nil {
+		return nil, error_no_jobs
+	}
+	job, err := a.Jobs.jobs.GetJob(id)
+	if err == clients.ErrJobNotFound {
+		return nil, error_job_not_found
+	} else if err != nil {
+		return nil, error_internal_server.setInternalMessage(err)
+	}
+	if job.UserId != userId {
+		return nil, error_job_cant_view
+	}
+	//it may not have been removed yet
+	if job.IsExpired(time.Now()) {
+		return nil, error_job_not_found
+	}
+	return job, nil
+}
+
+//the authenticated user must still be able to view the data of each user the job's query was for
+func (a *Api) checkJobGroups(userId string, job *model.Job) *detailedError {
+	//every query is for at least one user
+	if len(job.Groups) == 0 {
+		return error_no_view_permisson
+	}
+	lookup := a.viewableGroupLookup(userId)
+	for _, group := range job.Groups {
+		groupId, detailedErr := lookup(group.Field, group.QueriedId)
+		if detailedErr != nil {
+			return detailedErr
+		}
+		if groupId != group.GroupId {
+			return error_no_view_permisson
+		}
+	}
+	return nil
+}
+
+func writeJob(res http.ResponseWriter, status int, job *model.Job) {
+	//the groups are only kept to check the results can still be viewed
+	shown := *job
+	shown.Groups = nil
+	jsonJob, _ := json.Marshal(&shown)
+	res.Header().Set("content-type", "application/json")
+	res.WriteHeader(status)
+	res.Write(jsonJob)
+}
+
+// http.StatusAccepted - the job that will run the query, its results can be fetched once it's done
+// http.StatusBadRequest - something was wrong with the request data
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - you can't view the data of the user, or one of the users in the cohort
+// http.StatusServiceUnavailable - too many jobs are waiting to run
+func (a *Api) SubmitJob(res http.ResponseWriter, req *http.Request) {
+
+	start := time.Now()
+
+	if td := a.authorized(req); td != nil {
+
+		if a.Jobs == nil {
+			jsonError(res, error_no_jobs, start)
+			return
+		}
+
+		query, detailedErr := a.prepareQuery(req, td)
+		if detailedErr != nil {
+			jsonError(res, detailedErr, start)
+			return
+		}
+		if query.paged {
+			jsonError(res, error_job_paged, start)
+			return
+		}
+
+		job := model.NewJob(uuid.NewV4().String(), td.UserID, query.format.contentType, start)
+		job.Groups = query.groups
+		//the job changes as it's run
+		submitted := *job
+
+		queued, err := a.Jobs.submit(&jobTask{job: job, qd: query.qd, format: query.format})
+		if err != nil {
+			jsonError(res, error_internal_server.setInternalMessage(err), start)
+			return
+		}
+		if !queued {
+			jsonError(res, error_jobs_busy, start)
+			return
+		}
+
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("SubmitJob: [%s] queued in [%.5f] secs", job.Id, time.Now().Sub(start).Seconds()))
+		writeJob(res, http.StatusAccepted, &submitted)
+		return
+	}
+	jsonError(res, error_not_authorized, start)
+	return
+}
+
+// http.StatusOK - the job and its status
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - someone else submitted the job
+// http.StatusNotFound - there is no job, or it has expired
+func (a *Api) GetJob(res http.ResponseWriter, req *http.Request, vars httpVars) {
+
+	start := time.Now()
+
+	if td := a.authorized(req); td != nil {
+
+		job, detailedErr := a.ownedJob(td.UserID, vars["jobID"])
+		if detailedErr != nil {
+			jsonError(res, detailedErr, start)
+			return
+		}
+
+		writeJob(res, http.StatusOK, job)
+		return
+	}
+	jsonError(res, error_not_authorized, start)
+	return
+}
+
+// http.StatusOK - the results of the job's query
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - someone else submitted the job, or you can no longer view the data of a user it queried
+// http.StatusNotFound - there is no job, or it has expired
+// http.StatusConflict - the job hasn't finished, or it failed
+func (a *Api) GetJobResult(res http.ResponseWriter, req *http.Request, vars httpVars) {
+
+	start := time.Now()
+
+	if td := a.authorized(req); td != nil {
+
+		job, detailedErr := a.ownedJob(td.UserID, vars["jobID"])
+		if detailedErr != nil {
+			jsonError(res, detailedErr, start)
+			return
+		}
+		if job.Status != model.JOB_DONE {
+			jsonError(res, error_job_not_done, start)
+			return
+		}
+		//who can view the data may have changed since it was submitted
+		if detailedErr := a.checkJobGroups(td.UserID, job); detailedErr != nil {
+			jsonError(res, detailedErr, start)
+			return
+		}
+
+		results, err := a.Jobs.jobs.ResultReader(job.Id)
+		if err == clients.ErrJobNotFound {
+			//expired since we looked
+			jsonError(res, error_job_not_found, start)
+			return
+		} else if err != nil {
+			jsonError(res, error_internal_server.setInternalMessage(err), start)
+			return
+		}
+		defer results.Close()
+
+		res.Header().Set("content-type", job.ContentType)
+		if _, err := io.Copy(res, results); err != nil {
+			log.Println(QUERY_API_PREFIX, fmt.Sprintf("GetJobResult: [%s] failed part way through the results with error [%s]", job.Id, err.Error()))
+			return
+		}
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("GetJobResult: [%s] completed in [%.5f] secs", job.Id, time.Now().Sub(start).Seconds()))
+		return
+	}
+	jsonError(res, error_not_authorized, start)
+	return
+}
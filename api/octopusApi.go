@@ -18,11 +18,15 @@ not, you can obtain one from Tidepool Project at tidepool.org.
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	httpgzip "github.com/daaku/go.httpgzip"
@@ -37,7 +41,33 @@ import (
 
 const (
 	SESSION_TOKEN    = "x-tidepool-session-token"
+	NEXT_CURSOR      = "x-tidepool-next-cursor"
 	QUERY_API_PREFIX = "api/query"
+
+	//the query parameters for a page of results
+	page_size_param   = "pageSize"
+	cursor_param      = "cursor"
+	default_page_size = 1000
+
+	//the query parameter for de-identified results
+	deidentify_param = "deidentify"
+
+	//the query parameters for the glucose statistics
+	start_date_param   = "startDate"
+	end_date_param     = "endDate"
+	units_param        = "units"
+	very_low_param     = "veryLow"
+	low_param          = "low"
+	high_param         = "high"
+	very_high_param    = "veryHigh"
+	default_stats_days = 14
+	slot_minutes_param = "slotMinutes"
+	timezone_param     = "timezone"
+	type_param         = "type"
+	minimum_gap_param  = "minimumGap"
+
+	//the longest period the statistics, AGP, totals and gaps are given for unless the config says otherwise
+	default_max_period_days = 90
 )
 
 type (
@@ -46,6 +76,12 @@ type (
 		ShorelineClient  ShorelineInterface
 		SeagullClient    SeagullInterface
 		GatekeeperClient GatekeeperInterface
+		//the secrets for de-identified results, they can't be given unless this is set
+		Deidentify *clients.DeidentifyConfig
+		//runs the queries submitted as jobs, there are no jobs unless this is set
+		Jobs *JobRunner
+		//the longest period in days the statistics, AGP, totals and gaps are given for, 90 when it isn't set
+		MaxPeriodDays int
 	}
 
 	ShorelineInterface interface {
@@ -56,19 +92,22 @@ type (
 
 	GatekeeperInterface interface {
 		UserInGroup(userID, groupID string) (commonClients.Permissions, error)
+		GroupsForUser(userID string) (UsersPermissions, error)
 	}
 
 	SeagullInterface interface {
 		GetPrivatePair(userID, hashName, token string) *commonClients.PrivatePair
+		GetCollection(userID, collectionName, token string, v interface{}) error
 	}
 
 	// so we can wrap and marshal the detailed error
 	detailedError struct {
-		Status          int    `json:"status"`
-		Id              string `json:"id"`
-		Code            string `json:"code"`
-		Message         string `json:"message"`
-		InternalMessage string `json:"-"` //used only for logging so we don't want to serialize it out
+		Status          int                 `json:"status"`
+		Id              string              `json:"id"`
+		Code            string              `json:"code"`
+		Message         string              `json:"message"`
+		Errors          []*model.ParseError `json:"errors,omitempty"` //where the query went wrong so it can be shown to the user
+		InternalMessage string              `json:"-"`                //used only for logging so we don't want to serialize it out
 	}
 
 	httpVars    map[string]string
@@ -79,14 +118,35 @@ type (
 var (
 	error_no_userid          = &detailedError{Status: http.StatusBadRequest, Code: "query_userid_notfound", Message: "userid not found"}
 	error_getting_permissons = &detailedError{Status: http.StatusBadRequest, Code: "query_permissons_notfound", Message: "user does not have any permissons"}
+	error_ambiguous_user     = &detailedError{Status: http.StatusBadRequest, Code: "query_userid_ambiguous", Message: "more than one user matches, query for them by userid instead"}
+	error_too_many_profiles  = &detailedError{Status: http.StatusBadRequest, Code: "query_too_many_profiles", Message: fmt.Sprintf("you can view the data of more than %d users, query for them by userid or username instead", max_profile_search)}
 	error_no_view_permisson  = &detailedError{Status: http.StatusForbidden, Code: "query_cant_view", Message: "user does not have permisson to view data"}
 	error_not_authorized     = &detailedError{Status: http.StatusUnauthorized, Code: "query_not_authorized", Message: "user is not authorized"}
 	error_building_query     = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_data", Message: "error building your query"}
+	error_invalid_page       = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_page", Message: "the pageSize must be a whole number greater than 0 and the cursor one we gave you"}
+	error_not_acceptable     = &detailedError{Status: http.StatusNotAcceptable, Code: "query_not_acceptable", Message: "results can only be given as application/json, application/x-ndjson or text/csv"}
+	error_invalid_stats      = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_stats", Message: "startDate and endDate must be ISO 8601 times with startDate first, units mg/dL or mmol/L and the thresholds numbers with veryLow < low < high < veryHigh"}
+	error_invalid_agp        = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_agp", Message: "slotMinutes must be 5 or 15 and timezone a zone such as America/Los_Angeles"}
+	error_invalid_totals     = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_totals", Message: "startDate and endDate must be ISO 8601 times with startDate first and timezone a zone such as America/Los_Angeles"}
+	error_invalid_gaps       = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_gaps", Message: "startDate and endDate must be ISO 8601 times with startDate first and minimumGap a duration longer than 0 e.g. 30m or 2h"}
+	error_invalid_deidentify = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_deidentify", Message: "deidentify must be true or false, and de-identified results are records so can't be paged or used with aggregates or BUCKET BY"}
+	error_job_paged          = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_job", Message: "jobs give all of the results so can't be paged"}
+	error_job_not_found      = &detailedError{Status: http.StatusNotFound, Code: "query_job_notfound", Message: "job not found, it may have expired"}
+	error_job_cant_view      = &detailedError{Status: http.StatusForbidden, Code: "query_job_cant_view", Message: "only the user who submitted the job can see it"}
+	error_job_not_done       = &detailedError{Status: http.StatusConflict, Code: "query_job_not_done", Message: "the job hasn't finished, or it failed"}
+	error_jobs_busy          = &detailedError{Status: http.StatusServiceUnavailable, Code: "query_jobs_busy", Message: "too many jobs are waiting to run, try again later"}
+	error_period_too_long    = &detailedError{Status: http.StatusBadRequest, Code: "query_period_too_long", Message: "the period from startDate to endDate is longer than the server allows"}
+	error_paged_order        = &detailedError{Status: http.StatusBadRequest, Code: "query_invalid_page_order", Message: "pages are always newest records first so can't be used with aggregates, BUCKET BY, ORDER BY, LIMIT or OFFSET"}
+	error_too_many_values    = &detailedError{Status: http.StatusBadRequest, Code: "query_too_many_values", Message: clients.ErrTooManyValues.Error()}
 
 	//generic server errors
 	error_internal_server = &detailedError{Status: http.StatusInternalServerError, Code: "query_intenal_error", Message: "internal server error"}
 	error_running_query   = &detailedError{Status: http.StatusInternalServerError, Code: "query_store_error", Message: "internal server error"}
 	error_status_check    = &detailedError{Status: http.StatusInternalServerError, Code: "query_status_check", Message: "internal server error"}
+	error_getting_profile = &detailedError{Status: http.StatusInternalServerError, Code: "query_profile_error", Message: "internal server error"}
+	error_no_jobs         = &detailedError{Status: http.StatusNotImplemented, Code: "query_jobs_unavailable", Message: "jobs aren't available"}
+	error_no_deidentify   = &detailedError{Status: http.StatusNotImplemented, Code: "query_deidentify_unavailable", Message: "de-identified results aren't available"}
+	error_no_cohorts      = &detailedError{Status: http.StatusNotImplemented, Code: "query_cohorts_unavailable", Message: "cohorts aren't available"}
 )
 
 //set this from the actual error if applicable
@@ -95,6 +155,21 @@ func (d *detailedError) setInternalMessage(internal error) *detailedError {
 	return d
 }
 
+//a copy of the error with the reasons the query couldn't be built
+func (d *detailedError) withParseErrors(errs []error) *detailedError {
+	withErrs := *d
+	withErrs.Errors = []*model.ParseError{}
+	for i := range errs {
+		if pe, ok := errs[i].(*model.ParseError); ok {
+			withErrs.Errors = append(withErrs.Errors, pe)
+		} else {
+			withErrs.Errors = append(withErrs.Errors, &model.ParseError{Message: errs[i].Error()})
+		}
+	}
+	withErrs.InternalMessage = fmt.Sprintf("%v", errs)
+	return &withErrs
+}
+
 //log error detail and write as application/json
 func jsonError(res http.ResponseWriter, err *detailedError, startedAt time.Time) {
 
@@ -104,8 +179,8 @@ func jsonError(res http.ResponseWriter, err *detailedError, startedAt time.Time)
 
 	jsonErr, _ := json.Marshal(err)
 
+	res.Header().Set("content-type", "application/json")
 	res.WriteHeader(err.Status)
-	res.Header().Add("content-type", "application/json")
 	res.Write(jsonErr)
 	return
 }
@@ -166,8 +241,17 @@ func (a *Api) SetHandlers(prefix string, rtr *mux.Router) {
 	rtr.HandleFunc("/status", a.GetStatus).Methods("GET")
 	rtr.Handle("/upload/lastentry/{userID}", varsHandler(a.TimeLastEntryUser)).Methods("GET")
 	rtr.Handle("/upload/lastentry/{userID}/{deviceID}", varsHandler(a.TimeLastEntryUserAndDevice)).Methods("GET")
+	rtr.Handle("/upload/gaps/{userID}", varsHandler(a.DataGaps)).Methods("GET")
+	rtr.Handle("/stats/glucose/{userID}", varsHandler(a.GlucoseStats)).Methods("GET")
+	rtr.Handle("/stats/agp/{userID}", varsHandler(a.AGP)).Methods("GET")
+	rtr.Handle("/stats/totals/{userID}", varsHandler(a.DailyTotals)).Methods("GET")
 
 	rtr.Handle("/data", httpgzip.NewHandler(gzipHandler(a.Query))).Methods("POST")
+	rtr.Handle("/batch", httpgzip.NewHandler(gzipHandler(a.BatchQuery))).Methods("POST")
+
+	rtr.HandleFunc("/jobs", a.SubmitJob).Methods("POST")
+	rtr.Handle("/jobs/{jobID}", varsHandler(a.GetJob)).Methods("GET")
+	rtr.Handle("/jobs/{jobID}/result", httpgzip.NewHandler(varsHandler(a.GetJobResult))).Methods("GET")
 
 }
 
@@ -257,6 +341,305 @@ func (a *Api) TimeLastEntryUserAndDevice(res http.ResponseWriter, req *http.Requ
 	return
 }
 
+// http.StatusOK, glucose statistics for the period
+// http.StatusBadRequest - something was wrong with the request data
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - you have a valid token but don't have permisson to look at the data
+func (a *Api) GlucoseStats(res http.ResponseWriter, req *http.Request, vars httpVars) {
+
+	start := time.Now()
+
+	groupId, detailedErr := a.viewableGroupId(req, vars["userID"])
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	query, detailedErr := statsQueryFrom(req)
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+	if detailedErr := a.checkPeriod(query.From, query.To); detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	stats, err := a.Store.GetGlucoseStats(groupId, query)
+	if err != nil {
+		jsonError(res, error_running_query.setInternalMessage(err), start)
+		return
+	}
+	log.Println(QUERY_API_PREFIX, fmt.Sprintf("GlucoseStats: completed in [%.5f] secs", time.Now().Sub(start).Seconds()))
+	res.Header().Set("content-type", "application/json")
+	res.Write(stats)
+	return
+}
+
+// http.StatusOK, percentiles of the cbg readings for each slot of the day
+// http.StatusBadRequest - something was wrong with the request data
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - you have a valid token but don't have permisson to look at the data
+func (a *Api) AGP(res http.ResponseWriter, req *http.Request, vars httpVars) {
+
+	start := time.Now()
+
+	groupId, detailedErr := a.viewableGroupId(req, vars["userID"])
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	query, detailedErr := agpQueryFrom(req)
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+	if detailedErr := a.checkPeriod(query.From, query.To); detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	report, err := a.Store.GetAGP(groupId, query)
+	if err != nil {
+		jsonError(res, error_running_query.setInternalMessage(err), start)
+		return
+	}
+	log.Println(QUERY_API_PREFIX, fmt.Sprintf("AGP: completed in [%.5f] secs", time.Now().Sub(start).Seconds()))
+	res.Header().Set("content-type", "application/json")
+	res.Write(report)
+	return
+}
+
+// http.StatusOK, insulin and carb totals for each day
+// http.StatusBadRequest - something was wrong with the request data
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - you have a valid token but don't have permisson to look at the data
+func (a *Api) DailyTotals(res http.ResponseWriter, req *http.Request, vars httpVars) {
+
+	start := time.Now()
+
+	groupId, detailedErr := a.viewableGroupId(req, vars["userID"])
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	query, detailedErr := totalsQueryFrom(req)
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+	if detailedErr := a.checkPeriod(query.From, query.To); detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	report, err := a.Store.GetDailyTotals(groupId, query)
+	if err != nil {
+		jsonError(res, error_running_query.setInternalMessage(err), start)
+		return
+	}
+	log.Println(QUERY_API_PREFIX, fmt.Sprintf("DailyTotals: completed in [%.5f] secs", time.Now().Sub(start).Seconds()))
+	res.Header().Set("content-type", "application/json")
+	res.Write(report)
+	return
+}
+
+// http.StatusOK, the gaps between the records of a type
+// http.StatusBadRequest - something was wrong with the request data
+// http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - you have a valid token but don't have permisson to look at the data
+func (a *Api) DataGaps(res http.ResponseWriter, req *http.Request, vars httpVars) {
+
+	start := time.Now()
+
+	groupId, detailedErr := a.viewableGroupId(req, vars["userID"])
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	query, detailedErr := gapsQueryFrom(req)
+	if detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+	if detailedErr := a.checkPeriod(query.From, query.To); detailedErr != nil {
+		jsonError(res, detailedErr, start)
+		return
+	}
+
+	report, err := a.Store.GetDataGaps(groupId, query)
+	if err != nil {
+		jsonError(res, error_running_query.setInternalMessage(err), start)
+		return
+	}
+	log.Println(QUERY_API_PREFIX, fmt.Sprintf("DataGaps: completed in [%.5f] secs", time.Now().Sub(start).Seconds()))
+	res.Header().Set("content-type", "application/json")
+	res.Write(report)
+	return
+}
+
+//the group id of the user's data when the token given is allowed to view it
+func (a *Api) viewableGroupId(req *http.Request, userId string) (string, *detailedError) {
+	td := a.authorized(req)
+	if td == nil {
+		return "", error_not_authorized
+	}
+	if !a.userCanViewData(td.UserID, userId) {
+		return "", error_no_view_permisson
+	}
+	return a.getGroupIdForUserId(userId)
+}
+
+//the period, units and thresholds from the parameters, by default the last 14 days in mg/dL with the consensus thresholds
+func statsQueryFrom(req *http.Request) (*model.StatsQuery, *detailedError) {
+	params := req.URL.Query()
+
+	query := &model.StatsQuery{Units: model.UNITS_MGDL}
+	if raw := params.Get(units_param); raw != "" {
+		units, err := model.ParseUnits(raw)
+		if err != nil {
+			return nil, error_invalid_stats.setInternalMessage(err)
+		}
+		query.Units = units
+	}
+
+	var err error
+	if query.From, query.To, err = periodFrom(params, model.Now()); err != nil {
+		return nil, error_invalid_stats.setInternalMessage(err)
+	}
+
+	query.Ranges = model.DefaultGlucoseRanges(query.Units)
+	thresholds := map[string]*float64{
+		very_low_param:  &query.Ranges.VeryLow,
+		low_param:       &query.Ranges.Low,
+		high_param:      &query.Ranges.High,
+		very_high_param: &query.Ranges.VeryHigh,
+	}
+	for param, threshold := range thresholds {
+		if raw := params.Get(param); raw != "" {
+			if *threshold, err = strconv.ParseFloat(raw, 64); err != nil {
+				return nil, error_invalid_stats.setInternalMessage(err)
+			}
+		}
+	}
+
+	if err := query.Validate(); err != nil {
+		return nil, error_invalid_stats.setInternalMessage(err)
+	}
+	return query, nil
+}
+
+//the period from the startDate and endDate, by default the 14 days up to the given time
+func periodFrom(params url.Values, defaultTo time.Time) (from, to time.Time, err error) {
+	to = defaultTo
+	if raw := params.Get(end_date_param); raw != "" {
+		if to, err = time.Parse(time.RFC3339Nano, raw); err != nil {
+			return from, to, err
+		}
+	}
+	from = to.AddDate(0, 0, -default_stats_days)
+	if raw := params.Get(start_date_param); raw != "" {
+		from, err = time.Parse(time.RFC3339Nano, raw)
+	}
+	return from, to, err
+}
+
+//the values for the whole period are held while the statistics are worked out, so it can't be any longer than the config allows
+func (a *Api) checkPeriod(from, to time.Time) *detailedError {
+	maxDays := a.MaxPeriodDays
+	if maxDays <= 0 {
+		maxDays = default_max_period_days
+	}
+	if to.After(from.AddDate(0, 0, maxDays)) {
+		return error_period_too_long
+	}
+	return nil
+}
+
+//the zone from the timezone parameter, UTC when there isn't one
+func locationFrom(params url.Values) (*time.Location, error) {
+	raw := params.Get(timezone_param)
+	//Local would be wherever the server happens to be
+	if raw == "Local" {
+		return nil, errors.New("the timezone can't be Local")
+	}
+	return time.LoadLocation(raw)
+}
+
+//the local days the totals are for, by default the 14 days up to the start of today in UTC
+func totalsQueryFrom(req *http.Request) (*model.TotalsQuery, *detailedError) {
+	params := req.URL.Query()
+
+	loc, err := locationFrom(params)
+	if err != nil {
+		return nil, error_invalid_totals.setInternalMessage(err)
+	}
+	now := model.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+
+	query := &model.TotalsQuery{Location: loc}
+	if query.From, query.To, err = periodFrom(params, today); err != nil {
+		return nil, error_invalid_totals.setInternalMessage(err)
+	}
+	if err := query.Validate(); err != nil {
+		return nil, error_invalid_totals.setInternalMessage(err)
+	}
+	return query, nil
+}
+
+//the type, period and minimum gap, by default cbg over the last 14 days with gaps of an hour or more
+func gapsQueryFrom(req *http.Request) (*model.GapsQuery, *detailedError) {
+	params := req.URL.Query()
+
+	query := &model.GapsQuery{Type: "cbg", MinimumGap: model.DEFAULT_MINIMUM_GAP}
+	if raw := params.Get(type_param); raw != "" {
+		query.Type = raw
+	}
+	var err error
+	if raw := params.Get(minimum_gap_param); raw != "" {
+		if query.MinimumGap, err = time.ParseDuration(raw); err != nil {
+			return nil, error_invalid_gaps.setInternalMessage(err)
+		}
+	}
+	if query.From, query.To, err = periodFrom(params, model.Now()); err != nil {
+		return nil, error_invalid_gaps.setInternalMessage(err)
+	}
+	if err := query.Validate(); err != nil {
+		return nil, error_invalid_gaps.setInternalMessage(err)
+	}
+	return query, nil
+}
+
+//the slots of the day and the timezone they are in as well as the period, units and thresholds, by default 15 minute slots in UTC
+func agpQueryFrom(req *http.Request) (*model.AGPQuery, *detailedError) {
+	stats, detailedErr := statsQueryFrom(req)
+	if detailedErr != nil {
+		return nil, detailedErr
+	}
+	params := req.URL.Query()
+
+	query := &model.AGPQuery{StatsQuery: *stats, Slot: model.DEFAULT_AGP_SLOT}
+	if raw := params.Get(slot_minutes_param); raw != "" {
+		minutes, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, error_invalid_agp.setInternalMessage(err)
+		}
+		query.Slot = time.Duration(minutes) * time.Minute
+	}
+	var err error
+	if query.Location, err = locationFrom(params); err != nil {
+		return nil, error_invalid_agp.setInternalMessage(err)
+	}
+
+	if err := query.Validate(); err != nil {
+		return nil, error_invalid_agp.setInternalMessage(err)
+	}
+	return query, nil
+}
+
 //build up valid QueryData from the request or return any detailedError that happens while trying to build it
 func buildQueryFrom(req *http.Request) (*model.QueryData, *detailedError) {
 	defer req.Body.Close()
@@ -275,13 +658,61 @@ func buildQueryFrom(req *http.Request) (*model.QueryData, *detailedError) {
 	errs, qd := model.BuildQuery(query)
 
 	if len(errs) != 0 {
-		buildError := error_building_query
-		buildError.Message = fmt.Sprintf("[%s] %v", buildError.Message, errs)
-		return nil, buildError
+		return nil, error_building_query.withParseErrors(errs)
 	}
 	return qd, nil
 }
 
+//if the results are to be de-identified, which can only be done for the records and when we have been configured to
+func (a *Api) deidentifyFrom(req *http.Request, qd *model.QueryData, paged bool) (bool, *detailedError) {
+	raw := req.URL.Query().Get(deidentify_param)
+	if raw == "" {
+		return false, nil
+	}
+	deidentify, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, error_invalid_deidentify
+	}
+	if !deidentify {
+		return false, nil
+	}
+	//aggregates can't be attributed to a user to shift their dates, and a cursor would give away the real time
+	if paged || qd.IsAggregate() {
+		return false, error_invalid_deidentify
+	}
+	if err := a.Deidentify.Validate(); err != nil {
+		return false, error_no_deidentify.setInternalMessage(err)
+	}
+	return true, nil
+}
+
+//the page of results asked for, if any, from the pageSize and cursor parameters
+func pageFrom(req *http.Request, qd *model.QueryData) (paged bool, after *model.Cursor, size int, detailedErr *detailedError) {
+	params := req.URL.Query()
+	rawSize, rawCursor := params.Get(page_size_param), params.Get(cursor_param)
+	if rawSize == "" && rawCursor == "" {
+		return false, nil, 0, nil
+	}
+	if len(qd.OrderBy) != 0 || qd.Limit != 0 || qd.Offset != 0 || qd.IsAggregate() {
+		return true, nil, 0, error_paged_order
+	}
+
+	size = default_page_size
+	if rawSize != "" {
+		var err error
+		if size, err = strconv.Atoi(rawSize); err != nil || size < 1 {
+			return true, nil, 0, error_invalid_page
+		}
+	}
+	if rawCursor != "" {
+		var err error
+		if after, err = model.ParseCursor(rawCursor); err != nil {
+			return true, nil, 0, error_invalid_page.setInternalMessage(err)
+		}
+	}
+	return true, after, size, nil
+}
+
 func (a *Api) getUserIdForQueriedId(queriedId string) (string, *detailedError) {
 	user, err := a.ShorelineClient.GetUser(queriedId, a.ShorelineClient.TokenProvide())
 	if err != nil {
@@ -298,9 +729,120 @@ func (a *Api) getGroupIdForUserId(userId string) (string, *detailedError) {
 	return group.ID, nil
 }
 
+//the groupId for the user looked up by the field, as long as the authenticated user can view their data
+func (a *Api) viewableQueriedGroupId(viewerId, field, queriedId string) (string, *detailedError) {
+	// Find the userId
+	userId, detailedErr := a.findUserId(viewerId, field, queriedId)
+	if detailedErr != nil {
+		return "", detailedErr
+	}
+	// Can the authenticated user view the requested user data?
+	if !a.userCanViewData(viewerId, userId) {
+		return "", error_no_view_permisson
+	}
+	// Find the groupId
+	return a.getGroupIdForUserId(userId)
+}
+
+//looks up the groupId of a user by the field, as long as the authenticated user can view their data
+type groupLookup func(field, queriedId string) (string, *detailedError)
+
+//look the users up for the authenticated user
+func (a *Api) viewableGroupLookup(viewerId string) groupLookup {
+	return func(field, queriedId string) (string, *detailedError) {
+		return a.viewableQueriedGroupId(viewerId, field, queriedId)
+	}
+}
+
+//keeps each group the lookup finds
+func recordedGroupLookup(lookup groupLookup, groups *[]model.QueriedGroup) groupLookup {
+	return func(field, queriedId string) (string, *detailedError) {
+		groupId, detailedErr := lookup(field, queriedId)
+		if detailedErr == nil {
+			*groups = append(*groups, model.QueriedGroup{Field: field, QueriedId: queriedId, GroupId: groupId})
+		}
+		return groupId, detailedErr
+	}
+}
+
+//the query is for the groupId of the user in the METAQUERY, or of each user in the cohort.
+//The authenticated user has to be able to view the data of all of them.
+//Each user in a cohort is given a subjectId hashed with the key the results are de-identified with.
+func setQueriedGroups(qd *model.QueryData, lookup groupLookup, keys *clients.DeidentifyConfig) *detailedError {
+	if !qd.IsCohort() {
+		groupId, detailedErr := lookup(qd.MetaQueryField, qd.GetMetaQueryId())
+		if detailedErr != nil {
+			return detailedErr
+		}
+		qd.SetMetaQueryId(groupId)
+		return nil
+	}
+	if _, err := keys.SubjectId(""); err != nil {
+		return error_no_cohorts.setInternalMessage(err)
+	}
+	for _, queriedId := range qd.Cohort {
+		groupId, detailedErr := lookup(model.META_USERID, queriedId)
+		if detailedErr != nil {
+			return detailedErr
+		}
+		subjectId, _ := keys.SubjectId(groupId)
+		qd.AddSubject(groupId, subjectId)
+	}
+	return nil
+}
+
+//a query built from the request, ready to run once the users it is for are found and checked
+type preparedQuery struct {
+	qd       *model.QueryData
+	format   *resultFormat
+	paged    bool
+	after    *model.Cursor
+	pageSize int
+	//the users the query is for
+	groups []model.QueriedGroup
+}
+
+//build the query from the request along with how its results are to be given
+func (a *Api) prepareQuery(req *http.Request, td *shoreline.TokenData) (*preparedQuery, *detailedError) {
+
+	//build the query
+	qd, detailedErr := buildQueryFrom(req)
+
+	if detailedErr != nil {
+		return nil, detailedErr
+	}
+
+	paged, after, pageSize, detailedErr := pageFrom(req, qd)
+	if detailedErr != nil {
+		return nil, detailedErr
+	}
+
+	deidentify, detailedErr := a.deidentifyFrom(req, qd, paged)
+	if detailedErr != nil {
+		return nil, detailedErr
+	}
+
+	format := negotiateFormat(req.Header.Get("accept"))
+	if format == nil {
+		return nil, error_not_acceptable
+	}
+	if deidentify {
+		format = format.deidentified(a.Deidentify)
+	}
+
+	// Find the groupId of each user the query is for
+	var groups []model.QueriedGroup
+	if detailedErr := setQueriedGroups(qd, recordedGroupLookup(a.viewableGroupLookup(td.UserID), &groups), a.Deidentify); detailedErr != nil {
+		return nil, detailedErr
+	}
+
+	return &preparedQuery{qd: qd, format: format, paged: paged, after: after, pageSize: pageSize, groups: groups}, nil
+}
+
 // http.StatusOK - the requested data
 // http.StatusBadRequest - something was wrong with the request data
 // http.StatusUnauthorized - you don't have a valid token
+// http.StatusForbidden - you can't view the data of the user, or one of the users in the cohort
 func (a *Api) Query(res http.ResponseWriter, req *http.Request) {
 
 	start := time.Now()
@@ -309,38 +851,20 @@ func (a *Api) Query(res http.ResponseWriter, req *http.Request) {
 
 		log.Println(QUERY_API_PREFIX, "Query: starting ... ")
 
-		//build the query
-		qd, detailedErr := buildQueryFrom(req)
-
-		if detailedErr != nil {
-			jsonError(res, detailedErr, start)
-			return
-		}
-
-		// Find the userId
-		userId, detailedErr := a.getUserIdForQueriedId(qd.GetMetaQueryId())
+		query, detailedErr := a.prepareQuery(req, td)
 		if detailedErr != nil {
 			jsonError(res, detailedErr, start)
 			return
 		}
 
-		// Can the authenticated user view the requested user data?
-		if !a.userCanViewData(td.UserID, userId) {
-			jsonError(res, error_no_view_permisson, start)
-			return
-		}
-
-		// Find the groupId
-		groupId, detailedErr := a.getGroupIdForUserId(userId)
-		if detailedErr != nil {
-			jsonError(res, detailedErr, start)
+		//run the query
+		if !query.paged {
+			a.streamQuery(res, query.qd, query.format, start)
 			return
 		}
 
-		qd.SetMetaQueryId(groupId)
-
-		//run the query
-		result, err := a.Store.ExecuteQuery(qd)
+		var page bytes.Buffer
+		next, err := a.Store.ExecuteQueryPage(query.qd, query.after, query.pageSize, query.format.newWriter(&page, query.qd))
 
 		if err != nil {
 			jsonError(res, error_running_query.setInternalMessage(err), start)
@@ -348,8 +872,11 @@ func (a *Api) Query(res http.ResponseWriter, req *http.Request) {
 		}
 		// yay we made it! lets give them what they asked for
 		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Query: completed in [%.5f] secs", time.Now().Sub(start).Seconds()))
-		res.Header().Set("content-type", "application/json")
-		res.Write(result)
+		if next != nil {
+			res.Header().Set(NEXT_CURSOR, next.String())
+		}
+		res.Header().Set("content-type", query.format.contentType)
+		res.Write(page.Bytes())
 		return
 
 	}
@@ -357,6 +884,43 @@ func (a *Api) Query(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
+//why the query failed, it's an internal error unless the query asked for more than the store will hold
+func queryFailed(err error) *detailedError {
+	if err == clients.ErrTooManyValues {
+		return error_too_many_values
+	}
+	return error_running_query.setInternalMessage(err)
+}
+
+//write the results as they are read from the store so we never hold all of them
+func (a *Api) streamQuery(res http.ResponseWriter, qd *model.QueryData, format *resultFormat, start time.Time) {
+
+	res.Header().Set("content-type", format.contentType)
+	stream := &trackingWriter{ResponseWriter: res}
+
+	if err := a.Store.StreamQuery(qd, format.newWriter(stream, qd)); err != nil {
+		if !stream.written {
+			jsonError(res, queryFailed(err), start)
+			return
+		}
+		//too late to tell them, they will be left with incomplete results
+		log.Println(QUERY_API_PREFIX, fmt.Sprintf("Query: failed after [%.5f] secs part way through the results with error [%s]", time.Now().Sub(start).Seconds(), err.Error()))
+		return
+	}
+	log.Println(QUERY_API_PREFIX, fmt.Sprintf("Query: completed in [%.5f] secs", time.Now().Sub(start).Seconds()))
+}
+
+//knows if anything has been written, after which we can no longer send an error
+type trackingWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
 func (h varsHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	h(res, req, vars)
@@ -20,15 +20,23 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	commonClients "github.com/tidepool-org/go-common/clients"
 	"github.com/tidepool-org/go-common/clients/shoreline"
 
 	"../clients"
+	"../model"
 )
 
 const (
@@ -42,6 +50,12 @@ const (
 	//invalid
 	invalid_token         = "token-invalid"
 	userid_no_match_found = "user-no-match"
+	userid_cant_view      = "user-cant-view"
+
+	//the users whose profiles can be searched, two of them have the same name
+	userid_patient_one = "patient-one"
+	userid_patient_two = "patient-two"
+	userid_patient_too = "patient-too"
 
 	//specified permissons only
 	token_can_only_upload  = "token-upload-only"
@@ -75,6 +89,10 @@ func (slc MockShorelineClient) TokenProvide() string {
 
 func (slc MockShorelineClient) GetUser(userID, token string) (*shoreline.UserData, error) {
 	log.Print("MockShorelineClient.GetUser", "return the user asked for")
+	if strings.Contains(userID, "@") {
+		//found by their email, which isn't their username
+		return &shoreline.UserData{UserID: userID, Username: "by-email", Emails: []string{userID}}, nil
+	}
 	return &shoreline.UserData{UserID: userID, Username: userID, Emails: []string{userID}}, nil
 }
 
@@ -86,12 +104,45 @@ func (sgc MockSeagullClient) GetPrivatePair(userID, hashName, token string) *com
 	return &commonClients.PrivatePair{ID: hashName, Value: "value-to-use"}
 }
 
+func (sgc MockSeagullClient) GetCollection(userID, collectionName, token string, v interface{}) error {
+	profiles := map[string]string{
+		valid_userid:       `{"fullName": "Greg Old"}`,
+		userid_patient_one: `{"fullName": "Pat Parent", "patient": {"fullName": "Jamie  Smith", "mrn": "0012345"}}`,
+		userid_patient_two: `{"fullName": "Alex Jones", "patient": {"mrn": "0067890"}}`,
+		userid_patient_too: `{"fullName": "alex jones"}`,
+	}
+	profile, ok := profiles[userID]
+	if !ok {
+		//seagull gives an empty collection when there isn't one
+		return nil
+	}
+	return json.Unmarshal([]byte(profile), v)
+}
+
+func (gkc MockGateKeeperClient) GroupsForUser(userID string) (UsersPermissions, error) {
+	view := commonClients.Permissions{"view": commonClients.Permission{}}
+	return UsersPermissions{
+		userid_patient_one: view,
+		userid_patient_two: view,
+		userid_patient_too: view,
+		//no profile
+		userid_no_match_found: view,
+		//can't view their data
+		userid_cant_view: commonClients.Permissions{"upload": commonClients.Permission{}},
+	}, nil
+}
+
 func (gkc MockGateKeeperClient) UserInGroup(userID, groupID string) (commonClients.Permissions, error) {
 	permissonsToReturn := make(commonClients.Permissions)
 	p := make(commonClients.Permission)
 
 	log.Printf("user [%s] group [%s]", userID, groupID)
 
+	if groupID == userid_cant_view {
+		log.Println("MockGateKeeperClient.UserInGroup", "no perms")
+		return permissonsToReturn, nil
+	}
+
 	if userID == userid_can_only_upload {
 		log.Println("MockGateKeeperClient.UserInGroup", "Allow `upload` perms only")
 		p["userid"] = userID
@@ -107,6 +158,9 @@ func (gkc MockGateKeeperClient) UserInGroup(userID, groupID string) (commonClien
 
 // initialize the api in a working state:
 // we may reset some clients depending on what we are trying to assert in our tests
+// the secrets for de-identified results and the subjectIds of cohorts
+var deidentify_for_test = &clients.DeidentifyConfig{Key: "some-key", ShiftSeed: "some-seed", MaxShiftDays: 30}
+
 func initApiForTest() *Api {
 	return InitApi(
 		MockShorelineClient{},
@@ -240,16 +294,15 @@ func Test_TimeLastEntryUserAndDevice_Forbidden(t *testing.T) {
 	}
 }
 
+// the query is posted as the raw text
 func encodeQuery(queryString string) *bytes.Buffer {
-	var body = &bytes.Buffer{}
-	json.NewEncoder(body).Encode(queryString)
-	return body
+	return bytes.NewBufferString(queryString)
 }
 
 func Test_Query_Unauthorized(t *testing.T) {
 
 	//query is valid
-	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg SORT BY time AS Timestamp REVERSED")
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
 
 	req, _ := http.NewRequest("POST", "/", body)
 	req.Header.Set(SESSION_TOKEN, invalid_token)
@@ -265,7 +318,7 @@ func Test_Query_Unauthorized(t *testing.T) {
 func Test_Query_Forbidden(t *testing.T) {
 
 	//query is valid
-	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg SORT BY time AS Timestamp REVERSED")
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
 
 	req, _ := http.NewRequest("POST", "/", body)
 	req.Header.Set(SESSION_TOKEN, token_can_only_upload)
@@ -294,10 +347,38 @@ func Test_Query_BadRequest(t *testing.T) {
 	}
 }
 
+func Test_Query_BadRequest_ParseErrors(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa\nQUERY TYPE IN cbg\nWHERE time => 2015-01-01T00:00:00.000Z")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Query(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusBadRequest)
+	}
+
+	var given detailedError
+	if err := json.Unmarshal(res.Body.Bytes(), &given); err != nil {
+		t.Fatalf("error body [%s] should be json but %s", res.Body.String(), err.Error())
+	}
+
+	if given.Code != error_building_query.Code || len(given.Errors) != 1 {
+		t.Fatalf("expected one parse error but got %s", res.Body.String())
+	}
+
+	if given.Errors[0].Line != 3 || given.Errors[0].Column != 12 || given.Errors[0].Token != "=>" || len(given.Errors[0].Expected) == 0 {
+		t.Fatalf("parse error should be for [=>] at line 3 column 12 but got %#v", given.Errors[0])
+	}
+}
+
 func Test_Query_InternalServerError(t *testing.T) {
 
 	//query is valid
-	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg SORT BY time AS Timestamp REVERSED")
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
 
 	req, _ := http.NewRequest("POST", "/", body)
 	req.Header.Set(SESSION_TOKEN, valid_token)
@@ -312,3 +393,1315 @@ func Test_Query_InternalServerError(t *testing.T) {
 		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusInternalServerError)
 	}
 }
+
+func Test_Query_Paged_OK(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	req, _ := http.NewRequest("POST", "/?pageSize=100", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Query(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+
+	if res.Body.String() != `[{"type":"ExecuteQueryPage"}]` {
+		t.Fatalf("expected a page of results but got [%s]", res.Body.String())
+	}
+
+	next, err := model.ParseCursor(res.Header().Get(NEXT_CURSOR))
+	if err != nil || next.Id != "54a4cf6b4c3c5cfe5ba0a6e1" {
+		t.Fatalf("expected the cursor for the next page but got [%s]", res.Header().Get(NEXT_CURSOR))
+	}
+}
+
+func Test_Query_Paged_LastPage(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	cursor := &model.Cursor{Time: "2015-01-01T00:00:00.000Z", Id: "54a4cf6b4c3c5cfe5ba0a6e1"}
+	req, _ := http.NewRequest("POST", "/?cursor="+cursor.String(), body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	//set the store so there are no more pages
+	octo.Store = clients.NewMockStoreClient(SOME_SALT, true, false)
+	octo.Query(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+
+	if next := res.Header().Get(NEXT_CURSOR); next != "" {
+		t.Fatalf("there should be no cursor after the last page but got [%s]", next)
+	}
+}
+
+func Test_Query_Paged_BadRequest(t *testing.T) {
+
+	pages := map[string]string{
+		"/?pageSize=0":           "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+		"/?pageSize=ten":         "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+		"/?cursor=notourcursor":  "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+		"/?pageSize=10&offset=1": "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg ORDER BY value",
+		"/?pageSize=20":          "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 10",
+		"/?pageSize=30":          "METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT COUNT(*) TYPE IN cbg",
+	}
+
+	for url, query := range pages {
+		req, _ := http.NewRequest("POST", url, encodeQuery(query))
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.Query(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", url, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_Query_OK(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Query(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+
+	//the results are streamed from the store
+	if res.Body.String() != `[{"type":"StreamQuery"}]` {
+		t.Fatalf("expected the streamed results but got [%s]", res.Body.String())
+	}
+
+	if contentType := res.Header().Get("content-type"); contentType != "application/json" {
+		t.Fatalf("content-type given [%s] expected [application/json]", contentType)
+	}
+}
+
+func Test_Query_Cohort_OK(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IN 12d7bc90fa, 5a8c1e2f QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Deidentify = deidentify_for_test
+	octo.Query(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != `[{"type":"StreamQuery"}]` {
+		t.Fatalf("expected the streamed results but got [%s]", res.Body.String())
+	}
+}
+
+func Test_Query_Cohort_Forbidden(t *testing.T) {
+
+	//they can view the first user's data but not the second's
+	body := encodeQuery("METAQUERY WHERE userid IN 12d7bc90fa, " + userid_cant_view + " QUERY TYPE IN cbg, smbg")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Deidentify = deidentify_for_test
+	octo.Query(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+}
+
+func Test_Query_Cohort_BadRequest(t *testing.T) {
+
+	//the second user has no data
+	body := encodeQuery("METAQUERY WHERE userid IN 12d7bc90fa, " + userid_no_match_found + " QUERY TYPE IN cbg, smbg")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Deidentify = deidentify_for_test
+	octo.Query(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_Query_Cohort_NotConfigured(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IN 12d7bc90fa, 5a8c1e2f QUERY TYPE IN cbg, smbg")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	//the subjectIds can't be hashed without the key
+	octo := initApiForTest()
+	octo.Query(res, req)
+	if res.Code != http.StatusNotImplemented {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusNotImplemented)
+	}
+}
+
+func Test_Query_MetaQueryFields_OK(t *testing.T) {
+
+	metaQueries := []string{
+		"METAQUERY WHERE UserId IS 12d7bc90fa",
+		"METAQUERY WHERE emails CONTAINS foo@bar.org",
+		"METAQUERY WHERE username IS 12d7bc90fa",
+		"METAQUERY WHERE fullName IS 'jamie smith'",
+		"METAQUERY WHERE mrn IS 0067890",
+		"METAQUERY WHERE fullname IS 'Greg Old'",
+	}
+
+	for _, metaQuery := range metaQueries {
+		body := encodeQuery(metaQuery + " QUERY TYPE IN cbg")
+
+		req, _ := http.NewRequest("POST", "/", body)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.Query(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", metaQuery, res.Code, http.StatusOK)
+		}
+	}
+}
+
+func Test_Query_MetaQueryFields_BadRequest(t *testing.T) {
+
+	metaQueries := map[string]string{
+		//found by email rather than username
+		"METAQUERY WHERE username IS foo@bar.org":  error_no_userid.Code,
+		"METAQUERY WHERE fullName IS Nobody":       error_no_userid.Code,
+		"METAQUERY WHERE mrn IS 0099999":           error_no_userid.Code,
+		"METAQUERY WHERE fullName IS 'Alex Jones'": error_ambiguous_user.Code,
+	}
+
+	for metaQuery, code := range metaQueries {
+		body := encodeQuery(metaQuery + " QUERY TYPE IN cbg")
+
+		req, _ := http.NewRequest("POST", "/", body)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.Query(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", metaQuery, res.Code, http.StatusBadRequest)
+		}
+		var detailedErr detailedError
+		json.Unmarshal(res.Body.Bytes(), &detailedErr)
+		if detailedErr.Code != code {
+			t.Fatalf("[%s] given [%s] expected [%s]", metaQuery, detailedErr.Code, code)
+		}
+	}
+}
+
+//can't get the profile of one of the users
+type failingProfileSeagull struct {
+	MockSeagullClient
+	failFor string
+}
+
+func (f failingProfileSeagull) GetCollection(userID, collectionName, token string, v interface{}) error {
+	if userID == f.failFor {
+		return errors.New("seagull is unavailable")
+	}
+	return f.MockSeagullClient.GetCollection(userID, collectionName, token, v)
+}
+
+//can view the data of more users than we will look through
+type manyGroupsGatekeeper struct {
+	MockGateKeeperClient
+}
+
+func (m manyGroupsGatekeeper) GroupsForUser(userID string) (UsersPermissions, error) {
+	groups := UsersPermissions{}
+	for i := 0; i <= max_profile_search; i++ {
+		groups[fmt.Sprintf("group%d", i)] = commonClients.Permissions{"view": commonClients.Permission{}}
+	}
+	return groups, nil
+}
+
+func Test_Query_MetaQueryFields_ProfileErrors(t *testing.T) {
+
+	//the profile that can't be read could be another match
+	octo := initApiForTest()
+	octo.SeagullClient = failingProfileSeagull{failFor: userid_patient_too}
+	if _, detailedErr := octo.viewableQueriedGroupId(userid_patient_one, model.META_MRN, "0012345"); detailedErr == nil || detailedErr.Status != http.StatusInternalServerError {
+		t.Fatalf("given %v but expected the lookup to fail", detailedErr)
+	}
+
+	octo = initApiForTest()
+	octo.GatekeeperClient = manyGroupsGatekeeper{}
+	if _, detailedErr := octo.viewableQueriedGroupId(userid_patient_one, model.META_MRN, "0012345"); detailedErr == nil || detailedErr.Code != error_too_many_profiles.Code {
+		t.Fatalf("given %v but expected too many profiles to look through", detailedErr)
+	}
+}
+
+//the hosts of a service we started for the test
+type testHosts []url.URL
+
+func (h testHosts) HostGet() []url.URL {
+	return h
+}
+
+//gatekeeper and seagull as the adapters call them
+func initCommonServicesForTest(t *testing.T) (testHosts, func()) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/access/groups/"+valid_userid, func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(SESSION_TOKEN) != valid_token {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		res.Write([]byte(`{"` + userid_patient_one + `": {"view": {}}}`))
+	})
+	mux.HandleFunc("/"+userid_patient_one+"/"+profile_collection, func(res http.ResponseWriter, req *http.Request) {
+		res.Write([]byte(`{"fullName": "Jane Doe", "patient": {"mrn": "0012345"}}`))
+	})
+	mux.HandleFunc("/"+userid_patient_too+"/"+profile_collection, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusInternalServerError)
+	})
+	server := httptest.NewServer(mux)
+
+	host, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testHosts{*host}, server.Close
+}
+
+func Test_GatekeeperAdapter_GroupsForUser(t *testing.T) {
+
+	hosts, stop := initCommonServicesForTest(t)
+	defer stop()
+
+	gatekeeper := NewGatekeeperAdapter(nil, hosts, http.DefaultClient, MockShorelineClient{})
+	groups, err := gatekeeper.GroupsForUser(valid_userid)
+	if err != nil || len(groups) != 1 || groups[userid_patient_one]["view"] == nil {
+		t.Fatalf("given %v and error %v but expected to view %s", groups, err, userid_patient_one)
+	}
+
+	//unknown to gatekeeper
+	if groups, err = gatekeeper.GroupsForUser(userid_cant_view); err != nil || len(groups) != 0 {
+		t.Fatalf("given %v and error %v but expected no groups", groups, err)
+	}
+
+	if _, err = NewGatekeeperAdapter(nil, testHosts{}, http.DefaultClient, MockShorelineClient{}).GroupsForUser(valid_userid); err != ErrNoHost {
+		t.Fatalf("given %v but expected %v", err, ErrNoHost)
+	}
+}
+
+func Test_SeagullAdapter_GetCollection(t *testing.T) {
+
+	hosts, stop := initCommonServicesForTest(t)
+	defer stop()
+
+	seagull := NewSeagullAdapter(nil, hosts, http.DefaultClient)
+
+	var profile userProfile
+	if err := seagull.GetCollection(userid_patient_one, profile_collection, valid_token, &profile); err != nil || profile.FullName != "Jane Doe" || profile.Patient.Mrn != "0012345" {
+		t.Fatalf("given %v and error %v but expected the profile of Jane Doe", profile, err)
+	}
+
+	//no profile leaves it empty
+	profile = userProfile{}
+	if err := seagull.GetCollection(valid_userid, profile_collection, valid_token, &profile); err != nil || profile.FullName != "" {
+		t.Fatalf("given %v and error %v but expected no profile", profile, err)
+	}
+
+	if err := seagull.GetCollection(userid_patient_too, profile_collection, valid_token, &profile); err == nil {
+		t.Fatal("expected an error when seagull fails")
+	}
+}
+
+func Test_Query_Deidentify_OK(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	req, _ := http.NewRequest("POST", "/?deidentify=true", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Deidentify = deidentify_for_test
+	octo.Query(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != `[{"type":"StreamQuery"}]` {
+		t.Fatalf("expected the streamed results but got [%s]", res.Body.String())
+	}
+}
+
+func Test_Query_Deidentify_BadRequest(t *testing.T) {
+
+	queries := map[string]string{
+		"/?deidentify=perhaps":            "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+		"/?deidentify=true&pageSize=100":  "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+		"/?deidentify=true":               "METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT COUNT(*) TYPE IN cbg",
+		"/?deidentify=true&cursor=abcdef": "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 1h",
+	}
+
+	for url, query := range queries {
+		req, _ := http.NewRequest("POST", url, encodeQuery(query))
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.Deidentify = deidentify_for_test
+		octo.Query(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] [%s] Resp given [%d] expected [%d] ", url, query, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_Query_Deidentify_NotConfigured(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	req, _ := http.NewRequest("POST", "/?deidentify=true", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Query(res, req)
+	if res.Code != http.StatusNotImplemented {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusNotImplemented)
+	}
+}
+
+func Test_Query_Formats(t *testing.T) {
+
+	formats := map[string]string{
+		"application/x-ndjson":                 "{\"type\":\"StreamQuery\"}\n",
+		"text/csv":                             "type\nStreamQuery\n",
+		"text/csv;q=0.5, application/x-ndjson": "{\"type\":\"StreamQuery\"}\n",
+		"text/*":                               "type\nStreamQuery\n",
+		"*/*":                                  `[{"type":"StreamQuery"}]`,
+		"text/html, application/json;q=0.9":    `[{"type":"StreamQuery"}]`,
+	}
+
+	for accept, expected := range formats {
+		body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg")
+
+		req, _ := http.NewRequest("POST", "/", body)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		req.Header.Set("accept", accept)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.Query(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", accept, res.Code, http.StatusOK)
+		}
+		if res.Body.String() != expected {
+			t.Fatalf("[%s] given [%s] expected [%s]", accept, res.Body.String(), expected)
+		}
+	}
+}
+
+func Test_Query_NotAcceptable(t *testing.T) {
+
+	body := encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	req.Header.Set("accept", "application/xml, text/csv;q=0")
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Query(res, req)
+	if res.Code != http.StatusNotAcceptable {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusNotAcceptable)
+	}
+}
+
+func Test_GlucoseStats_OK(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/?startDate=2015-01-01T00:00:00Z&endDate=2015-01-15T00:00:00Z&units=mmol/L", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.GlucoseStats(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != "GetGlucoseStats" {
+		t.Fatalf("given [%s] expected [GetGlucoseStats]", res.Body.String())
+	}
+}
+
+func Test_GlucoseStats_BadRequest(t *testing.T) {
+
+	invalid := []string{
+		"/?startDate=yesterday",
+		"/?startDate=2015-01-15T00:00:00Z&endDate=2015-01-01T00:00:00Z",
+		"/?units=mg",
+		"/?low=seventy",
+		"/?low=200",
+	}
+
+	for _, url := range invalid {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.GlucoseStats(res, req, httpVars{"userID": valid_userid})
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", url, res.Code, http.StatusBadRequest)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.GlucoseStats(res, req, httpVars{"userID": userid_no_match_found})
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_GlucoseStats_Unauthorized(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, invalid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.GlucoseStats(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_GlucoseStats_Forbidden(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, token_can_only_upload)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.GlucoseStats(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+}
+
+func Test_StatsQueryFrom(t *testing.T) {
+	now := time.Date(2015, 3, 15, 12, 0, 0, 0, time.UTC)
+	model.SetClock(func() time.Time { return now })
+	defer model.SetClock(nil)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	query, err := statsQueryFrom(req)
+	if err != nil {
+		t.Fatalf("there should be no error but got %v", err)
+	}
+	if !query.To.Equal(now) || !query.From.Equal(now.AddDate(0, 0, -14)) {
+		t.Fatalf("given %v to %v but expected the 14 days up to %v", query.From, query.To, now)
+	}
+	if query.Units != model.UNITS_MGDL || query.Ranges != model.DefaultGlucoseRanges(model.UNITS_MGDL) {
+		t.Fatalf("given %s %v but expected mg/dL and the consensus thresholds", query.Units, query.Ranges)
+	}
+
+	req, _ = http.NewRequest("GET", "/?units=MMOL/L&high=8.5", nil)
+	query, _ = statsQueryFrom(req)
+	if query.Units != model.UNITS_MMOLL || query.Ranges.High != 8.5 || query.Ranges.Low != 3.9 {
+		t.Fatalf("given %s %v but expected mmol/L with a high of 8.5", query.Units, query.Ranges)
+	}
+}
+
+func Test_AGP_OK(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/?slotMinutes=5&timezone=America/Los_Angeles", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.AGP(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != "GetAGP" {
+		t.Fatalf("given [%s] expected [GetAGP]", res.Body.String())
+	}
+}
+
+func Test_AGP_BadRequest(t *testing.T) {
+
+	invalid := []string{
+		"/?slotMinutes=10",
+		"/?slotMinutes=fifteen",
+		"/?timezone=Mars/Olympus_Mons",
+		"/?timezone=Local",
+		"/?units=mg",
+	}
+
+	for _, url := range invalid {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.AGP(res, req, httpVars{"userID": valid_userid})
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", url, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_AGP_Unauthorized(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, invalid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.AGP(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_AGP_Forbidden(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, token_can_only_upload)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.AGP(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+}
+
+func Test_DailyTotals_OK(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/?startDate=2015-01-01T00:00:00-08:00&endDate=2015-01-08T00:00:00-08:00&timezone=America/Los_Angeles", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.DailyTotals(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != "GetDailyTotals" {
+		t.Fatalf("given [%s] expected [GetDailyTotals]", res.Body.String())
+	}
+}
+
+func Test_DailyTotals_BadRequest(t *testing.T) {
+
+	invalid := []string{
+		"/?startDate=2015-01-08T00:00:00Z&endDate=2015-01-01T00:00:00Z",
+		"/?endDate=tomorrow",
+		"/?timezone=Mars/Olympus_Mons",
+		"/?timezone=Local",
+	}
+
+	for _, url := range invalid {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.DailyTotals(res, req, httpVars{"userID": valid_userid})
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", url, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_DailyTotals_Unauthorized(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, invalid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.DailyTotals(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_DailyTotals_Forbidden(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, token_can_only_upload)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.DailyTotals(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+}
+
+func Test_TotalsQueryFrom(t *testing.T) {
+	model.SetClock(func() time.Time { return time.Date(2015, 3, 15, 3, 0, 0, 0, time.UTC) })
+	defer model.SetClock(nil)
+
+	req, _ := http.NewRequest("GET", "/?timezone=America/Los_Angeles", nil)
+	query, err := totalsQueryFrom(req)
+	if err != nil {
+		t.Fatalf("there should be no error but got %v", err)
+	}
+
+	//it is still the 14th in Los Angeles
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	today := time.Date(2015, 3, 14, 0, 0, 0, 0, la)
+	if !query.To.Equal(today) || !query.From.Equal(today.AddDate(0, 0, -14)) || query.Location.String() != "America/Los_Angeles" {
+		t.Fatalf("given %v to %v but expected the 14 days up to %v", query.From, query.To, today)
+	}
+}
+
+func Test_DataGaps_OK(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/?type=smbg&minimumGap=30m&startDate=2015-01-01T00:00:00Z&endDate=2015-01-15T00:00:00Z", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.DataGaps(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != "GetDataGaps" {
+		t.Fatalf("given [%s] expected [GetDataGaps]", res.Body.String())
+	}
+}
+
+func Test_DataGaps_BadRequest(t *testing.T) {
+
+	invalid := []string{
+		"/?minimumGap=long",
+		"/?minimumGap=0s",
+		"/?minimumGap=-1h",
+		"/?startDate=2015-01-08T00:00:00Z&endDate=2015-01-01T00:00:00Z",
+	}
+
+	for _, url := range invalid {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo := initApiForTest()
+		octo.DataGaps(res, req, httpVars{"userID": valid_userid})
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", url, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_DataGaps_Unauthorized(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, invalid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.DataGaps(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_DataGaps_Forbidden(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, token_can_only_upload)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.DataGaps(res, req, httpVars{"userID": valid_userid})
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+}
+
+func Test_Stats_PeriodTooLong(t *testing.T) {
+
+	handlers := map[string]func(*Api) func(http.ResponseWriter, *http.Request, httpVars){
+		"GlucoseStats": func(a *Api) func(http.ResponseWriter, *http.Request, httpVars) { return a.GlucoseStats },
+		"AGP":          func(a *Api) func(http.ResponseWriter, *http.Request, httpVars) { return a.AGP },
+		"DailyTotals":  func(a *Api) func(http.ResponseWriter, *http.Request, httpVars) { return a.DailyTotals },
+		"DataGaps":     func(a *Api) func(http.ResponseWriter, *http.Request, httpVars) { return a.DataGaps },
+	}
+
+	periods := []struct {
+		maxDays  int
+		url      string
+		expected int
+	}{
+		{0, "/?startDate=2015-01-01T00:00:00Z&endDate=2015-04-01T00:00:00Z", http.StatusOK},
+		{0, "/?startDate=2015-01-01T00:00:00Z&endDate=2015-04-02T00:00:00Z", http.StatusBadRequest},
+		{30, "/?startDate=2015-01-01T00:00:00Z&endDate=2015-01-31T00:00:00Z", http.StatusOK},
+		{30, "/?startDate=2015-01-01T00:00:00Z&endDate=2015-02-01T00:00:00Z", http.StatusBadRequest},
+	}
+
+	for name, handler := range handlers {
+		for _, period := range periods {
+			req, _ := http.NewRequest("GET", period.url, nil)
+			req.Header.Set(SESSION_TOKEN, valid_token)
+			res := httptest.NewRecorder()
+
+			octo := initApiForTest()
+			octo.MaxPeriodDays = period.maxDays
+			handler(octo)(res, req, httpVars{"userID": valid_userid})
+			if res.Code != period.expected {
+				t.Fatalf("%s [%d days][%s] Resp given [%d] expected [%d] ", name, period.maxDays, period.url, res.Code, period.expected)
+			}
+		}
+	}
+}
+
+//a runner for the jobs kept in a directory that is removed once the test is done
+func initJobsForTest(octo *Api, t *testing.T) func() {
+	directory, err := ioutil.TempDir("", "octopus-jobs")
+	if err != nil {
+		t.Fatalf("couldn't make the directory: %s", err.Error())
+	}
+	jobStore, _ := clients.NewDiskJobStore(directory)
+	if octo.Jobs, err = NewJobRunner(octo.Store, jobStore, &clients.JobsConfig{Workers: 1, QueueSize: 1, TTL: "1h"}); err != nil {
+		t.Fatalf("couldn't make the runner: %s", err.Error())
+	}
+	return func() {
+		octo.Jobs.Stop()
+		os.RemoveAll(directory)
+	}
+}
+
+func submitJobForTest(octo *Api, query string, t *testing.T) *model.Job {
+	req, _ := http.NewRequest("POST", "/", encodeQuery(query))
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo.SubmitJob(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusAccepted)
+	}
+	job := &model.Job{}
+	json.Unmarshal(res.Body.Bytes(), job)
+	return job
+}
+
+//wait for the job to finish, it is run in the background
+func waitForJobForTest(octo *Api, id string, t *testing.T) *model.Job {
+	for tries := 0; tries < 100; tries++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo.GetJob(res, req, httpVars{"jobID": id})
+		if res.Code != http.StatusOK {
+			t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+		}
+		job := &model.Job{}
+		json.Unmarshal(res.Body.Bytes(), job)
+		if job.IsFinished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the job [%s] didn't finish", id)
+	return nil
+}
+
+func Test_SubmitJob_OK(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	job := submitJobForTest(octo, "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, smbg", t)
+	if job.Id == "" || job.UserId != valid_userid || job.Status != model.JOB_QUEUED || job.ContentType != "application/json" {
+		t.Fatalf("given %v but expected a queued job", job)
+	}
+
+	if finished := waitForJobForTest(octo, job.Id, t); finished.Status != model.JOB_DONE || finished.Expires == "" || finished.Groups != nil {
+		t.Fatalf("given %v but expected a job that is done", finished)
+	}
+	//the users it queried are kept with it
+	if kept, _ := octo.Jobs.jobs.GetJob(job.Id); len(kept.Groups) != 1 || kept.Groups[0].QueriedId != "12d7bc90fa" || kept.Groups[0].GroupId == "" {
+		t.Fatalf("given %v but expected the queried group to be kept", kept.Groups)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo.GetJobResult(res, req, httpVars{"jobID": job.Id})
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if res.Body.String() != `[{"type":"StreamQuery"}]` {
+		t.Fatalf("expected the results but got [%s]", res.Body.String())
+	}
+	if contentType := res.Header().Get("content-type"); contentType != "application/json" {
+		t.Fatalf("content-type given [%s] expected [application/json]", contentType)
+	}
+}
+
+func Test_SubmitJob_Failed(t *testing.T) {
+
+	octo := initApiForTest()
+	//the store will throw an exception
+	octo.Store = clients.NewMockStoreClient(SOME_SALT, false, true)
+	defer initJobsForTest(octo, t)()
+
+	job := submitJobForTest(octo, "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg", t)
+
+	//the reason is logged rather than given to the user
+	if finished := waitForJobForTest(octo, job.Id, t); finished.Status != model.JOB_FAILED || finished.Error != error_job_failed.Error() {
+		t.Fatalf("given %v but expected a failed job", finished)
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo.GetJobResult(res, req, httpVars{"jobID": job.Id})
+	if res.Code != http.StatusConflict {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusConflict)
+	}
+}
+
+func Test_SubmitJob_BadRequest(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	queries := map[string]string{
+		"/":              "METAQUERY WHERE REVERSED",
+		"/?pageSize=100": "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+	}
+	for url, query := range queries {
+		req, _ := http.NewRequest("POST", url, encodeQuery(query))
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo.SubmitJob(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", url, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_SubmitJob_Unauthorized(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	req, _ := http.NewRequest("POST", "/", encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"))
+	req.Header.Set(SESSION_TOKEN, invalid_token)
+	res := httptest.NewRecorder()
+
+	octo.SubmitJob(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_SubmitJob_Busy(t *testing.T) {
+
+	directory, _ := ioutil.TempDir("", "octopus-jobs")
+	defer os.RemoveAll(directory)
+	jobStore, _ := clients.NewDiskJobStore(directory)
+
+	//no workers and no room for a job to wait
+	octo := initApiForTest()
+	octo.Jobs = &JobRunner{store: octo.Store, jobs: jobStore, ttl: time.Hour, queue: make(chan *jobTask)}
+
+	req, _ := http.NewRequest("POST", "/", encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"))
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo.SubmitJob(res, req)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusServiceUnavailable)
+	}
+	//it isn't kept
+	if jobs, _ := jobStore.ListJobs(); len(jobs) != 0 {
+		t.Fatalf("given %v but expected no jobs", jobs)
+	}
+}
+
+func Test_SubmitJob_NotConfigured(t *testing.T) {
+
+	req, _ := http.NewRequest("POST", "/", encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"))
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.SubmitJob(res, req)
+	if res.Code != http.StatusNotImplemented {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusNotImplemented)
+	}
+}
+
+func Test_GetJob_Forbidden(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	job := submitJobForTest(octo, "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg", t)
+	waitForJobForTest(octo, job.Id, t)
+
+	//someone else
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(SESSION_TOKEN, token_can_only_upload)
+
+	res := httptest.NewRecorder()
+	octo.GetJob(res, req, httpVars{"jobID": job.Id})
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+
+	res = httptest.NewRecorder()
+	octo.GetJobResult(res, req, httpVars{"jobID": job.Id})
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusForbidden)
+	}
+}
+
+func Test_GetJob_NotFound(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	for _, id := range []string{"6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b", "../config/server"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+
+		res := httptest.NewRecorder()
+		octo.GetJob(res, req, httpVars{"jobID": id})
+		if res.Code != http.StatusNotFound {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", id, res.Code, http.StatusNotFound)
+		}
+
+		res = httptest.NewRecorder()
+		octo.GetJobResult(res, req, httpVars{"jobID": id})
+		if res.Code != http.StatusNotFound {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", id, res.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func Test_GetJobResult_NoLongerViewable(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	job := submitJobForTest(octo, "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg", t)
+	waitForJobForTest(octo, job.Id, t)
+
+	kept, _ := octo.Jobs.jobs.GetJob(job.Id)
+	groupId := kept.Groups[0].GroupId
+
+	for name, groups := range map[string][]model.QueriedGroup{
+		"none":        nil,
+		"cant_view":   {{Field: model.META_USERID, QueriedId: userid_cant_view, GroupId: groupId}},
+		"other_group": {{Field: model.META_USERID, QueriedId: "12d7bc90fa", GroupId: "some-other-group"}},
+	} {
+		kept.Groups = groups
+		octo.Jobs.jobs.SaveJob(kept)
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(SESSION_TOKEN, valid_token)
+
+		res := httptest.NewRecorder()
+		octo.GetJobResult(res, req, httpVars{"jobID": job.Id})
+		if res.Code != http.StatusForbidden {
+			t.Fatalf("[%s] Resp given [%d] expected [%d] ", name, res.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func Test_JobRunner_Stop(t *testing.T) {
+
+	octo := initApiForTest()
+	defer initJobsForTest(octo, t)()
+
+	octo.Jobs.Stop()
+	//it's fine to stop it again
+	octo.Jobs.Stop()
+
+	req, _ := http.NewRequest("POST", "/", encodeQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"))
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo.SubmitJob(res, req)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusServiceUnavailable)
+	}
+	if jobs, _ := octo.Jobs.jobs.ListJobs(); len(jobs) != 0 {
+		t.Fatalf("given %v but expected no jobs", jobs)
+	}
+}
+
+func Test_JobRunner_ExpireAndAbandon(t *testing.T) {
+
+	directory, _ := ioutil.TempDir("", "octopus-jobs")
+	defer os.RemoveAll(directory)
+	jobStore, _ := clients.NewDiskJobStore(directory)
+
+	now := time.Now()
+	finished := model.NewJob("6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b", valid_userid, "text/csv", now.Add(-3*time.Hour))
+	finished.Finish(now.Add(-2*time.Hour), time.Hour, nil)
+	running := model.NewJob("0a1b2c3d-3b4d-4e5f-8a7b-9c0d1e2f3a4b", valid_userid, "text/csv", now)
+	running.Start(now)
+	jobStore.SaveJob(finished)
+	jobStore.SaveJob(running)
+
+	//the running job was left behind when the last runner stopped
+	runner, err := NewJobRunner(clients.NewMockStoreClient(SOME_SALT, false, false), jobStore, &clients.JobsConfig{Workers: 1, TTL: "1h"})
+	if err != nil {
+		t.Fatalf("couldn't make the runner: %s", err.Error())
+	}
+	defer runner.Stop()
+	if abandoned, _ := jobStore.GetJob(running.Id); abandoned.Status != model.JOB_FAILED || abandoned.Error != error_job_abandoned.Error() {
+		t.Fatalf("given %v but expected the job to have failed", abandoned)
+	}
+
+	runner.expire(now)
+	if jobs, _ := jobStore.ListJobs(); len(jobs) != 1 || jobs[0].Id != running.Id {
+		t.Fatalf("given %v but expected only the job that was running", jobs)
+	}
+}
+
+func Test_BatchQuery_Unauthorized(t *testing.T) {
+
+	body := bytes.NewBufferString(`[{"name":"cbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"}]`)
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, invalid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.BatchQuery(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_BatchQuery_BadRequest(t *testing.T) {
+
+	tooMany := []string{}
+	for i := 0; i <= max_batch_size; i++ {
+		tooMany = append(tooMany, fmt.Sprintf(`{"name":"q%d","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"}`, i))
+	}
+
+	batches := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg",
+		`{"name":"cbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"}`,
+		`[]`,
+		`[null]`,
+		`[{"query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"}]`,
+		`[{"name":"cbg"}]`,
+		`[{"name":"cbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"},{"name":"cbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN smbg"}]`,
+		"[" + strings.Join(tooMany, ",") + "]",
+	}
+
+	octo := initApiForTest()
+
+	for _, batch := range batches {
+		req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(batch))
+		req.Header.Set(SESSION_TOKEN, valid_token)
+		res := httptest.NewRecorder()
+
+		octo.BatchQuery(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("given [%s] resp given [%d] expected [%d] ", batch, res.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_BatchQuery_OK(t *testing.T) {
+
+	body := bytes.NewBufferString(`[
+		{"name":"cbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > 2015-01-01T00:00:00.000Z LIMIT 100"},
+		{"name":"smbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN smbg WHERE time > 2015-01-01T00:00:00.000Z LIMIT 100"},
+		{"name":"cohort","query":"METAQUERY WHERE userid IN 12d7bc90fa, 5a8c1e2f QUERY TYPE IN bolus LIMIT 100"}
+	]`)
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.Deidentify = deidentify_for_test
+	octo.BatchQuery(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+	if contentType := res.Header().Get("content-type"); contentType != "application/json" {
+		t.Fatalf("content-type given [%s] expected [application/json]", contentType)
+	}
+
+	var given map[string]*batchResult
+	if err := json.Unmarshal(res.Body.Bytes(), &given); err != nil {
+		t.Fatalf("body [%s] should be json but %s", res.Body.String(), err.Error())
+	}
+	if len(given) != 3 {
+		t.Fatalf("expected the results of the 3 queries but got %s", res.Body.String())
+	}
+	for name, result := range given {
+		if result.Status != http.StatusOK || result.Error != nil || string(result.Results) != `[{"type":"StreamQuery"}]` {
+			t.Fatalf("expected the results of [%s] but got %s", name, res.Body.String())
+		}
+	}
+}
+
+func Test_BatchQuery_MoreQueriesThanWorkers(t *testing.T) {
+
+	queries := []string{}
+	for i := 0; i < max_batch_size; i++ {
+		queries = append(queries, fmt.Sprintf(`{"name":"cbg%d","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 100"}`, i))
+	}
+	body := bytes.NewBufferString("[" + strings.Join(queries, ",") + "]")
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.BatchQuery(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+
+	var given map[string]*batchResult
+	json.Unmarshal(res.Body.Bytes(), &given)
+	if len(given) != max_batch_size {
+		t.Fatalf("expected the results of all %d queries but got %s", max_batch_size, res.Body.String())
+	}
+	for name, result := range given {
+		if result.Status != http.StatusOK {
+			t.Fatalf("expected the results of [%s] but got %s", name, res.Body.String())
+		}
+	}
+}
+
+func Test_BatchQuery_QueryErrors(t *testing.T) {
+
+	body := bytes.NewBufferString(`[
+		{"name":"ok","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 100"},
+		{"name":"invalid","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time => 2015-01-01T00:00:00.000Z LIMIT 100"},
+		{"name":"cant_view","query":"METAQUERY WHERE userid IS ` + userid_cant_view + ` QUERY TYPE IN cbg LIMIT 100"},
+		{"name":"cant_view_again","query":"METAQUERY WHERE userid IS ` + userid_cant_view + ` QUERY TYPE IN smbg LIMIT 100"},
+		{"name":"no_limit","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg"},
+		{"name":"aggregate","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg SELECT AVG(value)"},
+		{"name":"bucket","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 1h"}
+	]`)
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	octo.BatchQuery(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+
+	var given map[string]*batchResult
+	if err := json.Unmarshal(res.Body.Bytes(), &given); err != nil {
+		t.Fatalf("body [%s] should be json but %s", res.Body.String(), err.Error())
+	}
+
+	if given["ok"] == nil || given["ok"].Status != http.StatusOK {
+		t.Fatalf("expected the results of the valid query but got %s", res.Body.String())
+	}
+	if given["invalid"] == nil || given["invalid"].Status != http.StatusBadRequest || given["invalid"].Error == nil || len(given["invalid"].Error.Errors) != 1 {
+		t.Fatalf("expected the parse error of the invalid query but got %s", res.Body.String())
+	}
+	if given["cant_view"] == nil || given["cant_view"].Status != http.StatusForbidden || given["cant_view"].Error.Code != error_no_view_permisson.Code {
+		t.Fatalf("expected the query that can't be viewed to be forbidden but got %s", res.Body.String())
+	}
+	//each query has an error of its own
+	if given["cant_view_again"] == nil || given["cant_view_again"].Status != http.StatusForbidden || given["cant_view_again"].Error.Id == given["cant_view"].Error.Id {
+		t.Fatalf("expected each forbidden query to have its own error but got %s", res.Body.String())
+	}
+	if given["no_limit"] == nil || given["no_limit"].Status != http.StatusBadRequest || given["no_limit"].Error.Code != error_batch_limit.Code {
+		t.Fatalf("expected the query without a LIMIT to be refused but got %s", res.Body.String())
+	}
+	//aggregates don't need one
+	if given["aggregate"] == nil || given["aggregate"].Status != http.StatusOK || given["bucket"] == nil || given["bucket"].Status != http.StatusOK {
+		t.Fatalf("expected the aggregates to be run without a LIMIT but got %s", res.Body.String())
+	}
+}
+
+func Test_BatchQuery_InternalServerError(t *testing.T) {
+
+	body := bytes.NewBufferString(`[{"name":"cbg","query":"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 100"}]`)
+
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set(SESSION_TOKEN, valid_token)
+	res := httptest.NewRecorder()
+
+	octo := initApiForTest()
+	//set the store so it will throw an error
+	octo.Store = clients.NewMockStoreClient(SOME_SALT, false, true)
+
+	octo.BatchQuery(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("Resp given [%d] expected [%d] ", res.Code, http.StatusOK)
+	}
+
+	var given map[string]*batchResult
+	if err := json.Unmarshal(res.Body.Bytes(), &given); err != nil {
+		t.Fatalf("body [%s] should be json but %s", res.Body.String(), err.Error())
+	}
+	if given["cbg"] == nil || given["cbg"].Status != http.StatusInternalServerError || given["cbg"].Error.Code != error_running_query.Code {
+		t.Fatalf("expected the query to have failed but got %s", res.Body.String())
+	}
+}
+
+func Test_cachedGroupLookup(t *testing.T) {
+
+	lookups := 0
+	lookup := cachedGroupLookup(func(field, queriedId string) (string, *detailedError) {
+		lookups++
+		if queriedId == userid_cant_view {
+			return "", error_no_view_permisson
+		}
+		return "group-" + queriedId, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		if groupId, err := lookup(model.META_USERID, "12d7bc90fa"); groupId != "group-12d7bc90fa" || err != nil {
+			t.Fatalf("given [%s] %v but expected [group-12d7bc90fa]", groupId, err)
+		}
+		if _, err := lookup(model.META_USERID, userid_cant_view); err == nil || err.Code != error_no_view_permisson.Code {
+			t.Fatalf("given %v but expected %v", err, error_no_view_permisson)
+		}
+	}
+	//the same id for another field is another user
+	lookup(model.META_USERNAME, "12d7bc90fa")
+
+	if lookups != 3 {
+		t.Fatalf("given %d lookups but expected 3", lookups)
+	}
+}
+
+func Test_queryFailed(t *testing.T) {
+
+	if failed := queryFailed(clients.ErrTooManyValues); failed.Status != http.StatusBadRequest || failed.Code != error_too_many_values.Code {
+		t.Fatalf("given %v but expected the query to be bad", failed)
+	}
+	if failed := queryFailed(errors.New("mongo error")); failed.Status != http.StatusInternalServerError || failed.Code != error_running_query.Code {
+		t.Fatalf("given %v but expected an internal error", failed)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package api
+
+import (
+	"log"
+	"strings"
+
+	"../model"
+)
+
+const (
+	//the seagull collection with the user's profile
+	profile_collection = "profile"
+	//the most profiles we will look through to find a user by their name or MRN
+	max_profile_search = 100
+)
+
+type (
+	//the parts of the seagull profile we can look a user up by, the patient is set when the account is for someone else
+	userProfile struct {
+		FullName string `json:"fullName"`
+		Patient  struct {
+			FullName string `json:"fullName"`
+			Mrn      string `json:"mrn"`
+		} `json:"patient"`
+	}
+)
+
+//the name of the person whose data it is
+func (p *userProfile) patientName() string {
+	if p.Patient.FullName != "" {
+		return p.Patient.FullName
+	}
+	return p.FullName
+}
+
+//true when the profile has the value for the field, names are compared ignoring case and extra spaces
+func (p *userProfile) matches(field, value string) bool {
+	switch field {
+	case model.META_FULL_NAME:
+		return strings.EqualFold(strings.Join(strings.Fields(p.patientName()), " "), strings.Join(strings.Fields(value), " "))
+	case model.META_MRN:
+		return p.Patient.Mrn != "" && strings.TrimSpace(p.Patient.Mrn) == strings.TrimSpace(value)
+	}
+	return false
+}
+
+//the userId of the user looked up by the field, one of the METAQUERY fields
+func (a *Api) findUserId(viewerId, field, value string) (string, *detailedError) {
+	switch field {
+	case model.META_USERNAME:
+		return a.getUserIdForUsername(value)
+	case model.META_FULL_NAME, model.META_MRN:
+		return a.getUserIdForProfile(viewerId, field, value)
+	}
+	//shoreline finds users by their userid or email
+	return a.getUserIdForQueriedId(value)
+}
+
+//shoreline will also find a user by their email, so we make sure it is their username
+func (a *Api) getUserIdForUsername(username string) (string, *detailedError) {
+	user, err := a.ShorelineClient.GetUser(username, a.ShorelineClient.TokenProvide())
+	if err != nil {
+		return "", error_no_userid.setInternalMessage(err)
+	}
+	if user == nil || !strings.EqualFold(user.Username, username) {
+		return "", error_no_userid
+	}
+	return user.UserID, nil
+}
+
+//there is no search on profiles so we look through those of the users whose data the authenticated user can view,
+//there has to be exactly one that matches. We have to be able to read all of them, as the one we can't could also match.
+func (a *Api) getUserIdForProfile(viewerId, field, value string) (string, *detailedError) {
+	groups, err := a.GatekeeperClient.GroupsForUser(viewerId)
+	if err != nil {
+		return "", error_no_userid.setInternalMessage(err)
+	}
+
+	//they can always view their own data
+	candidates := []string{viewerId}
+	for groupId, perms := range groups {
+		if groupId != viewerId && (perms["root"] != nil || perms["view"] != nil) {
+			candidates = append(candidates, groupId)
+		}
+	}
+
+	if len(candidates) > max_profile_search {
+		return "", error_too_many_profiles
+	}
+
+	var found []string
+	for _, userId := range candidates {
+		var profile userProfile
+		if err := a.SeagullClient.GetCollection(userId, profile_collection, a.ShorelineClient.TokenProvide(), &profile); err != nil {
+			log.Println(QUERY_API_PREFIX, "Error getting the profile for", userId, err)
+			return "", error_getting_profile.setInternalMessage(err)
+		}
+		if profile.matches(field, value) {
+			found = append(found, userId)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", error_no_userid
+	case 1:
+		return found[0], nil
+	}
+	return "", error_ambiguous_user
+}
@@ -0,0 +1,207 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+
+	"../model"
+)
+
+var (
+	//fields that identify the user, their uploads or devices are given as keyed hashes
+	hashed_fields = []string{"_groupId", "_userId", model.SUBJECT_ID_FIELD, "userid", "userId", "byUser", "uploadId", "deviceId", "id", "guid"}
+	//the only other fields given, in records or those nested in them. Anything else, such as notes, payloads
+	//or serial numbers, could identify the user so is removed. The times are shifted by the user's date shift.
+	kept_fields = []string{"type", "subType", "deliveryType", "value", "units", "bg", "carb",
+		"normal", "extended", "expectedNormal", "expectedExtended", "duration", "expectedDuration", "rate", "percent", "suppressed",
+		"carbInput", "insulinCarbRatio", "insulinSensitivity", "insulinOnBoard", "bgInput", "bgTarget", "low", "high", "target", "range",
+		"recommended", "correction", "net", "carbRatio", "start", "amount",
+		"timezoneOffset", "conversionOffset", "clockDriftOffset", "reason", "status", "alarmType", "changeType", "primeTarget", "volume"}
+
+	//the layouts the times can be in, so they are given back in the same one
+	shifted_layouts = []string{model.TIME_FORMAT, model.LOCAL_TIME_FORMAT, time.RFC3339Nano, model.DEVICE_TIME_FORMAT}
+)
+
+func isOneOf(field string, fields []string) bool {
+	for i := range fields {
+		if fields[i] == field {
+			return true
+		}
+	}
+	return false
+}
+
+type (
+	// DeidentifyConfig has the secrets de-identified results are worked out with, they come from
+	// the server's config so the same user always gets the same hashes and date shift
+	DeidentifyConfig struct {
+		//the key the identifiers are hashed with
+		Key string `json:"key"`
+		//the seed each user's date shift is worked out from
+		ShiftSeed string `json:"shiftSeed"`
+		//the most days a user's dates are shifted by, earlier or later
+		MaxShiftDays int `json:"maxShiftDays"`
+	}
+
+	// de-identifies each record before it is written
+	deidentifyingWriter struct {
+		out    RecordWriter
+		config *DeidentifyConfig
+		//the groupId of the user the records are for, or of each subjectId for a cohort
+		groupId  string
+		subjects map[string]string
+	}
+)
+
+// Validate that we have everything we need to de-identify results
+func (c *DeidentifyConfig) Validate() error {
+	if c == nil || c.Key == "" || c.ShiftSeed == "" || c.MaxShiftDays < 1 {
+		return errors.New("de-identifying needs a key, shiftSeed and maxShiftDays greater than 0")
+	}
+	return nil
+}
+
+func keyedHash(key, value string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// Hash the identifier with the key, the same identifier always gives the same hash
+func (c *DeidentifyConfig) Hash(value string) string {
+	return hex.EncodeToString(keyedHash(c.Key, value)[:16])
+}
+
+// SubjectId is the pseudonym for the user with the groupId in a cohort's results. It is keyed so it can't be
+// worked out from the groupId, and is the same as their _groupId in de-identified results.
+func (c *DeidentifyConfig) SubjectId(groupId string) (string, error) {
+	if c == nil || c.Key == "" {
+		return "", errors.New("cohorts need the deidentify key their subjectIds are hashed with")
+	}
+	return c.Hash(groupId), nil
+}
+
+// ShiftDays is the number of days the dates of the user with the groupId are shifted by, always the same for them
+func (c *DeidentifyConfig) ShiftDays(groupId string) int {
+	sum := keyedHash(c.ShiftSeed, groupId)
+	span := uint64(2*c.MaxShiftDays + 1)
+	return int(binary.BigEndian.Uint64(sum[:8])%span) - c.MaxShiftDays
+}
+
+// NewDeidentifyingWriter writes the records for the query to out once they are de-identified
+func NewDeidentifyingWriter(out RecordWriter, config *DeidentifyConfig, details *model.QueryData) RecordWriter {
+	d := &deidentifyingWriter{out: out, config: config, groupId: details.GetMetaQueryId()}
+	if details.IsCohort() {
+		d.subjects = map[string]string{}
+		for groupId, subjectId := range details.Subjects {
+			d.subjects[subjectId] = groupId
+		}
+	}
+	return d
+}
+
+//the groupId of the user the record is for
+func (d *deidentifyingWriter) groupIdOf(record map[string]interface{}) string {
+	if groupId, ok := record["_groupId"].(string); ok {
+		return groupId
+	}
+	if subjectId, ok := record[model.SUBJECT_ID_FIELD].(string); ok && d.subjects != nil {
+		return d.subjects[subjectId]
+	}
+	return d.groupId
+}
+
+//the time moved by the days, in the layout it was in. It is nil when it isn't a time we know.
+func shiftTime(value interface{}, days int) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	for _, layout := range shifted_layouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t.AddDate(0, 0, days).Format(layout)
+		}
+	}
+	return nil
+}
+
+//the record and those nested in it with only the fields we keep, their identifiers hashed and their times shifted
+func (d *deidentifyingWriter) deidentify(record map[string]interface{}, days int) {
+	for field, value := range record {
+		switch {
+		case isOneOf(field, hashed_fields):
+			if field == model.SUBJECT_ID_FIELD || field == "_groupId" {
+				//the same hash as the user's _groupId
+				value = d.groupIdOf(record)
+			}
+			if text, ok := value.(string); ok {
+				record[field] = d.config.Hash(text)
+			} else {
+				delete(record, field)
+			}
+		case model.IsTimeField(field):
+			//we can't leave a time we can't shift
+			if shifted := shiftTime(value, days); shifted != nil {
+				record[field] = shifted
+			} else {
+				delete(record, field)
+			}
+		case isOneOf(field, kept_fields):
+			d.deidentifyNested(value, days)
+		default:
+			delete(record, field)
+		}
+	}
+}
+
+//the records nested in the value, including those in lists
+func (d *deidentifyingWriter) deidentifyNested(value interface{}, days int) {
+	switch nested := value.(type) {
+	case bson.M:
+		d.deidentify(nested, days)
+	case map[string]interface{}:
+		d.deidentify(nested, days)
+	case []interface{}:
+		for i := range nested {
+			d.deidentifyNested(nested[i], days)
+		}
+	}
+}
+
+func (d *deidentifyingWriter) WriteRecord(record map[string]interface{}) error {
+	days := d.config.ShiftDays(d.groupIdOf(record))
+	d.deidentify(record, days)
+	return d.out.WriteRecord(record)
+}
+
+func (d *deidentifyingWriter) Close() error {
+	return d.out.Close()
+}
+
+func (d *deidentifyingWriter) Abort() {
+	d.out.Abort()
+}
+
@@ -0,0 +1,189 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+
+	"../model"
+)
+
+var (
+	deidentify_config = &DeidentifyConfig{Key: "some-key", ShiftSeed: "some-seed", MaxShiftDays: 30}
+)
+
+func TestDeidentifyConfig(t *testing.T) {
+
+	if err := deidentify_config.Validate(); err != nil {
+		t.Fatalf("the config should be valid but given %s", err.Error())
+	}
+	invalid := []*DeidentifyConfig{nil, {ShiftSeed: "some-seed", MaxShiftDays: 30}, {Key: "some-key", MaxShiftDays: 30}, {Key: "some-key", ShiftSeed: "some-seed"}}
+	for i := range invalid {
+		if err := invalid[i].Validate(); err == nil {
+			t.Fatalf("%v should have given an error", invalid[i])
+		}
+	}
+
+	//the same each time but only with the same key
+	hash := deidentify_config.Hash("1234")
+	if hash == "1234" || len(hash) != 32 || hash != deidentify_config.Hash("1234") {
+		t.Fatalf("given hash %s", hash)
+	}
+	if other := (&DeidentifyConfig{Key: "other-key"}).Hash("1234"); other == hash {
+		t.Fatalf("given the same hash %s with another key", other)
+	}
+
+	//each user is shifted by their own days, which are always the same for them
+	shifts := map[int]bool{}
+	for _, groupId := range []string{"a", "b", "c", "d", "e", "f"} {
+		days := deidentify_config.ShiftDays(groupId)
+		if days < -30 || days > 30 || days != deidentify_config.ShiftDays(groupId) {
+			t.Fatalf("given a shift of %d days for %s", days, groupId)
+		}
+		shifts[days] = true
+	}
+	if len(shifts) < 2 {
+		t.Fatalf("every user was given the same shift %v", shifts)
+	}
+}
+
+func TestDeidentifyConfig_SubjectId(t *testing.T) {
+
+	//the same as the user's de-identified _groupId
+	subjectId, err := deidentify_config.SubjectId("1234")
+	if err != nil || subjectId != deidentify_config.Hash("1234") {
+		t.Fatalf("given %s %v but expected %s", subjectId, err, deidentify_config.Hash("1234"))
+	}
+
+	for _, config := range []*DeidentifyConfig{nil, {ShiftSeed: "some-seed", MaxShiftDays: 30}} {
+		if _, err := config.SubjectId("1234"); err == nil {
+			t.Fatalf("%v has no key so should have given an error", config)
+		}
+	}
+}
+
+func TestShiftTime(t *testing.T) {
+
+	times := map[string]string{
+		"2015-01-13T08:44:04.000Z":      "2015-01-16T08:44:04.000Z",
+		"2015-01-13T00:44:04.000-08:00": "2015-01-16T00:44:04.000-08:00",
+		"2015-01-13T08:44:04Z":          "2015-01-16T08:44:04Z",
+		"2015-01-13T08:44:04":           "2015-01-16T08:44:04",
+	}
+	for given, expected := range times {
+		if shifted := shiftTime(given, 3); shifted != expected {
+			t.Fatalf("given %v but expected %s", shifted, expected)
+		}
+	}
+	if shifted := shiftTime("yesterday", 3); shifted != nil {
+		t.Fatalf("given %v but expected nothing", shifted)
+	}
+}
+
+func deidentifyAll(details *model.QueryData, records []map[string]interface{}, t *testing.T) []map[string]interface{} {
+	var written bytes.Buffer
+	out := NewDeidentifyingWriter(NewJSONWriter(&written), deidentify_config, details)
+	for i := range records {
+		if err := out.WriteRecord(records[i]); err != nil {
+			t.Fatalf("writing the record %v gave %s", records[i], err.Error())
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("close gave %s", err.Error())
+	}
+	var results []map[string]interface{}
+	json.Unmarshal(written.Bytes(), &results)
+	return results
+}
+
+func TestDeidentifyingWriter(t *testing.T) {
+
+	details := &model.QueryData{MetaQuery: map[string]string{model.ANYID: "1234"}}
+	records := []map[string]interface{}{
+		bson.M{"_groupId": "1234", "type": "smbg", "time": "2015-01-13T08:44:04.000Z", "deviceTime": "2015-01-13T00:44:04", "value": 5.5,
+			"uploadId": "upid_abc", "deviceId": "Meter-1234", "notes": "at Jamie's party", "payload": bson.M{"serial": "1234"}},
+		//without its _groupId when they are hidden
+		bson.M{"type": "basal", "time": "2015-01-13T09:00:00.000Z", "byUser": "5678", "_userId": "5678", "deviceSerialNumber": "1234", "scheduleName": "Jamie's school",
+			"suppressed": bson.M{"deviceId": "Meter-1234", "time": "2015-01-13T09:00:00.000Z", "rate": 0.5},
+			"carbRatio":  []interface{}{bson.M{"start": 0, "amount": 10, "id": "cr_1", "notes": "at Jamie's"}, 12}},
+	}
+
+	results := deidentifyAll(details, records, t)
+	if len(results) != 2 {
+		t.Fatalf("given %v but expected two records", results)
+	}
+
+	shifted := shiftTime("2015-01-13T08:44:04.000Z", deidentify_config.ShiftDays("1234"))
+	first := results[0]
+	if first["_groupId"] != deidentify_config.Hash("1234") || first["uploadId"] != deidentify_config.Hash("upid_abc") || first["deviceId"] != deidentify_config.Hash("Meter-1234") {
+		t.Fatalf("the identifiers weren't hashed %v", first)
+	}
+	if first["time"] != shifted || first["deviceTime"] != shiftTime("2015-01-13T00:44:04", deidentify_config.ShiftDays("1234")) {
+		t.Fatalf("the times weren't shifted %v", first)
+	}
+	if first["notes"] != nil || first["payload"] != nil || first["value"] != 5.5 || first["type"] != "smbg" {
+		t.Fatalf("given %v", first)
+	}
+
+	second := results[1]
+	nested, _ := second["suppressed"].(map[string]interface{})
+	if second["byUser"] != deidentify_config.Hash("5678") || second["_userId"] != deidentify_config.Hash("5678") || nested["deviceId"] != first["deviceId"] || nested["rate"] != 0.5 {
+		t.Fatalf("the identifiers weren't hashed %v", second)
+	}
+	if second["deviceSerialNumber"] != nil || second["scheduleName"] != nil {
+		t.Fatalf("only the fields we keep should be given %v", second)
+	}
+	//shifted by the same days as the first as they are for the same user
+	if second["time"] != shiftTime("2015-01-13T09:00:00.000Z", deidentify_config.ShiftDays("1234")) || nested["time"] != second["time"] {
+		t.Fatalf("the times weren't shifted %v", second)
+	}
+
+	//and those in lists
+	ratios, _ := second["carbRatio"].([]interface{})
+	ratio, _ := ratios[0].(map[string]interface{})
+	if len(ratios) != 2 || ratio["id"] != deidentify_config.Hash("cr_1") || ratio["notes"] != nil || ratio["amount"] != 10.0 || ratios[1] != 12.0 {
+		t.Fatalf("the records in the list weren't de-identified %v", second["carbRatio"])
+	}
+}
+
+func TestDeidentifyingWriter_Cohort(t *testing.T) {
+
+	details := &model.QueryData{Cohort: []string{"12d7bc90fa", "5a8c1e2f"}}
+	details.AddSubject("1234", deidentify_config.Hash("1234"))
+	details.AddSubject("5678", deidentify_config.Hash("5678"))
+
+	records := []map[string]interface{}{
+		bson.M{model.SUBJECT_ID_FIELD: details.Subjects["1234"], "type": "cbg", "time": "2015-01-13T08:44:04.000Z"},
+		bson.M{model.SUBJECT_ID_FIELD: details.Subjects["5678"], "type": "cbg", "time": "2015-01-13T08:44:04.000Z"},
+	}
+
+	results := deidentifyAll(details, records, t)
+
+	for i, groupId := range []string{"1234", "5678"} {
+		if results[i][model.SUBJECT_ID_FIELD] != deidentify_config.Hash(groupId) {
+			t.Fatalf("given subject %v but expected %s", results[i][model.SUBJECT_ID_FIELD], deidentify_config.Hash(groupId))
+		}
+		if expected := shiftTime("2015-01-13T08:44:04.000Z", deidentify_config.ShiftDays(groupId)); results[i]["time"] != expected {
+			t.Fatalf("given time %v but expected %v", results[i]["time"], expected)
+		}
+	}
+}
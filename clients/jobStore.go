@@ -0,0 +1,207 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"../model"
+)
+
+const (
+	job_file_suffix    = ".json"
+	result_file_suffix = ".result"
+)
+
+var (
+	//the ids we give jobs, anything else can't be one of ours
+	job_id = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+	ErrJobNotFound = errors.New("job not found")
+)
+
+type (
+	// JobsConfig says how many jobs are run at once and how long their results are kept
+	JobsConfig struct {
+		//the number of jobs run at the same time
+		Workers int `json:"workers"`
+		//the most jobs that can be waiting to run
+		QueueSize int `json:"queueSize"`
+		//where the jobs and their results are kept
+		Directory string `json:"directory"`
+		//how long a job is kept once it has finished e.g. 24h
+		TTL string `json:"ttl"`
+	}
+
+	// JobStore keeps the jobs and their results
+	JobStore interface {
+		SaveJob(job *model.Job) error
+		// GetJob gives ErrJobNotFound when there is no job with the id
+		GetJob(id string) (*model.Job, error)
+		ListJobs() ([]*model.Job, error)
+		// DeleteJob along with its results
+		DeleteJob(id string) error
+		// ResultWriter for the job's results, they replace any it already has
+		ResultWriter(id string) (io.WriteCloser, error)
+		ResultReader(id string) (io.ReadCloser, error)
+	}
+
+	// keeps each job as a file of JSON alongside a file of its results
+	diskJobStore struct {
+		directory string
+		//so a job isn't read part way through being saved
+		mutex sync.RWMutex
+	}
+)
+
+// GetTTL is how long a finished job is kept
+func (c *JobsConfig) GetTTL() (time.Duration, error) {
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("the ttl must be longer than 0")
+	}
+	return ttl, nil
+}
+
+// NewDiskJobStore keeps the jobs in the directory, which is created if it doesn't exist
+func NewDiskJobStore(directory string) (JobStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &diskJobStore{directory: directory}, nil
+}
+
+//the file for the job's id with the suffix, the id has to be one we gave so it can't be a path elsewhere
+func (d *diskJobStore) file(id, suffix string) (string, error) {
+	if !job_id.MatchString(strings.ToLower(id)) {
+		return "", ErrJobNotFound
+	}
+	return filepath.Join(d.directory, strings.ToLower(id)+suffix), nil
+}
+
+func (d *diskJobStore) SaveJob(job *model.Job) error {
+	file, err := d.file(job.Id, job_file_suffix)
+	if err != nil {
+		return err
+	}
+	saved, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	//write it alongside and then replace it, so it's never only partly written
+	if err := ioutil.WriteFile(file+".tmp", saved, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func (d *diskJobStore) GetJob(id string) (*model.Job, error) {
+	file, err := d.file(id, job_file_suffix)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.RLock()
+	saved, err := ioutil.ReadFile(file)
+	d.mutex.RUnlock()
+	if os.IsNotExist(err) {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	job := &model.Job{}
+	if err := json.Unmarshal(saved, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (d *diskJobStore) ListJobs() ([]*model.Job, error) {
+	files, err := filepath.Glob(filepath.Join(d.directory, "*"+job_file_suffix))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*model.Job{}
+	for i := range files {
+		job, err := d.GetJob(strings.TrimSuffix(filepath.Base(files[i]), job_file_suffix))
+		if err == ErrJobNotFound {
+			//deleted since we looked
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (d *diskJobStore) DeleteJob(id string) error {
+	file, err := d.file(id, job_file_suffix)
+	if err != nil {
+		return err
+	}
+	results, _ := d.file(id, result_file_suffix)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := os.Remove(results); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *diskJobStore) ResultWriter(id string) (io.WriteCloser, error) {
+	file, err := d.file(id, result_file_suffix)
+	if err != nil {
+		return nil, err
+	}
+	results, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (d *diskJobStore) ResultReader(id string) (io.ReadCloser, error) {
+	file, err := d.file(id, result_file_suffix)
+	if err != nil {
+		return nil, err
+	}
+	results, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, ErrJobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
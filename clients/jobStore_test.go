@@ -0,0 +1,126 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"../model"
+)
+
+const (
+	test_job_id = "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b"
+)
+
+func newTestJobStore(t *testing.T) (JobStore, string) {
+	directory, err := ioutil.TempDir("", "octopus-jobs")
+	if err != nil {
+		t.Fatalf("couldn't make the directory: %s", err.Error())
+	}
+	store, err := NewDiskJobStore(directory)
+	if err != nil {
+		t.Fatalf("couldn't make the store: %s", err.Error())
+	}
+	return store, directory
+}
+
+func TestDiskJobStore(t *testing.T) {
+
+	store, directory := newTestJobStore(t)
+	defer os.RemoveAll(directory)
+
+	if _, err := store.GetJob(test_job_id); err != ErrJobNotFound {
+		t.Fatalf("given %v but expected %v", err, ErrJobNotFound)
+	}
+
+	job := model.NewJob(test_job_id, "12d7bc90fa", "text/csv", time.Now())
+	job.Groups = []model.QueriedGroup{{Field: model.META_USERID, QueriedId: "12d7bc90fa", GroupId: "abcdef"}}
+	if err := store.SaveJob(job); err != nil {
+		t.Fatalf("saving gave %s", err.Error())
+	}
+	job.Start(time.Now())
+	if err := store.SaveJob(job); err != nil {
+		t.Fatalf("saving again gave %s", err.Error())
+	}
+
+	saved, err := store.GetJob(test_job_id)
+	if err != nil || !reflect.DeepEqual(saved, job) {
+		t.Fatalf("given %v %v but expected %v", saved, err, job)
+	}
+	if jobs, err := store.ListJobs(); err != nil || len(jobs) != 1 || !reflect.DeepEqual(jobs[0], job) {
+		t.Fatalf("given %v %v but expected only %v", jobs, err, job)
+	}
+
+	results, err := store.ResultWriter(test_job_id)
+	if err != nil {
+		t.Fatalf("writing the results gave %s", err.Error())
+	}
+	results.Write([]byte("time,value\n"))
+	results.Close()
+
+	read, err := store.ResultReader(test_job_id)
+	if err != nil {
+		t.Fatalf("reading the results gave %s", err.Error())
+	}
+	contents, _ := ioutil.ReadAll(read)
+	read.Close()
+	if string(contents) != "time,value\n" {
+		t.Fatalf("given %s", contents)
+	}
+
+	if err := store.DeleteJob(test_job_id); err != nil {
+		t.Fatalf("deleting gave %s", err.Error())
+	}
+	if _, err := store.GetJob(test_job_id); err != ErrJobNotFound {
+		t.Fatalf("given %v but expected %v", err, ErrJobNotFound)
+	}
+	if _, err := store.ResultReader(test_job_id); err != ErrJobNotFound {
+		t.Fatalf("given %v but expected %v", err, ErrJobNotFound)
+	}
+}
+
+func TestDiskJobStore_InvalidIds(t *testing.T) {
+
+	store, directory := newTestJobStore(t)
+	defer os.RemoveAll(directory)
+
+	for _, id := range []string{"", "../../etc/passwd", "6f1c2a9e", test_job_id + "/.."} {
+		if _, err := store.GetJob(id); err != ErrJobNotFound {
+			t.Fatalf("[%s] given %v but expected %v", id, err, ErrJobNotFound)
+		}
+		if _, err := store.ResultWriter(id); err != ErrJobNotFound {
+			t.Fatalf("[%s] given %v but expected %v", id, err, ErrJobNotFound)
+		}
+	}
+}
+
+func TestJobsConfig_GetTTL(t *testing.T) {
+
+	if ttl, err := (&JobsConfig{TTL: "24h"}).GetTTL(); err != nil || ttl != 24*time.Hour {
+		t.Fatalf("given %v %v but expected 24h", ttl, err)
+	}
+	for _, invalid := range []string{"", "a day", "0s", "-1h"} {
+		if _, err := (&JobsConfig{TTL: invalid}).GetTTL(); err == nil {
+			t.Fatalf("[%s] should have given an error", invalid)
+		}
+	}
+}
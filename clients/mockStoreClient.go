@@ -56,9 +56,57 @@ func (d MockStoreClient) GetTimeLastEntryUserAndDevice(groupId, deviceId string)
 	return []byte("GetTimeLastEntryUserDevice"), nil
 }
 
+func (d MockStoreClient) GetGlucoseStats(groupId string, query *model.StatsQuery) ([]byte, error) {
+	if d.ThrowError {
+		return nil, errors.New("GetGlucoseStats mongo error")
+	}
+	return []byte("GetGlucoseStats"), nil
+}
+
+func (d MockStoreClient) GetAGP(groupId string, query *model.AGPQuery) ([]byte, error) {
+	if d.ThrowError {
+		return nil, errors.New("GetAGP mongo error")
+	}
+	return []byte("GetAGP"), nil
+}
+
+func (d MockStoreClient) GetDailyTotals(groupId string, query *model.TotalsQuery) ([]byte, error) {
+	if d.ThrowError {
+		return nil, errors.New("GetDailyTotals mongo error")
+	}
+	return []byte("GetDailyTotals"), nil
+}
+
+func (d MockStoreClient) GetDataGaps(groupId string, query *model.GapsQuery) ([]byte, error) {
+	if d.ThrowError {
+		return nil, errors.New("GetDataGaps mongo error")
+	}
+	return []byte("GetDataGaps"), nil
+}
+
 func (d MockStoreClient) ExecuteQuery(details *model.QueryData) ([]byte, error) {
 	if d.ThrowError {
 		return nil, errors.New("ExecuteQuery mongo error")
 	}
 	return []byte("ExecuteQuery"), nil
 }
+
+func (d MockStoreClient) ExecuteQueryPage(details *model.QueryData, after *model.Cursor, size int, out RecordWriter) (*model.Cursor, error) {
+	if d.ThrowError {
+		return nil, errors.New("ExecuteQueryPage mongo error")
+	}
+	out.WriteRecord(map[string]interface{}{"type": "ExecuteQueryPage"})
+	if d.ReturnOther {
+		//the last page
+		return nil, out.Close()
+	}
+	return &model.Cursor{Time: "2015-01-01T00:00:00.000Z", Id: "54a4cf6b4c3c5cfe5ba0a6e1"}, out.Close()
+}
+
+func (d MockStoreClient) StreamQuery(details *model.QueryData, out RecordWriter) error {
+	if d.ThrowError {
+		return errors.New("StreamQuery mongo error")
+	}
+	out.WriteRecord(map[string]interface{}{"type": "StreamQuery"})
+	return out.Close()
+}
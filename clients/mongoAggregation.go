@@ -0,0 +1,482 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+
+	"../model"
+)
+
+var (
+	//how much of a stored time string is kept when it's truncated e.g. 2015-01-13 for the day
+	truncate_lengths = map[string]int{model.TRUNCATE_MONTH: 7, model.TRUNCATE_DAY: 10, model.TRUNCATE_HOUR: 13}
+	//the layout of the start of a stored time for each length it is truncated to, in UTC as the stored times are
+	truncated_layouts = map[int]string{10: "2006-01-02", 13: "2006-01-02T15", 16: "2006-01-02T15:04"}
+)
+
+const (
+	//the length of a stored time truncated to the minute e.g. 2015-01-13T08:44
+	truncate_minute_length = 16
+	//where the hours and minutes are in a stored time
+	hours_at   = 11
+	minutes_at = 14
+	//what is kept for each piece of a bucket so the mean can be worked out once they are merged
+	bucket_sum    = "sum"
+	bucket_values = "values"
+	//what is kept for a standard deviation, added to the name of the aggregate
+	deviation_count   = "_n"
+	deviation_sum     = "_sum"
+	deviation_squares = "_squares"
+	//the most records a query with a percentile can be of, each of their values is held to find it
+	max_percentile_values = 200000
+)
+
+var (
+	// ErrTooManyValues is given for a percentile of more records than we will hold the values of
+	ErrTooManyValues = fmt.Errorf("a PERCENTILE can be of at most %d records, narrow the query e.g. with a shorter time range", max_percentile_values)
+)
+
+//the names for the keys and aggregates in the pipeline, the names in the results aren't valid in mongo
+func keyName(i int) string       { return "k" + strconv.Itoa(i) }
+func aggregateName(i int) string { return "a" + strconv.Itoa(i) }
+
+func getGroupKey(key model.GroupKey) interface{} {
+	if key.Field == model.SUBJECT_ID_FIELD && key.Truncate == "" {
+		//a cohort's records are grouped by whose they are, the subjectId is given to the results
+		return "$_groupId"
+	}
+	if length, ok := truncate_lengths[key.Truncate]; ok {
+		//times are stored as ISO 8601 strings so the start of it is the day, hour or month
+		return bson.M{"$substr": []interface{}{"$" + key.Field, 0, length}}
+	}
+	return "$" + key.Field
+}
+
+func getAccumulator(aggregate model.Aggregate) bson.M {
+	field := "$" + aggregate.Field
+	switch aggregate.Function {
+	case model.AGGREGATE_COUNT:
+		if aggregate.Field == "*" {
+			return bson.M{"$sum": 1}
+		}
+		//only those records with the field
+		return bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{field, nil}}, 1, 0}}}
+	case model.AGGREGATE_AVG:
+		return bson.M{"$avg": field}
+	case model.AGGREGATE_MIN:
+		return bson.M{"$min": field}
+	case model.AGGREGATE_MAX:
+		return bson.M{"$max": field}
+	case model.AGGREGATE_SUM:
+		return bson.M{"$sum": field}
+	}
+	//percentiles are worked out from all of the values once we have them
+	return bson.M{"$push": field}
+}
+
+//the count, sum and sum of the squares of the numbers in the field, the standard deviation is worked out from them.
+//Only numbers sort between null and strings, so the others are left out without needing $isNumber.
+func getDeviationAccumulators(field string) bson.M {
+	value := "$" + field
+	isNumber := bson.M{"$and": []interface{}{bson.M{"$gt": []interface{}{value, nil}}, bson.M{"$lt": []interface{}{value, ""}}}}
+	number := bson.M{"$cond": []interface{}{isNumber, value, 0}}
+	return bson.M{
+		deviation_count:   bson.M{"$sum": bson.M{"$cond": []interface{}{isNumber, 1, 0}}},
+		deviation_sum:     bson.M{"$sum": number},
+		deviation_squares: bson.M{"$sum": bson.M{"$multiply": []interface{}{number, number}}},
+	}
+}
+
+//the groups are sorted on the keys in the ORDER BY, and then on the rest of the keys
+func getGroupSort(details *model.QueryData) bson.D {
+	sortKeys := bson.D{}
+	sorted := map[int]bool{}
+	for _, order := range details.OrderBy {
+		for i := range details.GroupBy {
+			if details.GroupBy[i].Field == order.Field && !sorted[i] {
+				direction := 1
+				if order.Descending {
+					direction = -1
+				}
+				sortKeys = append(sortKeys, bson.DocElem{Name: "_id." + keyName(i), Value: direction})
+				sorted[i] = true
+			}
+		}
+	}
+	for i := range details.GroupBy {
+		if !sorted[i] {
+			sortKeys = append(sortKeys, bson.DocElem{Name: "_id." + keyName(i), Value: 1})
+		}
+	}
+	return sortKeys
+}
+
+//the aggregation pipeline that gives the aggregates for each group, the groups are in the order of their keys
+func (d MongoStoreClient) constructPipeline(details *model.QueryData) []bson.M {
+
+	groupId := bson.M{}
+	for i := range details.GroupBy {
+		groupId[keyName(i)] = getGroupKey(details.GroupBy[i])
+	}
+	group := bson.M{"_id": groupId}
+	for i := range details.Aggregates {
+		if details.Aggregates[i].Function == model.AGGREGATE_STDDEV {
+			for part, accumulator := range getDeviationAccumulators(details.Aggregates[i].Field) {
+				group[aggregateName(i)+part] = accumulator
+			}
+			continue
+		}
+		group[aggregateName(i)] = getAccumulator(details.Aggregates[i])
+	}
+
+	pipeline := []bson.M{{"$match": d.constructQuery(details)}, {"$group": group}}
+
+	if len(details.GroupBy) > 0 {
+		pipeline = append(pipeline, bson.M{"$sort": getGroupSort(details)})
+	}
+	if details.Offset > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": details.Offset})
+	}
+	if limit := d.getLimit(details.Limit); limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	return pipeline
+}
+
+//how a bucket is grouped on in the store, by the start of the stored time and the slot the bucket is in within
+//that start when the bucket is shorter e.g. the minutes 15 to 29 are slot 1 of the hour for a 15m bucket.
+//A bucket of more than one day is grouped by day and the days are merged as they are read.
+type bucketSlots struct {
+	//how much of a stored time is kept
+	length int
+	//where the hours or minutes the slots are of are in the stored time, and how long one of them is
+	at   int
+	unit time.Duration
+	//how many of them there are in what is kept
+	units int
+}
+
+func getBucketSlots(bucket time.Duration) bucketSlots {
+	day := 24 * time.Hour
+	switch {
+	case bucket%day == 0:
+		return bucketSlots{length: truncate_lengths[model.TRUNCATE_DAY]}
+	case bucket == time.Hour:
+		return bucketSlots{length: truncate_lengths[model.TRUNCATE_HOUR]}
+	case bucket == time.Minute:
+		return bucketSlots{length: truncate_minute_length}
+	case bucket%time.Hour == 0:
+		return bucketSlots{length: truncate_lengths[model.TRUNCATE_DAY], at: hours_at, unit: time.Hour, units: 24}
+	}
+	return bucketSlots{length: truncate_lengths[model.TRUNCATE_HOUR], at: minutes_at, unit: time.Minute, units: 60}
+}
+
+//the slot of a record's bucket, counting the starts of the slots that its hours or minutes are at or past
+//e.g. "17" >= "15". Strings can't be made numbers before mongo 3.2, but two digits compare the same either way.
+func (s bucketSlots) slotKey(bucket time.Duration) interface{} {
+	if s.unit == 0 {
+		return 0
+	}
+	digits := bson.M{"$substr": []interface{}{"$" + time_field, s.at, 2}}
+	step := int(bucket / s.unit)
+	past := []interface{}{}
+	for start := step; start < s.units; start += step {
+		past = append(past, bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{digits, fmt.Sprintf("%02d", start)}}, 1, 0}})
+	}
+	return bson.M{"$add": past}
+}
+
+//the aggregation pipeline that gives the count, min, max and sum of the value of each type for each bucket, in order.
+//Buckets of more than a day are given a day at a time, so the days of each bucket are together to be merged.
+func (d MongoStoreClient) constructBucketPipeline(details *model.QueryData) []bson.M {
+
+	value := "$" + model.BUCKET_VALUE_FIELD
+	slots := getBucketSlots(details.Bucket)
+	start := bson.M{"$substr": []interface{}{"$" + time_field, 0, slots.length}}
+	group := bson.M{
+		"_id":              bson.M{keyName(0): "$type", keyName(1): start, keyName(2): slots.slotKey(details.Bucket)},
+		model.BUCKET_COUNT: bson.M{"$sum": 1},
+		model.BUCKET_MIN:   bson.M{"$min": value},
+		model.BUCKET_MAX:   bson.M{"$max": value},
+		bucket_sum:         bson.M{"$sum": value},
+		//those with a value, the mean is of them
+		bucket_values: bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{value, nil}}, 1, 0}}},
+	}
+	sortKeys := bson.D{{Name: "_id." + keyName(0), Value: 1}, {Name: "_id." + keyName(1), Value: 1}, {Name: "_id." + keyName(2), Value: 1}}
+
+	return []bson.M{{"$match": d.constructQuery(details)}, {"$group": group}, {"$sort": sortKeys}}
+}
+
+//the start of the bucket from the start of the stored time and the slot it is in, buckets start from the unix epoch
+//so a 1d bucket is a UTC day
+func getBucketStart(keys bson.M, bucket time.Duration) (time.Time, bool) {
+	text, _ := keys[keyName(1)].(string)
+	layout, ok := truncated_layouts[len(text)]
+	if !ok {
+		return time.Time{}, false
+	}
+	at, err := time.Parse(layout, text)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if slot, ok := toNumber(keys[keyName(2)]); ok {
+		at = at.Add(time.Duration(slot) * bucket)
+	}
+	sinceEpoch := at.Sub(time.Unix(0, 0).UTC())
+	return at.Add(-(sinceEpoch % bucket)), true
+}
+
+//the lower, or higher, of two numbers either of which may not be one
+func keepNumber(kept, value interface{}, lower bool) interface{} {
+	number, ok := toNumber(value)
+	if !ok {
+		return kept
+	}
+	if current, ok := toNumber(kept); ok && (lower && current <= number || !lower && current >= number) {
+		return kept
+	}
+	return number
+}
+
+//merges the days of each bucket longer than a day, writing the bucket once all of its days have been merged.
+//Shorter buckets are whole when they are read. The OFFSET and LIMIT are of the buckets so are applied here.
+type bucketMerger struct {
+	details *model.QueryData
+	out     RecordWriter
+	limit   int
+	skipped int
+	written int
+	//the bucket the pieces are being merged into
+	bucket         bson.M
+	recordType     interface{}
+	start          time.Time
+	sum            float64
+	values, counts int
+}
+
+func newBucketMerger(details *model.QueryData, out RecordWriter, limit int) *bucketMerger {
+	return &bucketMerger{details: details, out: out, limit: limit}
+}
+
+func (b *bucketMerger) add(piece bson.M) error {
+	keys, _ := piece["_id"].(bson.M)
+	start, ok := getBucketStart(keys, b.details.Bucket)
+	if !ok {
+		//records without a time
+		return nil
+	}
+	if b.bucket != nil && (b.recordType != keys[keyName(0)] || !b.start.Equal(start)) {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	if b.bucket == nil {
+		b.recordType, b.start, b.sum, b.values, b.counts = keys[keyName(0)], start, 0, 0, 0
+		b.bucket = bson.M{"_id": bson.M{keyName(0): b.recordType, keyName(1): start}}
+	}
+	count, _ := toNumber(piece[model.BUCKET_COUNT])
+	values, _ := toNumber(piece[bucket_values])
+	sum, _ := toNumber(piece[bucket_sum])
+	b.counts += int(count)
+	b.values += int(values)
+	b.sum += sum
+	b.bucket[model.BUCKET_MIN] = keepNumber(b.bucket[model.BUCKET_MIN], piece[model.BUCKET_MIN], true)
+	b.bucket[model.BUCKET_MAX] = keepNumber(b.bucket[model.BUCKET_MAX], piece[model.BUCKET_MAX], false)
+	return nil
+}
+
+//write the bucket being merged
+func (b *bucketMerger) flush() error {
+	if b.bucket == nil {
+		return nil
+	}
+	bucket := b.bucket
+	b.bucket = nil
+
+	if b.skipped < b.details.Offset {
+		b.skipped++
+		return nil
+	}
+	if b.limit > 0 && b.written >= b.limit {
+		return nil
+	}
+	bucket[model.BUCKET_COUNT] = b.counts
+	bucket[model.BUCKET_MEAN] = nil
+	if b.values > 0 {
+		bucket[model.BUCKET_MEAN] = b.sum / float64(b.values)
+	}
+	b.written++
+	return b.out.WriteRecord(getBucketResult(bucket, b.details))
+}
+
+//the given percentile of the numbers in the values, nil when there are none
+func percentile(values interface{}, p float64) interface{} {
+	list, _ := values.([]interface{})
+	numbers := make([]float64, 0, len(list))
+	for i := range list {
+		if n, ok := toNumber(list[i]); ok {
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
+	sort.Float64s(numbers)
+	return model.Percentile(numbers, p)
+}
+
+//the population standard deviation from the count, sum and sum of the squares kept for the aggregate, nil when there are no numbers
+func standardDeviation(group bson.M, name string) interface{} {
+	count, _ := toNumber(group[name+deviation_count])
+	sum, _ := toNumber(group[name+deviation_sum])
+	sumSquares, _ := toNumber(group[name+deviation_squares])
+	if count == 0 {
+		return nil
+	}
+	mean := sum / count
+	return math.Sqrt(math.Max(sumSquares/count-mean*mean, 0))
+}
+
+//the values of every record are held for a percentile, so it can't be of more records than we will hold.
+//The records are only counted when there is one.
+func checkPercentileValues(details *model.QueryData, countRecords func() (int, error)) error {
+	for i := range details.Aggregates {
+		if details.Aggregates[i].Function != model.AGGREGATE_PERCENTILE {
+			continue
+		}
+		records, err := countRecords()
+		if err != nil {
+			return err
+		}
+		if records > max_percentile_values {
+			return ErrTooManyValues
+		}
+		return nil
+	}
+	return nil
+}
+
+//an aggregate of glucose values in the given units, the MIN and MAX are readings so are rounded like them
+func aggregateInUnits(value interface{}, function, units string) interface{} {
+	stored, ok := toNumber(value)
+	if !ok || units == "" {
+		return value
+	}
+	if function == model.AGGREGATE_MIN || function == model.AGGREGATE_MAX {
+		return model.ToUnits(stored, units)
+	}
+	return model.ConvertGlucose(stored, model.UNITS_MMOLL, units)
+}
+
+//the result for a group named as it was asked for e.g. {"type": "cbg", "avg(value)": 6.2}
+func getAggregateResult(group bson.M, details *model.QueryData) bson.M {
+	result := bson.M{}
+	keys, _ := group["_id"].(bson.M)
+	for i := range details.GroupBy {
+		result[details.GroupBy[i].Name()] = keys[keyName(i)]
+		if groupId, ok := keys[keyName(i)].(string); ok && details.GroupBy[i].Field == model.SUBJECT_ID_FIELD {
+			result[details.GroupBy[i].Name()] = details.Subjects[groupId]
+		}
+	}
+	for i, aggregate := range details.Aggregates {
+		value := group[aggregateName(i)]
+		switch aggregate.Function {
+		case model.AGGREGATE_PERCENTILE:
+			value = percentile(value, aggregate.Percentile)
+		case model.AGGREGATE_STDDEV:
+			value = standardDeviation(group, aggregateName(i))
+		}
+		if details.Units != "" && aggregate.Function != model.AGGREGATE_COUNT && model.IsGlucoseField(aggregate.Field) {
+			value = aggregateInUnits(value, aggregate.Function, details.Units)
+		}
+		result[aggregate.Name()] = value
+	}
+	return result
+}
+
+//the result for a bucket with its start time as it would be stored e.g. {"type": "cbg", "time": "2015-01-13T08:00:00.000Z", "count": 12, ...}
+func getBucketResult(group bson.M, details *model.QueryData) bson.M {
+	result := bson.M{}
+	keys, _ := group["_id"].(bson.M)
+	result[model.BUCKET_TYPE] = keys[keyName(0)]
+	if start, ok := keys[keyName(1)].(time.Time); ok {
+		result[model.BUCKET_TIME] = start.UTC().Format(model.TIME_FORMAT)
+	}
+	result[model.BUCKET_COUNT] = group[model.BUCKET_COUNT]
+	result[model.BUCKET_MIN] = aggregateInUnits(group[model.BUCKET_MIN], model.AGGREGATE_MIN, details.Units)
+	result[model.BUCKET_MEAN] = aggregateInUnits(group[model.BUCKET_MEAN], model.AGGREGATE_AVG, details.Units)
+	result[model.BUCKET_MAX] = aggregateInUnits(group[model.BUCKET_MAX], model.AGGREGATE_MAX, details.Units)
+	if details.Timezone != nil {
+		addLocalTimes([]interface{}{result}, details.Timezone)
+	}
+	return result
+}
+
+//write the aggregates for each group, or each bucket
+func (d MongoStoreClient) streamAggregates(details *model.QueryData, out RecordWriter) error {
+
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	countRecords := func() (int, error) {
+		return sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).Find(d.constructQuery(details)).Count()
+	}
+	if err := checkPercentileValues(details, countRecords); err != nil {
+		return abortWriting(out, err)
+	}
+
+	pipeline := d.constructPipeline(details)
+	writeGroup := func(group bson.M) error { return out.WriteRecord(getAggregateResult(group, details)) }
+	finish := func() error { return nil }
+	if details.Bucket != 0 {
+		merger := newBucketMerger(details, out, d.getLimit(details.Limit))
+		pipeline, writeGroup, finish = d.constructBucketPipeline(details), merger.add, merger.flush
+	}
+	d.logger.Printf("mongo pipeline %#v", pipeline)
+
+	startQueryTime := time.Now()
+	iter := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).Pipe(pipeline).Iter()
+
+	count := 0
+	group := bson.M{}
+	for iter.Next(&group) {
+		if err := writeGroup(group); err != nil {
+			iter.Close()
+			return abortWriting(out, err)
+		}
+		count++
+		group = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		d.logger.Println(fmt.Sprintf("mongo pipeline failed after [%d] groups with error [%s]", count, err.Error()))
+		return abortWriting(out, err)
+	}
+	if err := finish(); err != nil {
+		return abortWriting(out, err)
+	}
+	d.logger.Println(fmt.Sprintf("mongo pipeline took [%.5f] secs and returned [%d] groups", time.Now().Sub(startQueryTime).Seconds(), count))
+
+	return out.Close()
+}
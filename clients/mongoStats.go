@@ -0,0 +1,258 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	"../model"
+)
+
+const (
+	cbg_type    = "cbg"
+	smbg_type   = "smbg"
+	bolus_type  = "bolus"
+	basal_type  = "basal"
+	wizard_type = "wizard"
+)
+
+//the readings for the group in the period, the period includes its start but not its end
+func (d MongoStoreClient) getReadingsQuery(groupId string, types []string, from, to time.Time) bson.M {
+	query := d.getBaseQuery(groupId)
+	query["type"] = bson.M{"$in": types}
+	query[time_field] = bson.M{"$gte": from.UTC().Format(model.TIME_FORMAT), "$lt": to.UTC().Format(model.TIME_FORMAT)}
+	return query
+}
+
+//the last basal for the group that started before the period, it may still have been running when the period started
+func (d MongoStoreClient) getPrecedingBasalQuery(groupId string, from time.Time) bson.M {
+	query := d.getBaseQuery(groupId)
+	query["type"] = basal_type
+	query[time_field] = bson.M{"$lt": from.UTC().Format(model.TIME_FORMAT)}
+	return query
+}
+
+//the value as a number, false when it isn't one
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+//the field as a number, false when it isn't one
+func getNumber(record bson.M, field string) (float64, bool) {
+	return toNumber(record[field])
+}
+
+//the time the record was stored with
+func getTime(record bson.M) (time.Time, bool) {
+	stored, _ := record[time_field].(string)
+	at, err := time.Parse(time.RFC3339Nano, stored)
+	return at, err == nil
+}
+
+//the value of a reading and the units it is in, readings without a numeric value are skipped
+func getReading(record bson.M) (value float64, units string, ok bool) {
+	if value, ok = getNumber(record, "value"); !ok {
+		return 0, "", false
+	}
+	units, _ = record["units"].(string)
+	return value, units, true
+}
+
+//the glucose statistics for the cbg readings in the period, or the smbg readings when there are no cbg readings
+func (d MongoStoreClient) GetGlucoseStats(groupId string, query *model.StatsQuery) ([]byte, error) {
+
+	startQueryTime := time.Now()
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	summaries := map[string]*model.GlucoseSummary{
+		cbg_type:  model.NewGlucoseSummary(cbg_type, query),
+		smbg_type: model.NewGlucoseSummary(smbg_type, query),
+	}
+
+	iter := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).
+		Find(d.getReadingsQuery(groupId, []string{cbg_type, smbg_type}, query.From, query.To)).
+		Select(bson.M{"type": 1, "value": 1, "units": 1}).
+		Iter()
+
+	record := bson.M{}
+	for iter.Next(&record) {
+		glucoseType, _ := record["type"].(string)
+		if value, units, ok := getReading(record); ok && summaries[glucoseType] != nil {
+			summaries[glucoseType].Add(value, units)
+		}
+		record = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		return d.interpretQueryError(err, startQueryTime, nil)
+	}
+
+	summary := summaries[cbg_type]
+	if summary.Count() == 0 {
+		summary = summaries[smbg_type]
+	}
+	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and found [%d] %s readings", time.Now().Sub(startQueryTime).Seconds(), summary.Count(), summary.Type))
+
+	return json.Marshal(summary.Stats())
+}
+
+//the percentiles of the cbg readings in the period for each slot of the day
+func (d MongoStoreClient) GetAGP(groupId string, query *model.AGPQuery) ([]byte, error) {
+
+	startQueryTime := time.Now()
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	profile := model.NewAGPProfile(query)
+
+	iter := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).
+		Find(d.getReadingsQuery(groupId, []string{cbg_type}, query.From, query.To)).
+		Select(bson.M{time_field: 1, "value": 1, "units": 1}).
+		Iter()
+
+	record := bson.M{}
+	for iter.Next(&record) {
+		at, isTime := getTime(record)
+		if value, units, ok := getReading(record); ok && isTime {
+			profile.Add(at, value, units)
+		}
+		record = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		return d.interpretQueryError(err, startQueryTime, nil)
+	}
+
+	report := profile.Report()
+	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and found [%d] cbg readings", time.Now().Sub(startQueryTime).Seconds(), report.Count))
+
+	return json.Marshal(report)
+}
+
+//add the insulin or carbs in the record to the totals for its day
+func addToTotals(totals *model.DailyTotals, record bson.M) {
+	at, ok := getTime(record)
+	if !ok {
+		return
+	}
+	switch record["type"] {
+	case bolus_type:
+		//the normal and extended parts of a combo bolus are given together
+		normal, _ := getNumber(record, "normal")
+		extended, _ := getNumber(record, "extended")
+		totals.AddBolus(at, normal+extended)
+	case basal_type:
+		//a suspended basal has no rate and delivers nothing
+		rate, hasRate := getNumber(record, "rate")
+		duration, hasDuration := getNumber(record, "duration")
+		if hasRate && hasDuration {
+			totals.AddBasal(at, time.Duration(duration)*time.Millisecond, rate)
+		}
+	case wizard_type:
+		if carbs, ok := getNumber(record, "carbInput"); ok {
+			totals.AddCarbs(at, carbs)
+		}
+	}
+}
+
+//the insulin and carbs for each local day of the period
+func (d MongoStoreClient) GetDailyTotals(groupId string, query *model.TotalsQuery) ([]byte, error) {
+
+	startQueryTime := time.Now()
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	totals := model.NewDailyTotals(query)
+
+	iter := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).
+		Find(d.getReadingsQuery(groupId, []string{bolus_type, basal_type, wizard_type}, query.From, query.To)).
+		Select(bson.M{"type": 1, time_field: 1, "normal": 1, "extended": 1, "rate": 1, "duration": 1, "carbInput": 1}).
+		Iter()
+
+	count := 0
+	record := bson.M{}
+	for iter.Next(&record) {
+		addToTotals(totals, record)
+		count++
+		record = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		return d.interpretQueryError(err, startQueryTime, nil)
+	}
+
+	//only the part of the preceding basal that ran into the period is counted
+	record = bson.M{}
+	err := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).
+		Find(d.getPrecedingBasalQuery(groupId, query.From)).
+		Select(bson.M{"type": 1, time_field: 1, "rate": 1, "duration": 1}).
+		Sort("-" + time_field).
+		One(&record)
+	if err == nil {
+		addToTotals(totals, record)
+		count++
+	} else if err != mgo.ErrNotFound {
+		return d.interpretQueryError(err, startQueryTime, nil)
+	}
+	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and found [%d] records", time.Now().Sub(startQueryTime).Seconds(), count))
+
+	return json.Marshal(totals.Report())
+}
+
+//the gaps between the records of the type in the period, oldest first
+func (d MongoStoreClient) GetDataGaps(groupId string, query *model.GapsQuery) ([]byte, error) {
+
+	startQueryTime := time.Now()
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	gaps := model.NewGapFinder(query)
+
+	iter := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).
+		Find(d.getReadingsQuery(groupId, []string{query.Type}, query.From, query.To)).
+		Select(bson.M{time_field: 1}).
+		Sort(time_field).
+		Iter()
+
+	record := bson.M{}
+	for iter.Next(&record) {
+		if at, ok := getTime(record); ok {
+			gaps.Add(at)
+		}
+		record = bson.M{}
+	}
+	if err := iter.Close(); err != nil {
+		return d.interpretQueryError(err, startQueryTime, nil)
+	}
+
+	report := gaps.Report()
+	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and found [%d] gaps in [%d] %s records", time.Now().Sub(startQueryTime).Seconds(), len(report.Gaps), report.Count, query.Type))
+
+	return json.Marshal(report)
+}
@@ -18,7 +18,9 @@ not, you can obtain one from Tidepool Project at tidepool.org.
 package clients
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -36,12 +38,16 @@ const (
 	DEVICE_DATA_COLLECTION = "deviceData"
 	sort_time_descending   = "-time"
 	uploadid_field         = "uploadId"
+	time_field             = "time"
+	local_time_field       = "localTime"
 )
 
 var (
 	//the feilds we use for the different query types and associated indexes
 	query_fields          = []string{"_groupId", "_active", "_schemaVersion", "type", sort_time_descending}
 	uploadid_query_fields = []string{"_groupId", "_active", "_schemaVersion", "type", uploadid_field, sort_time_descending}
+	//pages are strictly newest first, the _id orders records with the same time
+	page_sort_fields = []string{sort_time_descending, "-_id"}
 )
 
 type MongoStoreClient struct {
@@ -53,6 +59,10 @@ type MongoStoreClient struct {
 type StoreConfig struct {
 	Connection    *mongo.Config `json:"mongo"`
 	SchemaVersion `json:"schemaVersion"`
+	//when true the internal fields that start with an _ are only returned if they are SELECTed
+	HideInternalFields bool `json:"hideInternalFields"`
+	//the most records a query can return, 0 for no maximum
+	MaxLimit int `json:"maxLimit"`
 }
 
 type SchemaVersion struct {
@@ -174,48 +184,324 @@ func getMongoOperator(op string) string {
 		return "$gt"
 	case ">=":
 		return "$gte"
+	case "=":
+		return "$eq"
+	case "!=":
+		return "$ne"
 	default:
 		return ""
 	}
 }
 
+//the value as it would be stored, times are kept as ISO 8601 strings
+func getMongoValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case model.Timestamp:
+		return v.String()
+	case model.RelativeTime:
+		//resolved as the query is run
+		return v.Resolve().String()
+	}
+	return value
+}
+
+func getMongoValues(where model.WhereCondition) interface{} {
+	values := make([]interface{}, 0, len(where.Values))
+	for i := range where.Values {
+		values = append(values, getMongoValue(where.Values[i]))
+	}
+	return values
+}
+
+//the mongo operator and value for the where condition
+func getMongoCondition(where model.WhereCondition) (string, interface{}) {
+	switch strings.ToLower(where.Condition) {
+	case "in":
+		return "$in", getMongoValues(where)
+	case "not in":
+		return "$nin", getMongoValues(where)
+	case "exists":
+		return "$exists", true
+	case "not exists":
+		return "$exists", false
+	case "matches":
+		return "$regex", where.Value
+	default:
+		return getMongoOperator(where.Condition), getMongoValue(where.Value)
+	}
+}
+
+//add to the conditions for the field, anything that would replace an existing condition is AND'ed instead
+func addCondition(query bson.M, field, op string, value interface{}) {
+	if query[field] == nil {
+		query[field] = bson.M{op: value}
+		return
+	}
+	if existing, ok := query[field].(bson.M); ok {
+		if _, taken := existing[op]; !taken {
+			existing[op] = value
+			return
+		}
+	}
+	and, _ := query["$and"].([]bson.M)
+	query["$and"] = append(and, bson.M{field: bson.M{op: value}})
+}
+
+//the mongo document for a single where condition including any terms it groups
+func getMongoWhere(where model.WhereCondition) bson.M {
+	if where.IsGroup() {
+		terms := make([]bson.M, 0, len(where.Terms))
+		for i := range where.Terms {
+			terms = append(terms, getMongoWhere(where.Terms[i]))
+		}
+		switch where.Condition {
+		case model.CONDITION_AND:
+			return bson.M{"$and": terms}
+		case model.CONDITION_OR:
+			return bson.M{"$or": terms}
+		default:
+			return bson.M{"$nor": terms}
+		}
+	}
+	op, value := getMongoCondition(where)
+	return bson.M{where.Name: bson.M{op: value}}
+}
+
+//the base query for everyone in a cohort
+func (d MongoStoreClient) getCohortQuery(groupIds []string) bson.M {
+	query := d.getBaseQuery("")
+	query["_groupId"] = bson.M{"$in": groupIds}
+	return query
+}
+
 func (d MongoStoreClient) constructQuery(details *model.QueryData) (query bson.M) {
 	for _, v := range details.MetaQuery {
 		//start with the base query
-
 		query = d.getBaseQuery(v)
-		//add types
-		if len(details.Types) > 0 {
-			query["type"] = bson.M{"$in": details.Types}
+	}
+	if details.IsCohort() {
+		query = d.getCohortQuery(details.GroupIds())
+	}
+	if query == nil {
+		return query
+	}
+	//add types
+	if len(details.Types) > 0 {
+		query["type"] = bson.M{"$in": details.Types}
+	}
+	//add where, all conditions must be met
+	for i := range details.WhereConditions {
+		where := details.WhereConditions[i]
+		if where.IsGroup() {
+			and, _ := query["$and"].([]bson.M)
+			query["$and"] = append(and, getMongoWhere(where))
+			continue
 		}
-		if len(details.InList) > 0 {
-			first := details.WhereConditions[0]
-			switch strings.ToLower(first.Condition) {
-			case "in":
-				query[first.Name] = bson.M{"$in": details.InList}
-			case "not in":
-				query[first.Name] = bson.M{"$nin": details.InList}
-			}
+		op, value := getMongoCondition(where)
+		addCondition(query, where.Name, op, value)
+	}
+	d.logger.Printf("mongo query %#v", query)
+	return query
+}
+
+//how the results are sorted, by default this is the index used for the query so by type and then newest first
+func getSort(query bson.M, orderBy []model.OrderBy) []string {
+	if len(orderBy) == 0 {
+		if query[uploadid_field] != nil {
+			//switch if uploadId is included
+			return uploadid_query_fields
+		}
+		return query_fields
+	}
+	sortFields := make([]string, 0, len(orderBy))
+	for i := range orderBy {
+		if orderBy[i].Descending {
+			sortFields = append(sortFields, "-"+orderBy[i].Field)
 		} else {
-			//add where but only if there wasn't an InList
-			if len(details.WhereConditions) == 1 {
-				first := details.WhereConditions[0]
-				op := getMongoOperator(first.Condition)
-				query[first.Name] = bson.M{op: first.Value}
-			} else if len(details.WhereConditions) == 2 {
-				first := details.WhereConditions[0]
-				op1 := getMongoOperator(first.Condition)
-				second := details.WhereConditions[1]
-				op2 := getMongoOperator(second.Condition)
-				query[first.Name] = bson.M{op1: first.Value, op2: second.Value}
+			sortFields = append(sortFields, orderBy[i].Field)
+		}
+	}
+	return sortFields
+}
+
+//the most records to return, no more than the configured maximum when there is one
+func (d MongoStoreClient) getLimit(requested int) int {
+	if d.config.MaxLimit > 0 && (requested == 0 || requested > d.config.MaxLimit) {
+		d.logger.Printf("limiting the query to the maximum of [%d] records rather than [%d]", d.config.MaxLimit, requested)
+		return d.config.MaxLimit
+	}
+	return requested
+}
+
+//the fields to return, either those SELECTed or all but the ones we never want to return
+func getProjection(fields []string) bson.M {
+	if len(fields) == 0 {
+		return bson.M{"_id": 0, "_active": 0}
+	}
+	projection := bson.M{}
+	for i := range fields {
+		projection[fields[i]] = 1
+	}
+	projection["_id"] = 0
+	return projection
+}
+
+//remove the fields starting with an _ from each of the records, other than those we were asked for
+func removeInternalFields(results []interface{}, selected []string) {
+	keep := map[string]bool{}
+	for i := range selected {
+		keep[selected[i]] = true
+	}
+	for i := range results {
+		record, ok := results[i].(bson.M)
+		if !ok {
+			continue
+		}
+		for field := range record {
+			if strings.HasPrefix(field, "_") && !keep[field] {
+				delete(record, field)
 			}
 		}
-		d.logger.Printf("mongo query %#v", query)
 	}
-	return query
 }
 
-func (d MongoStoreClient) ExecuteQuery(details *model.QueryData) ([]byte, error) {
+//a cohort's records also need their _groupId so they can be given their subjectId
+func addSubjectProjection(projection bson.M, details *model.QueryData) bson.M {
+	if details.IsCohort() && len(details.Fields) > 0 {
+		projection["_groupId"] = 1
+	}
+	return projection
+}
+
+//give each record the subjectId of its user in place of their _groupId
+func addSubjectIds(results []interface{}, subjects map[string]string) {
+	for i := range results {
+		record, ok := results[i].(bson.M)
+		if !ok {
+			continue
+		}
+		groupId, _ := record["_groupId"].(string)
+		record[model.SUBJECT_ID_FIELD] = subjects[groupId]
+		delete(record, "_groupId")
+	}
+}
+
+//what we do to the records found before they are returned
+func (d MongoStoreClient) finishResults(results []interface{}, details *model.QueryData) {
+	if details.IsCohort() {
+		addSubjectIds(results, details.Subjects)
+	}
+	if d.config.HideInternalFields {
+		removeInternalFields(results, details.Fields)
+	}
+	if details.Timezone != nil {
+		addLocalTimes(results, details.Timezone)
+	}
+	if details.Units != "" {
+		convertGlucoseFields(results, details.Units)
+	}
+}
+
+//give the glucose fields of each record in the units, and say that they are
+func convertGlucoseFields(results []interface{}, units string) {
+	for i := range results {
+		record, ok := results[i].(bson.M)
+		if !ok {
+			continue
+		}
+		recordType, _ := record["type"].(string)
+		fields := model.GlucoseFields(recordType)
+		for _, field := range fields {
+			//nested fields such as bgTarget.low are in the documents within the record
+			path := strings.Split(field, ".")
+			parent := record
+			for _, name := range path[:len(path)-1] {
+				if parent, ok = parent[name].(bson.M); !ok {
+					break
+				}
+			}
+			if stored, ok := getNumber(parent, path[len(path)-1]); ok {
+				parent[path[len(path)-1]] = model.ToUnits(stored, units)
+			}
+		}
+		if _, hasUnits := record["units"]; hasUnits && len(fields) > 0 {
+			record["units"] = units
+		}
+	}
+}
+
+//only records that come after the cursor, that is older or as old with a lower _id
+func addCursor(query bson.M, after *model.Cursor) error {
+	if !bson.IsObjectIdHex(after.Id) {
+		return errors.New("the cursor has an invalid id")
+	}
+	id := bson.ObjectIdHex(after.Id)
+	and, _ := query["$and"].([]bson.M)
+	query["$and"] = append(and, bson.M{"$or": []bson.M{
+		bson.M{time_field: bson.M{"$lt": after.Time}},
+		bson.M{time_field: after.Time, "_id": bson.M{"$lt": id}},
+	}})
+	return nil
+}
+
+//the cursor for the page that ends with the given record
+func cursorAt(last interface{}) *model.Cursor {
+	record, _ := last.(bson.M)
+	id, ok := record["_id"].(bson.ObjectId)
+	if !ok {
+		return nil
+	}
+	stored, _ := record[time_field].(string)
+	return &model.Cursor{Time: stored, Id: id.Hex()}
+}
+
+//pages also need the time and _id for the cursor
+func getPageProjection(fields []string) bson.M {
+	projection := getProjection(fields)
+	if len(fields) == 0 {
+		delete(projection, "_id")
+		return projection
+	}
+	projection[time_field] = 1
+	projection["_id"] = 1
+	return projection
+}
+
+//remove what we only needed for the cursor
+func removePageFields(results []interface{}, selected []string) {
+	keepTime := len(selected) == 0
+	for i := range selected {
+		keepTime = keepTime || selected[i] == time_field
+	}
+	for i := range results {
+		if record, ok := results[i].(bson.M); ok {
+			delete(record, "_id")
+			if !keepTime {
+				delete(record, time_field)
+			}
+		}
+	}
+}
+
+//add the time of each record in the given zone as its localTime
+func addLocalTimes(results []interface{}, loc *time.Location) {
+	for i := range results {
+		record, ok := results[i].(bson.M)
+		if !ok {
+			continue
+		}
+		stored, ok := record[time_field].(string)
+		if !ok {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, stored); err == nil {
+			record[local_time_field] = t.In(loc).Format(model.LOCAL_TIME_FORMAT)
+		}
+	}
+}
+
+//the query to find the results for the given details
+func (d MongoStoreClient) find(session *mgo.Session, details *model.QueryData) *mgo.Query {
 
 	startTime := time.Now()
 
@@ -223,15 +509,120 @@ func (d MongoStoreClient) ExecuteQuery(details *model.QueryData) ([]byte, error)
 
 	d.logger.Println(fmt.Sprintf("mongo query built in [%.5f] secs", time.Now().Sub(startTime).Seconds()))
 
+	filter := addSubjectProjection(getProjection(details.Fields), details)
+	sortFields := getSort(query, details.OrderBy)
+	limit := d.getLimit(details.Limit)
+
+	find := session.DB("").C(DEVICE_DATA_COLLECTION).
+		Find(query).
+		Sort(sortFields...).
+		Select(filter)
+	if details.Offset > 0 {
+		find = find.Skip(details.Offset)
+	}
+	if limit > 0 {
+		find = find.Limit(limit)
+	}
+	return find
+}
+
+func (d MongoStoreClient) ExecuteQuery(details *model.QueryData) ([]byte, error) {
+
+	if details.IsAggregate() {
+		var results bytes.Buffer
+		if err := d.streamAggregates(details, NewJSONWriter(&results)); err != nil {
+			return nil, err
+		}
+		return results.Bytes(), nil
+	}
+
 	var results []interface{}
-	//we don't want to return these
-	filter := bson.M{"_id": 0, "_active": 0}
-	//sort fields
-	sortFields := query_fields
-	if query[uploadid_field] != nil {
-		//switch if uploadId is included
-		sortFields = uploadid_query_fields
+
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	startQueryTime := time.Now()
+	err := d.find(sessionCopy, details).All(&results)
+
+	if err != nil {
+		return d.interpretQueryError(err, startQueryTime, []byte("[]"))
 	}
+	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and returned [%d] records", time.Now().Sub(startQueryTime).Seconds(), len(results)))
+
+	if len(results) == 0 {
+		return []byte("[]"), nil
+	}
+	d.finishResults(results, details)
+	return json.Marshal(results)
+
+}
+
+//give up writing the results as the query failed
+func abortWriting(out RecordWriter, err error) error {
+	out.Abort()
+	return err
+}
+
+//write the results out one record at a time, so however many there are we only hold one of them.
+//If the query fails before any are written the error is returned and nothing is written.
+func (d MongoStoreClient) StreamQuery(details *model.QueryData, out RecordWriter) error {
+
+	if details.IsAggregate() {
+		return d.streamAggregates(details, out)
+	}
+
+	sessionCopy := d.session.Copy()
+	defer sessionCopy.Close()
+
+	startQueryTime := time.Now()
+	iter := d.find(sessionCopy, details).Iter()
+
+	//a new record each time as the iterator will otherwise merge them
+	record := bson.M{}
+	if !iter.Next(&record) {
+		if err := iter.Close(); err != nil {
+			_, err = d.interpretQueryError(err, startQueryTime, nil)
+			return abortWriting(out, err)
+		}
+		return out.Close()
+	}
+
+	count := 0
+	for {
+		d.finishResults([]interface{}{record}, details)
+		if err := out.WriteRecord(record); err != nil {
+			iter.Close()
+			return abortWriting(out, err)
+		}
+		count++
+
+		record = bson.M{}
+		if !iter.Next(&record) {
+			break
+		}
+	}
+	if err := iter.Close(); err != nil {
+		d.logger.Println(fmt.Sprintf("mongo query failed after streaming [%d] records with error [%s]", count, err.Error()))
+		return abortWriting(out, err)
+	}
+	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and streamed [%d] records", time.Now().Sub(startQueryTime).Seconds(), count))
+
+	return out.Close()
+}
+
+//write a page of the results, newest first, that follows the given cursor. The cursor for the next page is nil when there are no more results.
+func (d MongoStoreClient) ExecuteQueryPage(details *model.QueryData, after *model.Cursor, size int, out RecordWriter) (*model.Cursor, error) {
+
+	query := d.constructQuery(details)
+	if after != nil {
+		if err := addCursor(query, after); err != nil {
+			return nil, abortWriting(out, err)
+		}
+	}
+
+	var results []interface{}
+	filter := addSubjectProjection(getPageProjection(details.Fields), details)
+	size = d.getLimit(size)
 
 	startQueryTime := time.Now()
 	sessionCopy := d.session.Copy()
@@ -239,18 +630,31 @@ func (d MongoStoreClient) ExecuteQuery(details *model.QueryData) ([]byte, error)
 
 	err := sessionCopy.DB("").C(DEVICE_DATA_COLLECTION).
 		Find(query).
-		Sort(sortFields...). //sort by time but use full index based on query
+		Sort(page_sort_fields...).
 		Select(filter).
+		Limit(size).
 		All(&results)
 
 	if err != nil {
-		return d.interpretQueryError(err, startQueryTime, []byte("[]"))
+		if _, err := d.interpretQueryError(err, startQueryTime, nil); err != nil {
+			return nil, abortWriting(out, err)
+		}
 	}
-	d.logger.Println(fmt.Sprintf("mongo query took [%.5f] secs and returned [%d] records", time.Now().Sub(startQueryTime).Seconds(), len(results)))
+	d.logger.Println(fmt.Sprintf("mongo page query took [%.5f] secs and returned [%d] records", time.Now().Sub(startQueryTime).Seconds(), len(results)))
 
-	if len(results) == 0 {
-		return []byte("[]"), nil
+	var next *model.Cursor
+	if len(results) > 0 && len(results) == size {
+		//there may be more
+		next = cursorAt(results[len(results)-1])
 	}
-	return json.Marshal(results)
+	removePageFields(results, details.Fields)
+	d.finishResults(results, details)
 
+	for i := range results {
+		record, _ := results[i].(bson.M)
+		if err := out.WriteRecord(record); err != nil {
+			return nil, abortWriting(out, err)
+		}
+	}
+	return next, out.Close()
 }
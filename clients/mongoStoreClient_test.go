@@ -20,7 +20,11 @@ package clients
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"log"
+	"math"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -115,6 +119,13 @@ func initTestData(t *testing.T, config *StoreConfig) *MongoStoreClient {
 
 }
 
+//a store for the tests that only build queries and pipelines, so it isn't connected
+func initQueryStore(maxLimit int) *MongoStoreClient {
+	config := initConfig(all_schemas)
+	config.MaxLimit = maxLimit
+	return &MongoStoreClient{logger: log.New(os.Stdout, "api/query:", log.Lshortfile), config: config}
+}
+
 // FIXME: Mismatch between new MongoDB version 3.0.7 and old mgo package causes
 // the Indexes() command to silently fail. Not worth the effort at this point to
 // bump the old mgo package
@@ -236,6 +247,64 @@ func TestExecuteQuery(t *testing.T) {
 	}
 }
 
+func TestExecuteQuery_OrderLimitOffset(t *testing.T) {
+
+	mc := initTestData(t, initConfig(all_schemas))
+
+	qd := &model.QueryData{
+		MetaQuery: map[string]string{"userid": valid_userid},
+		Types:     []string{"basal"},
+		OrderBy:   []model.OrderBy{{Field: "time"}},
+		Limit:     2,
+		Offset:    1,
+	}
+
+	results, err := mc.ExecuteQuery(qd)
+	if err != nil {
+		t.Fatalf("an error was thrown for query [%v] w error [%s]", qd, err.Error())
+	}
+
+	records := []map[string]interface{}{}
+	json.Unmarshal(results, &records)
+
+	if len(records) != 2 {
+		t.Fatalf("we should have been given two results but got [%d]", len(records))
+	}
+
+	//oldest first, skipping the very first
+	if records[0]["time"] != "2014-10-23T08:00:00.000Z" || records[1]["time"] != "2014-10-23T10:00:00.000Z" {
+		t.Fatalf("given times [%s] and [%s] but expected 2014-10-23T08:00:00.000Z and 2014-10-23T10:00:00.000Z", records[0]["time"], records[1]["time"])
+	}
+}
+
+func TestStreamQuery(t *testing.T) {
+
+	mc := initTestData(t, initConfig(all_schemas))
+
+	var streamed bytes.Buffer
+	if err := mc.StreamQuery(basalsQd, NewJSONWriter(&streamed)); err != nil {
+		t.Fatalf("an error was thrown for query [%v] w error [%s]", basalsQd, err.Error())
+	}
+
+	//the same as if we had read them all at once
+	executed, _ := mc.ExecuteQuery(basalsQd)
+
+	var streamedRecords, executedRecords []map[string]interface{}
+	if err := json.Unmarshal(streamed.Bytes(), &streamedRecords); err != nil {
+		t.Fatalf("the streamed results [%s] should be a JSON array but %s", streamed.String(), err.Error())
+	}
+	json.Unmarshal(executed, &executedRecords)
+
+	if len(streamedRecords) != 2 || reflect.DeepEqual(streamedRecords, executedRecords) == false {
+		t.Fatalf("streamed [%s] but expected [%s]", streamed.String(), executed)
+	}
+
+	var none bytes.Buffer
+	if err := mc.StreamQuery(noDataQd, NewJSONWriter(&none)); err != nil || none.String() != "[]" {
+		t.Fatalf("expected an empty array but got [%s] and error %v", none.String(), err)
+	}
+}
+
 func TestExecuteQuery_NoData(t *testing.T) {
 
 	mc := initTestData(t, initConfig(all_schemas))
@@ -399,7 +468,6 @@ func Test_constructQuery_WhereQueryConstruction(t *testing.T) {
 		MetaQuery:       map[string]string{"userid": "1234"},
 		WhereConditions: []model.WhereCondition{model.WhereCondition{Name: "Stuff", Value: "123", Condition: ">"}},
 		Types:           []string{"cbg", "smbg"},
-		InList:          []string{},
 	}
 
 	store := NewMongoStoreClient(initConfig(all_schemas))
@@ -435,9 +503,8 @@ func TestInQueryConstruction(t *testing.T) {
 
 	ourData := &model.QueryData{
 		MetaQuery:       map[string]string{"userid": "1234"},
-		WhereConditions: []model.WhereCondition{model.WhereCondition{Name: "updateId", Value: "NOTHING", Condition: "IN"}},
+		WhereConditions: []model.WhereCondition{model.WhereCondition{Name: "updateId", Values: []interface{}{"firstId", "secondId"}, Condition: "IN"}},
 		Types:           []string{"cbg"},
-		InList:          []string{"firstId", "secondId"},
 	}
 
 	store := NewMongoStoreClient(initConfig(all_schemas))
@@ -458,10 +525,912 @@ func TestInQueryConstruction(t *testing.T) {
 
 	//check the where condition
 	where := query["updateId"]
-	expectedWhere := bson.M{"$in": []string{"firstId", "secondId"}}
+	expectedWhere := bson.M{"$in": []interface{}{"firstId", "secondId"}}
 
 	if reflect.DeepEqual(where, expectedWhere) != true {
 		t.Fatalf("given %v but expected %v", where, expectedWhere)
 	}
 
 }
+
+func TestCombinedQueryConstruction(t *testing.T) {
+
+	ourData := &model.QueryData{
+		MetaQuery: map[string]string{"userid": "1234"},
+		WhereConditions: []model.WhereCondition{
+			model.WhereCondition{Name: "time", Value: "2015-01-01T00:00:00.000Z", Condition: ">"},
+			model.WhereCondition{Name: "time", Value: "2015-01-02T00:00:00.000Z", Condition: "<"},
+			model.WhereCondition{Name: "uploadId", Value: "NOT USED", Condition: "IN", Values: []interface{}{"firstId", "secondId"}},
+			model.WhereCondition{Name: "deviceId", Value: "NOT USED", Condition: "NOT IN", Values: []interface{}{"aDevice"}},
+			model.WhereCondition{Name: "time", Value: "2015-01-01T12:00:00.000Z", Condition: ">"},
+		},
+		Types: []string{"cbg"},
+	}
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	if query["_groupId"] != "1234" {
+		t.Fatalf("_groupId [%v] should have been set to given 1234", query)
+	}
+
+	expectedTime := bson.M{"$gt": "2015-01-01T00:00:00.000Z", "$lt": "2015-01-02T00:00:00.000Z"}
+	if reflect.DeepEqual(query["time"], expectedTime) != true {
+		t.Fatalf("given %v but expected %v", query["time"], expectedTime)
+	}
+
+	expectedUploads := bson.M{"$in": []interface{}{"firstId", "secondId"}}
+	if reflect.DeepEqual(query["uploadId"], expectedUploads) != true {
+		t.Fatalf("given %v but expected %v", query["uploadId"], expectedUploads)
+	}
+
+	expectedDevices := bson.M{"$nin": []interface{}{"aDevice"}}
+	if reflect.DeepEqual(query["deviceId"], expectedDevices) != true {
+		t.Fatalf("given %v but expected %v", query["deviceId"], expectedDevices)
+	}
+
+	//the repeated time condition can't replace the first so is AND'ed
+	expectedAnd := []bson.M{bson.M{"time": bson.M{"$gt": "2015-01-01T12:00:00.000Z"}}}
+	if reflect.DeepEqual(query["$and"], expectedAnd) != true {
+		t.Fatalf("given %v but expected %v", query["$and"], expectedAnd)
+	}
+}
+
+func TestQueryConstruction_CantReplaceGroupId(t *testing.T) {
+
+	ourData := &model.QueryData{
+		MetaQuery:       map[string]string{"userid": "1234"},
+		WhereConditions: []model.WhereCondition{model.WhereCondition{Name: "_groupId", Value: "NOT USED", Condition: "IN", Values: []interface{}{"5678"}}},
+		Types:           []string{"cbg"},
+	}
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	if query["_groupId"] != "1234" {
+		t.Fatalf("_groupId [%v] should still be the given 1234", query)
+	}
+}
+
+func TestBooleanQueryConstruction(t *testing.T) {
+
+	//WHERE (type IN bolus AND normal > 5) OR NOT deviceId IN aDevice
+	ourData := &model.QueryData{
+		MetaQuery: map[string]string{"userid": "1234"},
+		WhereConditions: []model.WhereCondition{
+			model.WhereCondition{Condition: model.CONDITION_OR, Terms: []model.WhereCondition{
+				model.WhereCondition{Condition: model.CONDITION_AND, Terms: []model.WhereCondition{
+					model.WhereCondition{Name: "type", Condition: "IN", Values: []interface{}{"bolus"}},
+					model.WhereCondition{Name: "normal", Condition: ">", Value: "5"},
+				}},
+				model.WhereCondition{Condition: model.CONDITION_NOT, Terms: []model.WhereCondition{
+					model.WhereCondition{Name: "deviceId", Condition: "IN", Values: []interface{}{"aDevice"}},
+				}},
+			}},
+		},
+		Types: []string{"bolus", "wizard"},
+	}
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	expectedAnd := []bson.M{
+		bson.M{"$or": []bson.M{
+			bson.M{"$and": []bson.M{
+				bson.M{"type": bson.M{"$in": []interface{}{"bolus"}}},
+				bson.M{"normal": bson.M{"$gt": "5"}},
+			}},
+			bson.M{"$nor": []bson.M{
+				bson.M{"deviceId": bson.M{"$in": []interface{}{"aDevice"}}},
+			}},
+		}},
+	}
+
+	if reflect.DeepEqual(query["$and"], expectedAnd) != true {
+		t.Fatalf("given %v but expected %v", query["$and"], expectedAnd)
+	}
+
+	expectedTypes := bson.M{"$in": []string{"bolus", "wizard"}}
+	if reflect.DeepEqual(query["type"], expectedTypes) != true {
+		t.Fatalf("given %v but expected %v", query["type"], expectedTypes)
+	}
+}
+
+func TestOperatorQueryConstruction(t *testing.T) {
+
+	ourData := &model.QueryData{
+		MetaQuery: map[string]string{"userid": "1234"},
+		WhereConditions: []model.WhereCondition{
+			model.WhereCondition{Name: "deviceId", Condition: "=", Value: "abc"},
+			model.WhereCondition{Name: "uploadId", Condition: "!=", Value: "def"},
+			model.WhereCondition{Name: "annotations", Condition: "EXISTS"},
+			model.WhereCondition{Name: "suppressed", Condition: "NOT EXISTS"},
+			model.WhereCondition{Name: "source", Condition: "MATCHES", Value: "(?i)^care"},
+		},
+		Types: []string{"cbg"},
+	}
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	expected := map[string]bson.M{
+		"deviceId":    bson.M{"$eq": "abc"},
+		"uploadId":    bson.M{"$ne": "def"},
+		"annotations": bson.M{"$exists": true},
+		"suppressed":  bson.M{"$exists": false},
+		"source":      bson.M{"$regex": "(?i)^care"},
+	}
+
+	for field, where := range expected {
+		if reflect.DeepEqual(query[field], where) != true {
+			t.Fatalf("%s given %v but expected %v", field, query[field], where)
+		}
+	}
+}
+
+func TestTypedQueryConstruction(t *testing.T) {
+
+	start, _ := time.Parse(time.RFC3339, "2015-01-01T00:00:00-08:00")
+
+	ourData := &model.QueryData{
+		MetaQuery: map[string]string{"userid": "1234"},
+		WhereConditions: []model.WhereCondition{
+			model.WhereCondition{Name: "time", Condition: ">=", Value: model.Timestamp{Time: start}},
+			model.WhereCondition{Name: "value", Condition: ">", Value: float64(180)},
+			model.WhereCondition{Name: "suspended", Condition: "=", Value: false},
+		},
+		Types: []string{"cbg"},
+	}
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	expected := map[string]bson.M{
+		//times are compared as the UTC strings they are stored as
+		"time":      bson.M{"$gte": "2015-01-01T08:00:00.000Z"},
+		"value":     bson.M{"$gt": float64(180)},
+		"suspended": bson.M{"$eq": false},
+	}
+
+	for field, where := range expected {
+		if reflect.DeepEqual(query[field], where) != true {
+			t.Fatalf("%s given %v but expected %v", field, query[field], where)
+		}
+	}
+}
+
+func TestRelativeTimeQueryConstruction(t *testing.T) {
+
+	now, _ := time.Parse(time.RFC3339, "2015-03-11T15:30:00Z")
+	model.SetClock(func() time.Time { return now })
+	defer model.SetClock(nil)
+
+	ourData := &model.QueryData{
+		MetaQuery: map[string]string{"userid": "1234"},
+		WhereConditions: []model.WhereCondition{
+			model.WhereCondition{Name: "time", Condition: ">", Value: model.RelativeTime{Anchor: model.ANCHOR_NOW, Offsets: []model.TimeOffset{{Amount: -14, Unit: "d"}}}},
+		},
+		Types: []string{"cbg"},
+	}
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	//resolved against the clock when the query is constructed
+	expected := bson.M{"$gt": "2015-02-25T15:30:00.000Z"}
+
+	if reflect.DeepEqual(query["time"], expected) != true {
+		t.Fatalf("time given %v but expected %v", query["time"], expected)
+	}
+}
+
+func TestAddLocalTimes(t *testing.T) {
+
+	la, _ := time.LoadLocation("America/Los_Angeles")
+
+	results := []interface{}{
+		bson.M{"type": "cbg", "time": "2015-01-13T08:44:04.000Z"},
+		bson.M{"type": "cbg"},
+	}
+
+	addLocalTimes(results, la)
+
+	if local := results[0].(bson.M)["localTime"]; local != "2015-01-13T00:44:04.000-08:00" {
+		t.Fatalf("given %v but expected the time in Los Angeles", local)
+	}
+
+	if local, ok := results[1].(bson.M)["localTime"]; ok {
+		t.Fatalf("given %v but a record without a time should have no localTime", local)
+	}
+}
+
+func TestGetProjection(t *testing.T) {
+
+	if projection := getProjection(nil); reflect.DeepEqual(projection, bson.M{"_id": 0, "_active": 0}) != true {
+		t.Fatalf("given %v but expected everything but the _id and _active", projection)
+	}
+
+	expected := bson.M{"time": 1, "value": 1, "_id": 0}
+	if projection := getProjection([]string{"time", "value", "_id"}); reflect.DeepEqual(projection, expected) != true {
+		t.Fatalf("given %v but expected %v", projection, expected)
+	}
+}
+
+func TestRemoveInternalFields(t *testing.T) {
+
+	results := []interface{}{
+		bson.M{"type": "cbg", "value": 5.5, "_groupId": "1234", "_schemaVersion": 1, "_version": 0},
+	}
+
+	removeInternalFields(results, []string{"type", "value", "_schemaVersion"})
+
+	expected := bson.M{"type": "cbg", "value": 5.5, "_schemaVersion": 1}
+	if reflect.DeepEqual(results[0], expected) != true {
+		t.Fatalf("given %v but expected %v", results[0], expected)
+	}
+}
+
+func TestGetSort(t *testing.T) {
+
+	if sortFields := getSort(bson.M{}, nil); reflect.DeepEqual(sortFields, query_fields) != true {
+		t.Fatalf("given %v but expected the index fields %v", sortFields, query_fields)
+	}
+
+	if sortFields := getSort(bson.M{"uploadId": "abcd"}, nil); reflect.DeepEqual(sortFields, uploadid_query_fields) != true {
+		t.Fatalf("given %v but expected the uploadId index fields %v", sortFields, uploadid_query_fields)
+	}
+
+	orderBy := []model.OrderBy{{Field: "time"}, {Field: "value", Descending: true}}
+	expected := []string{"time", "-value"}
+	if sortFields := getSort(bson.M{}, orderBy); reflect.DeepEqual(sortFields, expected) != true {
+		t.Fatalf("given %v but expected %v", sortFields, expected)
+	}
+}
+
+func TestGetLimitConstruction(t *testing.T) {
+
+	store := initQueryStore(0)
+
+	if limit := store.getLimit(0); limit != 0 {
+		t.Fatalf("given %d but expected no limit", limit)
+	}
+
+	store.config.MaxLimit = 100
+
+	limits := map[int]int{0: 100, 50: 50, 100: 100, 500: 100}
+	for requested, expected := range limits {
+		if limit := store.getLimit(requested); limit != expected {
+			t.Fatalf("requested %d given %d but expected %d", requested, limit, expected)
+		}
+	}
+}
+
+func TestCursorPageQueryConstruction(t *testing.T) {
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(basalsQd)
+
+	after := &model.Cursor{Time: "2014-10-23T08:00:00.000Z", Id: "54a4cf6b4c3c5cfe5ba0a6e1"}
+	if err := addCursor(query, after); err != nil {
+		t.Fatalf("the cursor should be valid but gave %s", err.Error())
+	}
+
+	id := bson.ObjectIdHex(after.Id)
+	expected := []bson.M{bson.M{"$or": []bson.M{
+		bson.M{"time": bson.M{"$lt": after.Time}},
+		bson.M{"time": after.Time, "_id": bson.M{"$lt": id}},
+	}}}
+
+	if reflect.DeepEqual(query["$and"], expected) != true {
+		t.Fatalf("given %v but expected %v", query["$and"], expected)
+	}
+
+	if err := addCursor(query, &model.Cursor{Time: after.Time, Id: "1234"}); err == nil {
+		t.Fatal("a cursor with an invalid id should give an error")
+	}
+}
+
+func TestPageFields(t *testing.T) {
+
+	if projection := getPageProjection(nil); reflect.DeepEqual(projection, bson.M{"_active": 0}) != true {
+		t.Fatalf("given %v but the _id should be included", projection)
+	}
+
+	expected := bson.M{"value": 1, "time": 1, "_id": 1}
+	if projection := getPageProjection([]string{"value"}); reflect.DeepEqual(projection, expected) != true {
+		t.Fatalf("given %v but expected %v", projection, expected)
+	}
+
+	id := bson.NewObjectId()
+	results := []interface{}{bson.M{"value": 5.5, "time": "2014-10-23T08:00:00.000Z", "_id": id}}
+
+	if next := cursorAt(results[0]); next == nil || next.Id != id.Hex() || next.Time != "2014-10-23T08:00:00.000Z" {
+		t.Fatalf("given cursor %v for the last record %v", next, results[0])
+	}
+
+	removePageFields(results, []string{"value"})
+	if reflect.DeepEqual(results[0], bson.M{"value": 5.5}) != true {
+		t.Fatalf("given %v but only the selected fields should remain", results[0])
+	}
+}
+
+func TestExecuteQueryPage(t *testing.T) {
+
+	mc := initTestData(t, initConfig(all_schemas))
+
+	qd := &model.QueryData{
+		MetaQuery: map[string]string{"userid": valid_userid},
+		Types:     []string{"basal"},
+	}
+
+	var times []string
+	var after *model.Cursor
+	for page := 0; page < 10; page++ {
+		var results bytes.Buffer
+		next, err := mc.ExecuteQueryPage(qd, after, 3, NewJSONWriter(&results))
+		if err != nil {
+			t.Fatalf("an error was thrown for page [%d] w error [%s]", page, err.Error())
+		}
+		records := []map[string]interface{}{}
+		json.Unmarshal(results.Bytes(), &records)
+		for i := range records {
+			if records[i]["_id"] != nil {
+				t.Fatalf("the _id should not be returned but is [%s]", records[i]["_id"])
+			}
+			times = append(times, records[i]["time"].(string))
+		}
+		if next == nil {
+			break
+		}
+		after = next
+	}
+
+	if len(times) != 12 {
+		t.Fatalf("all 12 basals should be returned across the pages, including those with the same time, but got [%d]", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i] > times[i-1] {
+			t.Fatalf("the pages should be newest first but [%s] followed [%s]", times[i], times[i-1])
+		}
+	}
+}
+
+func TestAggregatePipelineConstruction(t *testing.T) {
+
+	store := initQueryStore(100)
+
+	qd := &model.QueryData{
+		MetaQuery:  map[string]string{"userid": valid_userid},
+		Types:      []string{"cbg"},
+		Aggregates: []model.Aggregate{{Function: model.AGGREGATE_COUNT, Field: "*"}, {Function: model.AGGREGATE_AVG, Field: "value"}, {Function: model.AGGREGATE_STDDEV, Field: "value"}},
+		GroupBy:    []model.GroupKey{{Field: "type"}, {Field: "time", Truncate: model.TRUNCATE_DAY}},
+		OrderBy:    []model.OrderBy{{Field: "time", Descending: true}},
+		Offset:     10,
+	}
+
+	pipeline := store.constructPipeline(qd)
+
+	if len(pipeline) != 5 {
+		t.Fatalf("expected $match, $group, $sort, $skip and $limit but got %v", pipeline)
+	}
+
+	if reflect.DeepEqual(pipeline[0]["$match"], store.constructQuery(qd)) != true {
+		t.Fatalf("given match %v but expected the query", pipeline[0]["$match"])
+	}
+
+	expectedGroup := bson.M{
+		"_id": bson.M{"k0": "$type", "k1": bson.M{"$substr": []interface{}{"$time", 0, 10}}},
+		"a0":  bson.M{"$sum": 1},
+		"a1":  bson.M{"$avg": "$value"},
+		//the standard deviation is worked out from these rather than every value
+		"a2_n":       getDeviationAccumulators("value")[deviation_count],
+		"a2_sum":     getDeviationAccumulators("value")[deviation_sum],
+		"a2_squares": getDeviationAccumulators("value")[deviation_squares],
+	}
+	if reflect.DeepEqual(pipeline[1]["$group"], expectedGroup) != true {
+		t.Fatalf("given group %v but expected %v", pipeline[1]["$group"], expectedGroup)
+	}
+
+	expectedSort := bson.D{{Name: "_id.k1", Value: -1}, {Name: "_id.k0", Value: 1}}
+	if reflect.DeepEqual(pipeline[2]["$sort"], expectedSort) != true {
+		t.Fatalf("given sort %v but expected %v", pipeline[2]["$sort"], expectedSort)
+	}
+
+	if pipeline[3]["$skip"] != 10 || pipeline[4]["$limit"] != 100 {
+		t.Fatalf("given %v and %v but expected to skip 10 and limit to 100", pipeline[3], pipeline[4])
+	}
+}
+
+func TestPercentile(t *testing.T) {
+
+	values := []interface{}{4.0, 1.0, 3, 2.0, int64(5)}
+
+	percentiles := map[float64]float64{0: 1, 50: 3, 90: 4.6, 100: 5}
+	for p, expected := range percentiles {
+		if value := percentile(values, p); math.Abs(value.(float64)-expected) > 1e-9 {
+			t.Fatalf("percentile %v given %v but expected %v", p, value, expected)
+		}
+	}
+
+	if value := percentile([]interface{}{}, 50); value != nil {
+		t.Fatalf("given %v but expected nil when there are no values", value)
+	}
+}
+
+func TestStandardDeviation(t *testing.T) {
+
+	//of 2, 4, 4, 4, 5, 5, 7 and 9
+	group := bson.M{"a0_n": 8, "a0_sum": 40.0, "a0_squares": int64(232)}
+	if value := standardDeviation(group, "a0"); math.Abs(value.(float64)-2) > 1e-9 {
+		t.Fatalf("given %v but expected 2", value)
+	}
+
+	if value := standardDeviation(bson.M{"a0_n": 0, "a0_sum": 0, "a0_squares": 0}, "a0"); value != nil {
+		t.Fatalf("given %v but expected nil when there are no values", value)
+	}
+}
+
+func TestGetDeviationAccumulators(t *testing.T) {
+
+	isNumber := bson.M{"$and": []interface{}{bson.M{"$gt": []interface{}{"$value", nil}}, bson.M{"$lt": []interface{}{"$value", ""}}}}
+	number := bson.M{"$cond": []interface{}{isNumber, "$value", 0}}
+	expected := bson.M{
+		"_n":       bson.M{"$sum": bson.M{"$cond": []interface{}{isNumber, 1, 0}}},
+		"_sum":     bson.M{"$sum": number},
+		"_squares": bson.M{"$sum": bson.M{"$multiply": []interface{}{number, number}}},
+	}
+	if accumulators := getDeviationAccumulators("value"); reflect.DeepEqual(accumulators, expected) != true {
+		t.Fatalf("given %v but expected %v", accumulators, expected)
+	}
+}
+
+func TestCheckPercentileValues(t *testing.T) {
+
+	counted := 0
+	countOf := func(records int) func() (int, error) {
+		return func() (int, error) {
+			counted++
+			return records, nil
+		}
+	}
+
+	average := &model.QueryData{Aggregates: []model.Aggregate{{Function: model.AGGREGATE_AVG, Field: "value"}}}
+	if err := checkPercentileValues(average, countOf(max_percentile_values+1)); err != nil || counted != 0 {
+		t.Fatalf("given %v after counting [%d] times but expected the records not to be counted without a percentile", err, counted)
+	}
+
+	percentiles := &model.QueryData{Aggregates: []model.Aggregate{
+		{Function: model.AGGREGATE_PERCENTILE, Field: "value", Percentile: 10},
+		{Function: model.AGGREGATE_PERCENTILE, Field: "value", Percentile: 90},
+	}}
+	if err := checkPercentileValues(percentiles, countOf(max_percentile_values)); err != nil || counted != 1 {
+		t.Fatalf("given %v after counting [%d] times but expected the records to be counted once", err, counted)
+	}
+	if err := checkPercentileValues(percentiles, countOf(max_percentile_values+1)); err != ErrTooManyValues {
+		t.Fatalf("given %v but expected %v", err, ErrTooManyValues)
+	}
+
+	failed := errors.New("count failed")
+	if err := checkPercentileValues(percentiles, func() (int, error) { return 0, failed }); err != failed {
+		t.Fatalf("given %v but expected %v", err, failed)
+	}
+}
+
+func TestGetAggregateResult(t *testing.T) {
+
+	qd := &model.QueryData{
+		Aggregates: []model.Aggregate{{Function: model.AGGREGATE_COUNT, Field: "*"}, {Function: model.AGGREGATE_PERCENTILE, Field: "value", Percentile: 50}, {Function: model.AGGREGATE_STDDEV, Field: "value"}},
+		GroupBy:    []model.GroupKey{{Field: "time", Truncate: model.TRUNCATE_DAY}},
+	}
+
+	group := bson.M{"_id": bson.M{"k0": "2014-10-23"}, "a0": 3, "a1": []interface{}{1.0, 9.0, 5.0}, "a2_n": 2, "a2_sum": 4.0, "a2_squares": 10.0}
+	expected := bson.M{"day(time)": "2014-10-23", "count(*)": 3, "percentile(value,50)": 5.0, "stddev(value)": 1.0}
+
+	if result := getAggregateResult(group, qd); reflect.DeepEqual(result, expected) != true {
+		t.Fatalf("given %v but expected %v", result, expected)
+	}
+}
+
+func TestStreamAggregates(t *testing.T) {
+
+	mc := initTestData(t, initConfig(all_schemas))
+
+	qd := &model.QueryData{
+		MetaQuery:  map[string]string{"userid": valid_userid},
+		Types:      []string{"basal"},
+		Aggregates: []model.Aggregate{{Function: model.AGGREGATE_COUNT, Field: "*"}},
+		GroupBy:    []model.GroupKey{{Field: "time", Truncate: model.TRUNCATE_DAY}},
+	}
+
+	results, err := mc.ExecuteQuery(qd)
+	if err != nil {
+		t.Fatalf("an error was thrown for query [%v] w error [%s]", qd, err.Error())
+	}
+
+	groups := []map[string]interface{}{}
+	json.Unmarshal(results, &groups)
+
+	//the latest schema version of the basals on each of the two days
+	if len(groups) != 2 || groups[0]["day(time)"] != "2014-10-23" || groups[1]["day(time)"] != "2014-10-28" {
+		t.Fatalf("given groups [%s] but expected 2014-10-23 and 2014-10-28", results)
+	}
+}
+
+func TestBucketPipelineConstruction(t *testing.T) {
+
+	store := initQueryStore(0)
+
+	qd := &model.QueryData{
+		MetaQuery: map[string]string{"userid": valid_userid},
+		Types:     []string{"cbg"},
+		Bucket:    time.Hour,
+		Limit:     24,
+	}
+
+	pipeline := store.constructBucketPipeline(qd)
+
+	//the LIMIT is of the buckets so isn't applied to the pieces they are made up of
+	if len(pipeline) != 3 {
+		t.Fatalf("expected $match, $group and $sort but got %v", pipeline)
+	}
+
+	//the same permissions and schema versions as any other query
+	match, _ := pipeline[0]["$match"].(bson.M)
+	if match["_groupId"] != valid_groupid || match["_active"] != true || match["_schemaVersion"] == nil {
+		t.Fatalf("given match %v but expected the base query", match)
+	}
+
+	group, _ := pipeline[1]["$group"].(bson.M)
+	expectedId := bson.M{"k0": "$type", "k1": bson.M{"$substr": []interface{}{"$time", 0, 13}}, "k2": 0}
+	if reflect.DeepEqual(group["_id"], expectedId) != true {
+		t.Fatalf("given group %v but expected it to be by type and hour", group["_id"])
+	}
+
+	//the slot of a 15m bucket within the hour
+	qd.Bucket = 15 * time.Minute
+	group, _ = store.constructBucketPipeline(qd)[1]["$group"].(bson.M)
+	minutes := bson.M{"$substr": []interface{}{"$time", 14, 2}}
+	slot := bson.M{"$add": []interface{}{
+		bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{minutes, "15"}}, 1, 0}},
+		bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{minutes, "30"}}, 1, 0}},
+		bson.M{"$cond": []interface{}{bson.M{"$gte": []interface{}{minutes, "45"}}, 1, 0}},
+	}}
+	expectedId = bson.M{"k0": "$type", "k1": bson.M{"$substr": []interface{}{"$time", 0, 13}}, "k2": slot}
+	if reflect.DeepEqual(group["_id"], expectedId) != true {
+		t.Fatalf("given group %v but expected it to be by type, hour and quarter hour", group["_id"])
+	}
+
+	for _, name := range []string{"count", "min", "max", "sum", "values"} {
+		if group[name] == nil {
+			t.Fatalf("given group %v but expected %s", group, name)
+		}
+	}
+}
+
+func TestGetBucketSlots(t *testing.T) {
+
+	slots := map[time.Duration]bucketSlots{
+		time.Minute:        {length: 16},
+		15 * time.Minute:   {length: 13, at: 14, unit: time.Minute, units: 60},
+		time.Hour:          {length: 13},
+		6 * time.Hour:      {length: 10, at: 11, unit: time.Hour, units: 24},
+		24 * time.Hour:     {length: 10},
+		7 * 24 * time.Hour: {length: 10},
+	}
+
+	for bucket, expected := range slots {
+		if given := getBucketSlots(bucket); given != expected {
+			t.Fatalf("[%s] given %v but expected %v", bucket, given, expected)
+		}
+	}
+}
+
+func TestGetBucketStart(t *testing.T) {
+
+	starts := []struct {
+		keys     bson.M
+		bucket   time.Duration
+		expected time.Time
+	}{
+		{bson.M{"k1": "2015-01-13T08", "k2": 2}, 15 * time.Minute, time.Date(2015, 1, 13, 8, 30, 0, 0, time.UTC)},
+		{bson.M{"k1": "2015-01-13", "k2": 3}, 6 * time.Hour, time.Date(2015, 1, 13, 18, 0, 0, 0, time.UTC)},
+		{bson.M{"k1": "2015-01-13T08:44", "k2": 0}, time.Minute, time.Date(2015, 1, 13, 8, 44, 0, 0, time.UTC)},
+		//from the unix epoch, which was a Thursday
+		{bson.M{"k1": "2015-01-13", "k2": 0}, 7 * 24 * time.Hour, time.Date(2015, 1, 8, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for i := range starts {
+		if start, ok := getBucketStart(starts[i].keys, starts[i].bucket); !ok || !start.Equal(starts[i].expected) {
+			t.Fatalf("%v given %v but expected %v", starts[i].keys, start, starts[i].expected)
+		}
+	}
+
+	if _, ok := getBucketStart(bson.M{"k1": nil}, time.Hour); ok {
+		t.Fatal("records without a time aren't in a bucket")
+	}
+}
+
+//keeps the records written to it
+type keptRecords struct {
+	records []map[string]interface{}
+}
+
+func (k *keptRecords) WriteRecord(record map[string]interface{}) error {
+	k.records = append(k.records, record)
+	return nil
+}
+
+func (k *keptRecords) Close() error { return nil }
+
+func (k *keptRecords) Abort() {}
+
+func TestBucketMerger(t *testing.T) {
+
+	//the days of 2d buckets, from the unix epoch so 2015-01-13 starts one
+	days := []bson.M{
+		{"_id": bson.M{"k0": "cbg", "k1": "2015-01-13", "k2": 0}, "count": 2, "min": 5.0, "max": 7.0, "sum": 12.0, "values": 2},
+		{"_id": bson.M{"k0": "cbg", "k1": "2015-01-14", "k2": 0}, "count": 1, "min": 9.0, "max": 9.0, "sum": 9.0, "values": 1},
+		{"_id": bson.M{"k0": "cbg", "k1": "2015-01-15", "k2": 0}, "count": 1, "min": 4.0, "max": 4.0, "sum": 4.0, "values": 1},
+		{"_id": bson.M{"k0": "smbg", "k1": "2015-01-14", "k2": 0}, "count": 1, "min": nil, "max": nil, "sum": 0, "values": 0},
+	}
+
+	kept := &keptRecords{}
+	merger := newBucketMerger(&model.QueryData{Bucket: 2 * 24 * time.Hour}, kept, 0)
+	for i := range days {
+		if err := merger.add(days[i]); err != nil {
+			t.Fatalf("adding %v gave %s", days[i], err.Error())
+		}
+	}
+	merger.flush()
+
+	expected := []map[string]interface{}{
+		bson.M{"type": "cbg", "time": "2015-01-13T00:00:00.000Z", "count": 3, "min": 5.0, "mean": 7.0, "max": 9.0},
+		bson.M{"type": "cbg", "time": "2015-01-15T00:00:00.000Z", "count": 1, "min": 4.0, "mean": 4.0, "max": 4.0},
+		bson.M{"type": "smbg", "time": "2015-01-13T00:00:00.000Z", "count": 1, "min": nil, "mean": nil, "max": nil},
+	}
+	if reflect.DeepEqual(kept.records, expected) != true {
+		t.Fatalf("given %v but expected %v", kept.records, expected)
+	}
+
+	//the OFFSET and LIMIT are of the buckets
+	kept = &keptRecords{}
+	merger = newBucketMerger(&model.QueryData{Bucket: 2 * 24 * time.Hour, Offset: 1}, kept, 1)
+	for i := range days {
+		merger.add(days[i])
+	}
+	merger.flush()
+
+	if len(kept.records) != 1 || kept.records[0]["time"] != "2015-01-15T00:00:00.000Z" {
+		t.Fatalf("given %v but expected only the second bucket", kept.records)
+	}
+
+	//shorter buckets are whole when they are read
+	kept = &keptRecords{}
+	merger = newBucketMerger(&model.QueryData{Bucket: 30 * time.Minute}, kept, 0)
+	merger.add(bson.M{"_id": bson.M{"k0": "cbg", "k1": "2015-01-13T08", "k2": 1}, "count": 2, "min": 5.0, "max": 7.0, "sum": 12.0, "values": 2})
+	merger.flush()
+
+	if len(kept.records) != 1 || kept.records[0]["time"] != "2015-01-13T08:30:00.000Z" || kept.records[0]["mean"] != 6.0 {
+		t.Fatalf("given %v but expected the bucket from 08:30", kept.records)
+	}
+}
+
+func TestGetBucketResult(t *testing.T) {
+
+	qd := &model.QueryData{Bucket: time.Hour, Timezone: time.FixedZone("PST", -8*60*60)}
+
+	start := time.Date(2015, 1, 13, 8, 0, 0, 0, time.UTC)
+	group := bson.M{"_id": bson.M{"k0": "cbg", "k1": start}, "count": 12, "min": 4.2, "mean": 6.1, "max": 9.9}
+	expected := bson.M{
+		"type":      "cbg",
+		"time":      "2015-01-13T08:00:00.000Z",
+		"localTime": "2015-01-13T00:00:00.000-08:00",
+		"count":     12,
+		"min":       4.2,
+		"mean":      6.1,
+		"max":       9.9,
+	}
+
+	if result := getBucketResult(group, qd); reflect.DeepEqual(result, expected) != true {
+		t.Fatalf("given %v but expected %v", result, expected)
+	}
+}
+
+func TestReadingsQueryConstruction(t *testing.T) {
+
+	store := initQueryStore(0)
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := store.getReadingsQuery(valid_groupid, []string{"cbg", "smbg"}, from, from.AddDate(0, 0, 14))
+
+	if query["_groupId"] != valid_groupid || query["_active"] != true || query["_schemaVersion"] == nil {
+		t.Fatalf("given %v but expected the base query", query)
+	}
+
+	expected := bson.M{"$gte": "2015-01-01T00:00:00.000Z", "$lt": "2015-01-15T00:00:00.000Z"}
+	if reflect.DeepEqual(query["time"], expected) != true {
+		t.Fatalf("given %v but expected %v", query["time"], expected)
+	}
+}
+
+func TestGetReading(t *testing.T) {
+
+	if value, units, ok := getReading(bson.M{"value": 5.5, "units": "mmol/L"}); !ok || value != 5.5 || units != "mmol/L" {
+		t.Fatalf("given %v %s but expected 5.5 mmol/L", value, units)
+	}
+	if value, _, ok := getReading(bson.M{"value": 120}); !ok || value != 120 {
+		t.Fatalf("given %v but expected 120", value)
+	}
+	if _, _, ok := getReading(bson.M{"value": "high"}); ok {
+		t.Fatal("a reading without a number should be skipped")
+	}
+}
+
+func TestPrecedingBasalQueryConstruction(t *testing.T) {
+
+	store := initQueryStore(0)
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := store.getPrecedingBasalQuery(valid_groupid, from)
+
+	if query["_groupId"] != valid_groupid || query["_active"] != true || query["type"] != "basal" {
+		t.Fatalf("given %v but expected the base query for basals", query)
+	}
+
+	expected := bson.M{"$lt": "2015-01-01T00:00:00.000Z"}
+	if reflect.DeepEqual(query["time"], expected) != true {
+		t.Fatalf("given %v but expected %v", query["time"], expected)
+	}
+}
+
+func TestAddToTotals(t *testing.T) {
+
+	from := time.Date(2014, 10, 23, 0, 0, 0, 0, time.UTC)
+	totals := model.NewDailyTotals(&model.TotalsQuery{From: from, To: from.AddDate(0, 0, 1), Location: time.UTC})
+
+	records := []bson.M{
+		{"type": "bolus", "time": "2014-10-23T08:00:00.000Z", "normal": 2.5, "extended": 1.5},
+		{"type": "bolus", "time": "2014-10-23T12:00:00.000Z", "normal": 4},
+		{"type": "basal", "time": "2014-10-23T07:00:00.000Z", "rate": 0.8, "duration": 3600000},
+		//only the half hour of this basal after midnight is in the period
+		{"type": "basal", "time": "2014-10-22T23:30:00.000Z", "rate": 1.6, "duration": 3600000},
+		{"type": "basal", "time": "2014-10-23T08:00:00.000Z", "deliveryType": "suspend", "duration": 3600000},
+		{"type": "wizard", "time": "2014-10-23T12:00:00.000Z", "carbInput": 60},
+		{"type": "bolus", "normal": 10},
+	}
+	for i := range records {
+		addToTotals(totals, records[i])
+	}
+
+	report := totals.Report()
+	day := report.Days[0]
+	if len(report.Days) != 1 || day.Bolus != 8 || day.Basal != 1.6 || day.Carbs != 60 {
+		t.Fatalf("given %v but expected only 2014-10-23 with 8u of bolus, 1.6u of basal and 60g of carbs", report.Days)
+	}
+}
+
+func TestConvertGlucoseFields(t *testing.T) {
+
+	results := []interface{}{
+		bson.M{"type": "cbg", "value": 10.0, "units": "mmol/L"},
+		bson.M{"type": "wizard", "bgInput": 5.55, "bgTarget": bson.M{"low": 4.44, "high": 6.66}, "units": "mmol/L", "carbInput": 45},
+		bson.M{"type": "basal", "rate": 0.8},
+	}
+
+	convertGlucoseFields(results, model.UNITS_MGDL)
+
+	expected := []interface{}{
+		bson.M{"type": "cbg", "value": 180.0, "units": "mg/dL"},
+		bson.M{"type": "wizard", "bgInput": 100.0, "bgTarget": bson.M{"low": 80.0, "high": 120.0}, "units": "mg/dL", "carbInput": 45},
+		bson.M{"type": "basal", "rate": 0.8},
+	}
+	if reflect.DeepEqual(results, expected) != true {
+		t.Fatalf("given %v but expected %v", results, expected)
+	}
+}
+
+func TestAggregateInUnits(t *testing.T) {
+
+	if max := aggregateInUnits(10.0, model.AGGREGATE_MAX, model.UNITS_MGDL); max != 180.0 {
+		t.Fatalf("given %v but expected the max to be shown as 180", max)
+	}
+	if avg := aggregateInUnits(10.0, model.AGGREGATE_AVG, model.UNITS_MGDL); avg != 10*model.MGDL_PER_MMOLL {
+		t.Fatalf("given %v but expected the average not to be rounded", avg)
+	}
+	if none := aggregateInUnits(nil, model.AGGREGATE_MIN, model.UNITS_MGDL); none != nil {
+		t.Fatalf("given %v but expected nil when there are no values", none)
+	}
+	if same := aggregateInUnits(10.0, model.AGGREGATE_AVG, ""); same != 10.0 {
+		t.Fatalf("given %v but expected it unchanged without units", same)
+	}
+}
+
+func TestGetDataGaps(t *testing.T) {
+
+	mc := initTestData(t, initConfig(all_schemas))
+
+	from := time.Date(2014, 10, 23, 0, 0, 0, 0, time.UTC)
+	query := &model.GapsQuery{Type: "basal", From: from, To: from.AddDate(0, 0, 6), MinimumGap: 3 * time.Hour}
+
+	result, err := mc.GetDataGaps(valid_groupid, query)
+	if err != nil {
+		t.Fatalf("an error was thrown for query [%v] w error [%s]", query, err.Error())
+	}
+
+	report := model.GapsReport{}
+	json.Unmarshal(result, &report)
+
+	//before the first basal, between the two days of basals and after the last
+	if len(report.Gaps) != 3 || report.Gaps[1].Start != "2014-10-23T11:00:00.000Z" || report.Gaps[1].End != "2014-10-28T07:00:00.000Z" {
+		t.Fatalf("given gaps [%s] but expected three with the second from 2014-10-23T11:00:00.000Z to 2014-10-28T07:00:00.000Z", result)
+	}
+}
+
+func TestCohortQueryConstruction(t *testing.T) {
+
+	ourData := &model.QueryData{
+		Cohort: []string{"12d7bc90fa", "5a8c1e2f"},
+		Types:  []string{"cbg"},
+	}
+	ourData.AddSubject("5678", "subject5678")
+	ourData.AddSubject("1234", "subject1234")
+
+	store := initQueryStore(0)
+
+	query := store.constructQuery(ourData)
+
+	expected := bson.M{"$in": []string{"1234", "5678"}}
+	if !reflect.DeepEqual(query["_groupId"], expected) {
+		t.Fatalf("given _groupId %v but expected %v", query["_groupId"], expected)
+	}
+	if !reflect.DeepEqual(query["type"], bson.M{"$in": []string{"cbg"}}) {
+		t.Fatalf("given type %v but expected cbg", query["type"])
+	}
+
+	//the _groupId is needed for the subjectId, but can't be added when the other fields are excluded
+	if projection := addSubjectProjection(getProjection(nil), ourData); projection["_groupId"] != nil {
+		t.Fatalf("given %v but expected no _groupId", projection)
+	}
+	ourData.Fields = []string{"time"}
+	if projection := addSubjectProjection(getProjection(ourData.Fields), ourData); projection["_groupId"] != 1 {
+		t.Fatalf("given %v but expected the _groupId", projection)
+	}
+}
+
+func TestAddSubjectIds(t *testing.T) {
+
+	subjects := map[string]string{"1234": "a1b2c3"}
+	results := []interface{}{bson.M{"_groupId": "1234", "type": "cbg", "value": 5.5}}
+
+	addSubjectIds(results, subjects)
+
+	expected := bson.M{"subjectId": "a1b2c3", "type": "cbg", "value": 5.5}
+	if !reflect.DeepEqual(results[0], expected) {
+		t.Fatalf("given %v but expected %v", results[0], expected)
+	}
+}
+
+func TestGetSubjectAggregateResult(t *testing.T) {
+
+	details := &model.QueryData{
+		Subjects:   map[string]string{"1234": "a1b2c3"},
+		GroupBy:    []model.GroupKey{{Field: "subjectId"}},
+		Aggregates: []model.Aggregate{{Function: model.AGGREGATE_COUNT, Field: "*"}},
+	}
+
+	if key := getGroupKey(details.GroupBy[0]); key != "$_groupId" {
+		t.Fatalf("given %v but expected $_groupId", key)
+	}
+
+	result := getAggregateResult(bson.M{"_id": bson.M{"k0": "1234"}, "a0": 12}, details)
+	if result["subjectId"] != "a1b2c3" || result["count(*)"] != 12 {
+		t.Fatalf("given %v but expected the subjectId and count", result)
+	}
+}
@@ -0,0 +1,253 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"labix.org/v2/mgo/bson"
+)
+
+type (
+	// RecordWriter writes out the records of a query one at a time as they are read
+	RecordWriter interface {
+		WriteRecord(record map[string]interface{}) error
+		// Close finishes writing, there are no more records
+		Close() error
+		// Abort gives up writing when the query fails, anything kept while writing is removed
+		Abort()
+	}
+
+	// writes a JSON array of the records
+	jsonWriter struct {
+		w       io.Writer
+		written bool
+	}
+
+	// writes a line of JSON for each record
+	ndjsonWriter struct {
+		w io.Writer
+	}
+
+	// writes a CSV file with a row for each record. When we aren't given the columns they
+	// are all of the fields found, so the rows are kept in a temporary file until we have them.
+	csvWriter struct {
+		w       *csv.Writer
+		columns []string
+		header  bool
+		//when finding the columns
+		found map[string]bool
+		spill *os.File
+		lines *bufio.Writer
+	}
+)
+
+func NewJSONWriter(w io.Writer) RecordWriter {
+	return &jsonWriter{w: w}
+}
+
+func (j *jsonWriter) WriteRecord(record map[string]interface{}) error {
+	jsonRecord, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	separator := ","
+	if !j.written {
+		separator = "["
+		j.written = true
+	}
+	_, err = j.w.Write(append([]byte(separator), jsonRecord...))
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	end := "]"
+	if !j.written {
+		end = "[]"
+	}
+	_, err := j.w.Write([]byte(end))
+	return err
+}
+
+func (j *jsonWriter) Abort() {}
+
+func NewNDJSONWriter(w io.Writer) RecordWriter {
+	return &ndjsonWriter{w: w}
+}
+
+func (n *ndjsonWriter) WriteRecord(record map[string]interface{}) error {
+	jsonRecord, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = n.w.Write(append(jsonRecord, '\n'))
+	return err
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+func (n *ndjsonWriter) Abort() {}
+
+// NewCSVWriter with the given columns, or with every field found in the records when there are none.
+// Nested fields are columns of their own e.g. units.bg
+func NewCSVWriter(w io.Writer, columns []string) RecordWriter {
+	return &csvWriter{w: csv.NewWriter(w), columns: columns}
+}
+
+// the nested fields as their own dot separated fields, lists are kept as JSON
+func flatten(prefix string, record map[string]interface{}, into map[string]interface{}) {
+	for field, value := range record {
+		switch v := value.(type) {
+		case bson.M:
+			flatten(prefix+field+".", v, into)
+		case map[string]interface{}:
+			flatten(prefix+field+".", v, into)
+		case []interface{}:
+			list, _ := json.Marshal(v)
+			into[prefix+field] = string(list)
+		default:
+			into[prefix+field] = v
+		}
+	}
+}
+
+func csvCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (c *csvWriter) writeRow(flat map[string]interface{}) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+	}
+	row := make([]string, len(c.columns))
+	for i := range c.columns {
+		row[i] = csvCell(flat[c.columns[i]])
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) WriteRecord(record map[string]interface{}) error {
+	flat := map[string]interface{}{}
+	flatten("", record, flat)
+
+	if c.columns != nil && c.found == nil {
+		return c.writeRow(flat)
+	}
+
+	if c.spill == nil {
+		spill, err := ioutil.TempFile("", "octopus-csv")
+		if err != nil {
+			return err
+		}
+		c.spill, c.lines, c.found = spill, bufio.NewWriter(spill), map[string]bool{}
+	}
+	//the columns are in the order we find them
+	fields := make([]string, 0, len(flat))
+	for field := range flat {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i := range fields {
+		if !c.found[fields[i]] {
+			c.found[fields[i]] = true
+			c.columns = append(c.columns, fields[i])
+		}
+	}
+	line, err := json.Marshal(flat)
+	if err != nil {
+		return err
+	}
+	_, err = c.lines.Write(append(line, '\n'))
+	return err
+}
+
+// remove the rows we kept, they are patient data so can't be left behind
+func (c *csvWriter) removeSpilled() {
+	if c.spill == nil {
+		return
+	}
+	c.spill.Close()
+	os.Remove(c.spill.Name())
+	c.spill = nil
+}
+
+// write out the rows we kept until we knew the columns
+func (c *csvWriter) writeSpilled() error {
+	defer c.removeSpilled()
+
+	if err := c.lines.Flush(); err != nil {
+		return err
+	}
+	if _, err := c.spill.Seek(0, 0); err != nil {
+		return err
+	}
+	lines := json.NewDecoder(c.spill)
+	for {
+		flat := map[string]interface{}{}
+		if err := lines.Decode(&flat); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := c.writeRow(flat); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *csvWriter) Close() error {
+	if c.spill != nil {
+		if err := c.writeSpilled(); err != nil {
+			return err
+		}
+	}
+	if !c.header && c.columns != nil {
+		//no records but we still know the columns
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Abort() {
+	c.removeSpilled()
+}
@@ -0,0 +1,127 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package clients
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	writer_records = []map[string]interface{}{
+		bson.M{"type": "cbg", "time": "2014-10-23T07:00:00.000Z", "value": 5.5},
+		bson.M{"type": "settings", "time": "2014-10-23T08:00:00.000Z", "units": bson.M{"bg": "mg/dL", "carb": "grams"}, "carbRatio": []interface{}{14, 11}},
+	}
+)
+
+func writeAll(out RecordWriter, t *testing.T) {
+	for i := range writer_records {
+		if err := out.WriteRecord(writer_records[i]); err != nil {
+			t.Fatalf("writing the record %v gave %s", writer_records[i], err.Error())
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("close gave %s", err.Error())
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+
+	var written bytes.Buffer
+	writeAll(NewJSONWriter(&written), t)
+
+	expected := `[{"time":"2014-10-23T07:00:00.000Z","type":"cbg","value":5.5},{"carbRatio":[14,11],"time":"2014-10-23T08:00:00.000Z","type":"settings","units":{"bg":"mg/dL","carb":"grams"}}]`
+	if written.String() != expected {
+		t.Fatalf("given %s but expected %s", written.String(), expected)
+	}
+
+	var none bytes.Buffer
+	NewJSONWriter(&none).Close()
+	if none.String() != "[]" {
+		t.Fatalf("given %s but expected an empty array", none.String())
+	}
+}
+
+func TestNDJSONWriter(t *testing.T) {
+
+	var written bytes.Buffer
+	writeAll(NewNDJSONWriter(&written), t)
+
+	expected := `{"time":"2014-10-23T07:00:00.000Z","type":"cbg","value":5.5}
+{"carbRatio":[14,11],"time":"2014-10-23T08:00:00.000Z","type":"settings","units":{"bg":"mg/dL","carb":"grams"}}
+`
+	if written.String() != expected {
+		t.Fatalf("given %s but expected %s", written.String(), expected)
+	}
+}
+
+func TestCSVWriter_SelectedColumns(t *testing.T) {
+
+	var written bytes.Buffer
+	writeAll(NewCSVWriter(&written, []string{"time", "value", "units.bg"}), t)
+
+	expected := "time,value,units.bg\n2014-10-23T07:00:00.000Z,5.5,\n2014-10-23T08:00:00.000Z,,mg/dL\n"
+	if written.String() != expected {
+		t.Fatalf("given %s but expected %s", written.String(), expected)
+	}
+
+	var none bytes.Buffer
+	NewCSVWriter(&none, []string{"time", "value"}).Close()
+	if none.String() != "time,value\n" {
+		t.Fatalf("given %s but expected just the header", none.String())
+	}
+}
+
+func TestCSVWriter_AllColumns(t *testing.T) {
+
+	var written bytes.Buffer
+	writeAll(NewCSVWriter(&written, nil), t)
+
+	//the columns are those of each record in the order they are found
+	expected := "time,type,value,carbRatio,units.bg,units.carb\n" +
+		"2014-10-23T07:00:00.000Z,cbg,5.5,,,\n" +
+		"2014-10-23T08:00:00.000Z,settings,,\"[14,11]\",mg/dL,grams\n"
+	if written.String() != expected {
+		t.Fatalf("given %s but expected %s", written.String(), expected)
+	}
+}
+
+func TestCSVWriter_Abort(t *testing.T) {
+
+	var written bytes.Buffer
+	out := NewCSVWriter(&written, nil)
+	if err := out.WriteRecord(writer_records[0]); err != nil {
+		t.Fatalf("writing the record gave %s", err.Error())
+	}
+
+	spill := out.(*csvWriter).spill.Name()
+	if _, err := os.Stat(spill); err != nil {
+		t.Fatalf("the rows should be kept in [%s] until the columns are known but %s", spill, err.Error())
+	}
+
+	out.Abort()
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Fatalf("the kept rows in [%s] should be removed when writing is given up", spill)
+	}
+	if written.Len() != 0 {
+		t.Fatalf("given %s but expected nothing to be written", written.String())
+	}
+}
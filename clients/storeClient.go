@@ -22,7 +22,13 @@ import "../model"
 type StoreClient interface {
 	Close()
 	ExecuteQuery(details *model.QueryData) ([]byte, error)
+	StreamQuery(details *model.QueryData, out RecordWriter) error
+	ExecuteQueryPage(details *model.QueryData, after *model.Cursor, size int, out RecordWriter) (*model.Cursor, error)
 	GetTimeLastEntryUser(groupId string) ([]byte, error)
 	GetTimeLastEntryUserAndDevice(groupId, deviceId string) ([]byte, error)
+	GetGlucoseStats(groupId string, query *model.StatsQuery) ([]byte, error)
+	GetAGP(groupId string, query *model.AGPQuery) ([]byte, error)
+	GetDailyTotals(groupId string, query *model.TotalsQuery) ([]byte, error)
+	GetDataGaps(groupId string, query *model.GapsQuery) ([]byte, error)
 	Ping() error
 }
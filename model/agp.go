@@ -0,0 +1,145 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_AGP_SLOT = 15 * time.Minute
+)
+
+var (
+	// the percentiles of each slot in the standard AGP
+	agp_percentiles = []float64{5, 25, 50, 75, 95}
+	// the slots a day can be split into
+	agp_slots = []time.Duration{5 * time.Minute, 15 * time.Minute}
+
+	error_invalid_slot     = errors.New("the slot must be 5 or 15 minutes")
+	error_invalid_location = errors.New("the timezone must be given")
+)
+
+type (
+	// AGPQuery is the period, units and local time of day slots for an ambulatory glucose profile
+	AGPQuery struct {
+		StatsQuery
+		Slot     time.Duration
+		Location *time.Location
+	}
+
+	// AGPSlot is the percentiles of the readings in a slot of the day e.g. 08:15 is those from 08:15 up to 08:30
+	AGPSlot struct {
+		Time  string   `json:"time"`
+		Count int      `json:"count"`
+		P5    *float64 `json:"p5,omitempty"`
+		P25   *float64 `json:"p25,omitempty"`
+		P50   *float64 `json:"p50,omitempty"`
+		P75   *float64 `json:"p75,omitempty"`
+		P95   *float64 `json:"p95,omitempty"`
+	}
+
+	// AGPReport is every slot of the day in order, slots without readings only have their time and count
+	AGPReport struct {
+		From        string        `json:"from"`
+		To          string        `json:"to"`
+		Units       string        `json:"units"`
+		Timezone    string        `json:"timezone"`
+		SlotMinutes int           `json:"slotMinutes"`
+		Count       int           `json:"count"`
+		Thresholds  GlucoseRanges `json:"thresholds"`
+		Slots       []AGPSlot     `json:"slots"`
+	}
+
+	// AGPProfile collects the readings for each slot of the day
+	AGPProfile struct {
+		query *AGPQuery
+		count int
+		slots [][]float64
+	}
+)
+
+// Percentile of the sorted values, interpolating between the two closest when it falls between them
+func Percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	below := math.Floor(rank)
+	above := math.Ceil(rank)
+	return sorted[int(below)] + (sorted[int(above)]-sorted[int(below)])*(rank-below)
+}
+
+// Validate the query before it is run
+func (q *AGPQuery) Validate() error {
+	if err := q.StatsQuery.Validate(); err != nil {
+		return err
+	}
+	if q.Location == nil {
+		return error_invalid_location
+	}
+	for i := range agp_slots {
+		if q.Slot == agp_slots[i] {
+			return nil
+		}
+	}
+	return error_invalid_slot
+}
+
+// NewAGPProfile for the readings of the query
+func NewAGPProfile(query *AGPQuery) *AGPProfile {
+	return &AGPProfile{query: query, slots: make([][]float64, int(24*time.Hour/query.Slot))}
+}
+
+// Add a reading at the given time, in the units it is stored in
+func (a *AGPProfile) Add(at time.Time, value float64, units string) {
+	local := at.In(a.query.Location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	slot := int(sinceMidnight / a.query.Slot)
+	a.slots[slot] = append(a.slots[slot], ConvertGlucose(value, units, a.query.Units))
+	a.count++
+}
+
+// Report the percentiles for each slot
+func (a *AGPProfile) Report() *AGPReport {
+	report := &AGPReport{
+		From:        a.query.From.UTC().Format(TIME_FORMAT),
+		To:          a.query.To.UTC().Format(TIME_FORMAT),
+		Units:       a.query.Units,
+		Timezone:    a.query.Location.String(),
+		SlotMinutes: int(a.query.Slot / time.Minute),
+		Count:       a.count,
+		Thresholds:  a.query.Ranges,
+		Slots:       make([]AGPSlot, len(a.slots)),
+	}
+	for i, values := range a.slots {
+		start := time.Duration(i) * a.query.Slot
+		slot := AGPSlot{Time: fmt.Sprintf("%02d:%02d", int(start.Hours()), int(start.Minutes())%60), Count: len(values)}
+		if len(values) > 0 {
+			sort.Float64s(values)
+			percentiles := make([]float64, len(agp_percentiles))
+			for j := range agp_percentiles {
+				percentiles[j] = Percentile(values, agp_percentiles[j])
+			}
+			slot.P5, slot.P25, slot.P50, slot.P75, slot.P95 = &percentiles[0], &percentiles[1], &percentiles[2], &percentiles[3], &percentiles[4]
+		}
+		report.Slots[i] = slot
+	}
+	return report
+}
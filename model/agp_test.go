@@ -0,0 +1,87 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func agpQuery(slot time.Duration, loc *time.Location) *AGPQuery {
+	return &AGPQuery{StatsQuery: *statsQuery(UNITS_MGDL), Slot: slot, Location: loc}
+}
+
+func TestPercentile(t *testing.T) {
+
+	sorted := []float64{1, 2, 3, 4, 5}
+
+	percentiles := map[float64]float64{0: 1, 5: 1.2, 50: 3, 95: 4.8, 100: 5}
+	for p, expected := range percentiles {
+		if value := Percentile(sorted, p); !near(value, expected) {
+			t.Fatalf("percentile %v given %v but expected %v", p, value, expected)
+		}
+	}
+
+	if value := Percentile([]float64{7}, 25); value != 7 {
+		t.Fatalf("given %v but expected 7 for a single value", value)
+	}
+}
+
+func TestAGPQuery_Validate(t *testing.T) {
+
+	if err := agpQuery(5*time.Minute, time.UTC).Validate(); err != nil {
+		t.Fatalf("the query should be valid but got %v", err)
+	}
+
+	invalid := []*AGPQuery{agpQuery(10*time.Minute, time.UTC), agpQuery(DEFAULT_AGP_SLOT, nil)}
+	for i := range invalid {
+		if err := invalid[i].Validate(); err == nil {
+			t.Fatalf("%v should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestAGPProfile_Report(t *testing.T) {
+
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	profile := NewAGPProfile(agpQuery(DEFAULT_AGP_SLOT, la))
+
+	//08:00 to 08:14 in Los Angeles on two days
+	for i, mgdl := range []float64{100, 120, 140, 160, 180} {
+		at := time.Date(2015, 1, 1+i%2, 16, 3*i, 0, 0, time.UTC)
+		profile.Add(at, mgdl/MGDL_PER_MMOLL, UNITS_MMOLL)
+	}
+
+	report := profile.Report()
+
+	if len(report.Slots) != 96 || report.Count != 5 || report.Timezone != "America/Los_Angeles" || report.SlotMinutes != 15 {
+		t.Fatalf("given %d slots for %d readings in %s but expected 96 15 minute slots for 5 readings in America/Los_Angeles", len(report.Slots), report.Count, report.Timezone)
+	}
+
+	slot := report.Slots[32]
+	if slot.Time != "08:00" || slot.Count != 5 {
+		t.Fatalf("given slot %s with %d readings but expected 08:00 with 5", slot.Time, slot.Count)
+	}
+	if !near(*slot.P5, 104) || !near(*slot.P25, 120) || !near(*slot.P50, 140) || !near(*slot.P75, 160) || !near(*slot.P95, 176) {
+		t.Fatalf("given %v %v %v %v %v", *slot.P5, *slot.P25, *slot.P50, *slot.P75, *slot.P95)
+	}
+
+	if empty := report.Slots[95]; empty.Time != "23:45" || empty.Count != 0 || empty.P50 != nil {
+		t.Fatalf("given %v but expected an empty slot at 23:45", empty)
+	}
+}
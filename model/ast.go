@@ -0,0 +1,170 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Query is the parsed form of
+	//
+	//	METAQUERY WHERE <field> IS|CONTAINS <value> | METAQUERY WHERE userid IN <values>
+	//	QUERY [SELECT <fields or aggregates>] TYPE IN <types> [WHERE <expression>] [IN TIMEZONE <zone>]
+	//	[GROUP BY <keys>] [BUCKET BY <duration>] [ORDER BY <field> [ASC|DESC]] [LIMIT <n>] [OFFSET <n>] [UNITS <units>]
+	Query struct {
+		Meta       *MetaQuery
+		Select     []string
+		Aggregates []Aggregate
+		GroupBy    []GroupKey
+		Bucket     time.Duration
+		Types      []string
+		Where      Expr
+		Timezone   *time.Location
+		OrderBy    []OrderBy
+		Limit      int
+		Offset     int
+		Units      string
+	}
+
+	// Aggregate is a function over a field for each group of records e.g. AVG(value) or PERCENTILE(value, 90)
+	Aggregate struct {
+		Function string //one of COUNT, AVG, MIN, MAX, SUM, STDDEV or PERCENTILE
+		Field    string //* for COUNT(*)
+		//for a PERCENTILE, from 0 to 100
+		Percentile float64
+	}
+
+	// GroupKey is a field the records are grouped on, a time can be truncated to its day, hour or month
+	GroupKey struct {
+		Field    string
+		Truncate string
+	}
+
+	// OrderBy is a field the results are sorted on
+	OrderBy struct {
+		Field      string
+		Descending bool
+	}
+
+	// MetaQuery selects whose data we are querying
+	MetaQuery struct {
+		Field    string
+		Operator string
+		Value    string
+		//the userids of the cohort for IN
+		Values []string
+		Pos    Position
+	}
+
+	// Expr is any node that can appear in a QUERY WHERE clause
+	Expr interface {
+		Position() Position
+	}
+
+	// Comparison is a single `field op value` test e.g. time > 2015-01-01T00:00:00.000Z,
+	// the Value is a string, float64, bool or Timestamp
+	Comparison struct {
+		Field    string
+		Operator string
+		Value    interface{}
+		Pos      Position
+	}
+
+	// Membership is `field IN values` or `field NOT IN values`
+	Membership struct {
+		Field   string
+		Negated bool
+		Values  []interface{}
+		Pos     Position
+	}
+
+	// Existence is `field EXISTS` or `field NOT EXISTS`
+	Existence struct {
+		Field   string
+		Negated bool
+		Pos     Position
+	}
+
+	// Match is `field MATCHES /pattern/`, any flags are given inline in the Pattern
+	Match struct {
+		Field   string
+		Pattern string
+		Pos     Position
+	}
+
+	// AndExpr holds two or more expressions that must all be true
+	AndExpr struct {
+		Terms []Expr
+		Pos   Position
+	}
+
+	// OrExpr holds two or more expressions where at least one must be true
+	OrExpr struct {
+		Terms []Expr
+		Pos   Position
+	}
+
+	// NotExpr is true when its term is not
+	NotExpr struct {
+		Term Expr
+		Pos  Position
+	}
+)
+
+func (c *Comparison) Position() Position { return c.Pos }
+func (m *Membership) Position() Position { return m.Pos }
+func (e *Existence) Position() Position  { return e.Pos }
+func (m *Match) Position() Position      { return m.Pos }
+func (a *AndExpr) Position() Position    { return a.Pos }
+func (o *OrExpr) Position() Position     { return o.Pos }
+func (n *NotExpr) Position() Position    { return n.Pos }
+
+// the condition text we expose via WhereCondition
+func (m *Membership) condition() string {
+	if m.Negated {
+		return "NOT IN"
+	}
+	return "IN"
+}
+
+func (e *Existence) condition() string {
+	if e.Negated {
+		return "NOT EXISTS"
+	}
+	return "EXISTS"
+}
+
+// Name is what the aggregate is called in the results e.g. avg(value)
+func (a Aggregate) Name() string {
+	if a.Function == AGGREGATE_PERCENTILE {
+		return fmt.Sprintf("%s(%s,%s)", strings.ToLower(a.Function), a.Field, strconv.FormatFloat(a.Percentile, 'f', -1, 64))
+	}
+	return fmt.Sprintf("%s(%s)", strings.ToLower(a.Function), a.Field)
+}
+
+// Name is what the key is called in the results e.g. type or day(time)
+func (k GroupKey) Name() string {
+	if k.Truncate == "" {
+		return k.Field
+	}
+	return fmt.Sprintf("%s(%s)", strings.ToLower(k.Truncate), k.Field)
+}
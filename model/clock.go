@@ -0,0 +1,40 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"time"
+)
+
+// Clock gives the current time that relative times such as NOW - 14d are resolved against
+type Clock func() time.Time
+
+var clock Clock = time.Now
+
+// SetClock replaces the clock e.g. with a fixed time for tests, nil restores the system clock
+func SetClock(c Clock) {
+	if c == nil {
+		c = time.Now
+	}
+	clock = c
+}
+
+// Now is the current time from the clock
+func Now() time.Time {
+	return clock()
+}
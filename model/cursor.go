@@ -0,0 +1,52 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Cursor is the last record of a page of results, the next page starts from the record that follows it.
+// Pages are always newest first so the time and id are all we need, and records added meanwhile don't move it.
+type Cursor struct {
+	Time string `json:"time"`
+	Id   string `json:"id"`
+}
+
+var error_invalid_cursor = errors.New("the cursor isn't one that we gave you")
+
+// String gives the cursor in the opaque form we give to the client
+func (c *Cursor) String() string {
+	raw, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(raw)
+}
+
+// ParseCursor from the opaque form given by String
+func ParseCursor(opaque string) (*Cursor, error) {
+	raw, err := base64.URLEncoding.DecodeString(opaque)
+	if err != nil {
+		return nil, error_invalid_cursor
+	}
+	c := &Cursor{}
+	if err := json.Unmarshal(raw, c); err != nil || c.Id == "" {
+		return nil, error_invalid_cursor
+	}
+	return c, nil
+}
@@ -0,0 +1,42 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+
+	cursor := &Cursor{Time: "2015-01-01T00:00:00.000Z", Id: "54a4cf6b4c3c5cfe5ba0a6e1"}
+
+	parsed, err := ParseCursor(cursor.String())
+	if err != nil {
+		t.Fatalf("the cursor should parse but gave %s", err.Error())
+	}
+	if *parsed != *cursor {
+		t.Fatalf("given %v but expected %v", parsed, cursor)
+	}
+
+	invalid := []string{"", "not a cursor", "e30="}
+	for i := range invalid {
+		if _, err := ParseCursor(invalid[i]); err == nil {
+			t.Fatalf("[%s] should not be a cursor", invalid[i])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DEFAULT_MINIMUM_GAP = time.Hour
+)
+
+var (
+	error_invalid_gap_type = errors.New("the type must be given")
+	error_invalid_gap      = errors.New("the minimum gap must be longer than 0")
+)
+
+type (
+	// GapsQuery is the type of records and the period to look for gaps in, and how long a gap has to be to count
+	GapsQuery struct {
+		Type       string
+		From       time.Time
+		To         time.Time
+		MinimumGap time.Duration
+	}
+
+	// Gap is a time without any records, from the record before it or the start of the period to the record after or the end
+	Gap struct {
+		Start   string  `json:"start"`
+		End     string  `json:"end"`
+		Minutes float64 `json:"minutes"`
+	}
+
+	// GapsReport is the gaps in the period oldest first, along with the first and last records found
+	GapsReport struct {
+		From              string  `json:"from"`
+		To                string  `json:"to"`
+		Type              string  `json:"type"`
+		MinimumGapMinutes float64 `json:"minimumGapMinutes"`
+		Count             int     `json:"count"`
+		FirstRecord       string  `json:"firstRecord,omitempty"`
+		LastRecord        string  `json:"lastRecord,omitempty"`
+		Gaps              []Gap   `json:"gaps"`
+	}
+
+	// GapFinder looks for gaps between the times of the records, which are added oldest first
+	GapFinder struct {
+		query  *GapsQuery
+		report *GapsReport
+		last   time.Time
+	}
+)
+
+// Validate the query before it is run
+func (q *GapsQuery) Validate() error {
+	if q.Type == "" {
+		return error_invalid_gap_type
+	}
+	if q.MinimumGap <= 0 {
+		return error_invalid_gap
+	}
+	if !q.From.Before(q.To) {
+		return error_invalid_period
+	}
+	return nil
+}
+
+// NewGapFinder for the query
+func NewGapFinder(query *GapsQuery) *GapFinder {
+	return &GapFinder{
+		query: query,
+		last:  query.From,
+		report: &GapsReport{
+			From:              query.From.UTC().Format(TIME_FORMAT),
+			To:                query.To.UTC().Format(TIME_FORMAT),
+			Type:              query.Type,
+			MinimumGapMinutes: query.MinimumGap.Minutes(),
+			Gaps:              []Gap{},
+		},
+	}
+}
+
+// a gap from the start to the end when it's at least the minimum
+func (g *GapFinder) gap(start, end time.Time) {
+	if end.Sub(start) >= g.query.MinimumGap {
+		g.report.Gaps = append(g.report.Gaps, Gap{
+			Start:   start.UTC().Format(TIME_FORMAT),
+			End:     end.UTC().Format(TIME_FORMAT),
+			Minutes: end.Sub(start).Minutes(),
+		})
+	}
+}
+
+// Add the time of the next record
+func (g *GapFinder) Add(at time.Time) {
+	g.gap(g.last, at)
+	if g.report.Count == 0 {
+		g.report.FirstRecord = at.UTC().Format(TIME_FORMAT)
+	}
+	g.report.LastRecord = at.UTC().Format(TIME_FORMAT)
+	g.report.Count++
+	g.last = at
+}
+
+// Report the gaps, including the one from the last record to the end of the period
+func (g *GapFinder) Report() *GapsReport {
+	g.gap(g.last, g.query.To)
+	return g.report
+}
@@ -0,0 +1,82 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGapsQuery_Validate(t *testing.T) {
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := (&GapsQuery{Type: "cbg", From: from, To: from.AddDate(0, 0, 1), MinimumGap: time.Hour}).Validate(); err != nil {
+		t.Fatalf("the query should be valid but got %v", err)
+	}
+
+	invalid := []*GapsQuery{
+		{From: from, To: from.AddDate(0, 0, 1), MinimumGap: time.Hour},
+		{Type: "cbg", From: from, To: from.AddDate(0, 0, 1)},
+		{Type: "cbg", From: from, To: from, MinimumGap: time.Hour},
+	}
+	for i := range invalid {
+		if err := invalid[i].Validate(); err == nil {
+			t.Fatalf("%v should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestGapFinder_Report(t *testing.T) {
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	gaps := NewGapFinder(&GapsQuery{Type: "cbg", From: from, To: from.AddDate(0, 0, 1), MinimumGap: time.Hour})
+
+	//every 5 minutes from 00:30 to 02:00, then again from 05:00 to 06:00 for a gap of 3 hours
+	for at := from.Add(30 * time.Minute); !at.After(from.Add(2 * time.Hour)); at = at.Add(5 * time.Minute) {
+		gaps.Add(at)
+	}
+	for at := from.Add(5 * time.Hour); !at.After(from.Add(6 * time.Hour)); at = at.Add(5 * time.Minute) {
+		gaps.Add(at)
+	}
+
+	report := gaps.Report()
+
+	if report.Count != 32 || report.FirstRecord != "2015-01-01T00:30:00.000Z" || report.LastRecord != "2015-01-01T06:00:00.000Z" {
+		t.Fatalf("given %d records from %s to %s", report.Count, report.FirstRecord, report.LastRecord)
+	}
+
+	//the 30 minutes before the first record is too short to count, but the time since the last is a gap
+	expected := []Gap{
+		{Start: "2015-01-01T02:00:00.000Z", End: "2015-01-01T05:00:00.000Z", Minutes: 180},
+		{Start: "2015-01-01T06:00:00.000Z", End: "2015-01-02T00:00:00.000Z", Minutes: 1080},
+	}
+	if len(report.Gaps) != 2 || report.Gaps[0] != expected[0] || report.Gaps[1] != expected[1] {
+		t.Fatalf("given %v but expected %v", report.Gaps, expected)
+	}
+}
+
+func TestGapFinder_NoRecords(t *testing.T) {
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := NewGapFinder(&GapsQuery{Type: "cbg", From: from, To: from.AddDate(0, 0, 1), MinimumGap: time.Hour}).Report()
+
+	if report.Count != 0 || report.FirstRecord != "" || len(report.Gaps) != 1 || report.Gaps[0].Minutes != 1440 {
+		t.Fatalf("given %v but expected the whole day to be a gap", report)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	UNITS_MGDL  = "mg/dL"
+	UNITS_MMOLL = "mmol/L"
+
+	// the molar mass of glucose over 10, mg/dL = mmol/L * MGDL_PER_MMOLL
+	MGDL_PER_MMOLL = 18.01559
+
+	// a cgm gives a reading every 5 minutes
+	CGM_READING_INTERVAL = 5 * time.Minute
+)
+
+var (
+	// the consensus ranges for time in range
+	default_ranges = map[string]GlucoseRanges{
+		UNITS_MGDL:  {VeryLow: 54, Low: 70, High: 180, VeryHigh: 250},
+		UNITS_MMOLL: {VeryLow: 3.0, Low: 3.9, High: 10.0, VeryHigh: 13.9},
+	}
+
+	error_invalid_units  = errors.New("units must be mg/dL or mmol/L")
+	error_invalid_ranges = errors.New("the thresholds must be veryLow < low < high < veryHigh")
+	error_invalid_period = errors.New("the period must start before it ends")
+)
+
+type (
+	// GlucoseRanges are the thresholds between the time in range bands. A reading below VeryLow is very low, below Low
+	// is low, up to and including High is in the target range, up to and including VeryHigh is high and above that very high.
+	GlucoseRanges struct {
+		VeryLow  float64 `json:"veryLow"`
+		Low      float64 `json:"low"`
+		High     float64 `json:"high"`
+		VeryHigh float64 `json:"veryHigh"`
+	}
+
+	// StatsQuery is the period the statistics are for and the units they are given in
+	StatsQuery struct {
+		From   time.Time
+		To     time.Time
+		Units  string
+		Ranges GlucoseRanges //in the Units
+	}
+
+	// TimeInRange is the percentage of readings in each band
+	TimeInRange struct {
+		VeryLow  float64 `json:"veryLow"`
+		Low      float64 `json:"low"`
+		Target   float64 `json:"target"`
+		High     float64 `json:"high"`
+		VeryHigh float64 `json:"veryHigh"`
+	}
+
+	// GlucoseStats are the usual measures of glucose control over a period, those that need readings are
+	// left out when there are none
+	GlucoseStats struct {
+		From       string        `json:"from"`
+		To         string        `json:"to"`
+		Units      string        `json:"units"`
+		Type       string        `json:"type"` //cbg, or smbg when there are no cbg readings
+		Count      int           `json:"count"`
+		Thresholds GlucoseRanges `json:"thresholds"`
+		Mean       *float64      `json:"mean,omitempty"`
+		// the population standard deviation
+		StandardDeviation *float64 `json:"standardDeviation,omitempty"`
+		// the standard deviation as a percentage of the mean
+		CoefficientOfVariation *float64     `json:"coefficientOfVariation,omitempty"`
+		GMI                    *float64     `json:"gmi,omitempty"`
+		EstimatedA1c           *float64     `json:"estimatedA1c,omitempty"`
+		TimeInRange            *TimeInRange `json:"timeInRange,omitempty"`
+		// the percentage of the period a cgm was giving readings, only for cbg
+		SensorWear *float64 `json:"sensorWear,omitempty"`
+	}
+
+	// GlucoseSummary accumulates the readings of one type so the statistics can be given without holding them all
+	GlucoseSummary struct {
+		Type       string
+		query      *StatsQuery
+		count      int
+		sum        float64
+		sumSquares float64
+		bands      [5]int
+	}
+)
+
+// ParseUnits gives the units as we write them whatever their case
+func ParseUnits(text string) (string, error) {
+	for _, units := range []string{UNITS_MGDL, UNITS_MMOLL} {
+		if strings.EqualFold(text, units) {
+			return units, nil
+		}
+	}
+	return "", error_invalid_units
+}
+
+// ConvertGlucose from one of mg/dL or mmol/L to the other, anything else is taken to be mmol/L as that is how it is stored
+func ConvertGlucose(value float64, from, to string) float64 {
+	if from == UNITS_MGDL && to != UNITS_MGDL {
+		return value / MGDL_PER_MMOLL
+	}
+	if from != UNITS_MGDL && to == UNITS_MGDL {
+		return value * MGDL_PER_MMOLL
+	}
+	return value
+}
+
+// DefaultGlucoseRanges are the consensus thresholds in the given units
+func DefaultGlucoseRanges(units string) GlucoseRanges {
+	return default_ranges[units]
+}
+
+// Valid when each threshold is above the one before
+func (r GlucoseRanges) Valid() bool {
+	return r.VeryLow < r.Low && r.Low < r.High && r.High < r.VeryHigh
+}
+
+// Validate the query before it is run
+func (q *StatsQuery) Validate() error {
+	if _, err := ParseUnits(q.Units); err != nil {
+		return err
+	}
+	if !q.Ranges.Valid() {
+		return error_invalid_ranges
+	}
+	if !q.From.Before(q.To) {
+		return error_invalid_period
+	}
+	return nil
+}
+
+// NewGlucoseSummary for readings of the given type
+func NewGlucoseSummary(glucoseType string, query *StatsQuery) *GlucoseSummary {
+	return &GlucoseSummary{Type: glucoseType, query: query}
+}
+
+// Add a reading given in the units it is stored in
+func (s *GlucoseSummary) Add(value float64, units string) {
+	value = ConvertGlucose(value, units, s.query.Units)
+	s.count++
+	s.sum += value
+	s.sumSquares += value * value
+
+	ranges := s.query.Ranges
+	switch {
+	case value < ranges.VeryLow:
+		s.bands[0]++
+	case value < ranges.Low:
+		s.bands[1]++
+	case value <= ranges.High:
+		s.bands[2]++
+	case value <= ranges.VeryHigh:
+		s.bands[3]++
+	default:
+		s.bands[4]++
+	}
+}
+
+// Count of the readings added
+func (s *GlucoseSummary) Count() int {
+	return s.count
+}
+
+// Stats for the readings added
+func (s *GlucoseSummary) Stats() *GlucoseStats {
+	stats := &GlucoseStats{
+		From:       s.query.From.UTC().Format(TIME_FORMAT),
+		To:         s.query.To.UTC().Format(TIME_FORMAT),
+		Units:      s.query.Units,
+		Type:       s.Type,
+		Count:      s.count,
+		Thresholds: s.query.Ranges,
+	}
+	if s.count == 0 {
+		return stats
+	}
+
+	count := float64(s.count)
+	mean := s.sum / count
+	sd := math.Sqrt(math.Max(s.sumSquares/count-mean*mean, 0))
+	cv := 100 * sd / mean
+	//both are from the mean in mg/dL
+	meanMgdl := ConvertGlucose(mean, s.query.Units, UNITS_MGDL)
+	gmi := 3.31 + 0.02392*meanMgdl
+	a1c := (meanMgdl + 46.7) / 28.7
+
+	stats.Mean = &mean
+	stats.StandardDeviation = &sd
+	stats.CoefficientOfVariation = &cv
+	stats.GMI = &gmi
+	stats.EstimatedA1c = &a1c
+	stats.TimeInRange = &TimeInRange{
+		VeryLow:  100 * float64(s.bands[0]) / count,
+		Low:      100 * float64(s.bands[1]) / count,
+		Target:   100 * float64(s.bands[2]) / count,
+		High:     100 * float64(s.bands[3]) / count,
+		VeryHigh: 100 * float64(s.bands[4]) / count,
+	}
+
+	if s.Type == "cbg" {
+		expected := float64(s.query.To.Sub(s.query.From) / CGM_READING_INTERVAL)
+		wear := math.Min(100*count/expected, 100)
+		stats.SensorWear = &wear
+	}
+	return stats
+}
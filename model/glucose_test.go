@@ -0,0 +1,127 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func statsQuery(units string) *StatsQuery {
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &StatsQuery{From: from, To: from.AddDate(0, 0, 1), Units: units, Ranges: DefaultGlucoseRanges(units)}
+}
+
+func near(given, expected float64) bool {
+	return math.Abs(given-expected) < 1e-6
+}
+
+func TestConvertGlucose(t *testing.T) {
+
+	if mgdl := ConvertGlucose(10, UNITS_MMOLL, UNITS_MGDL); !near(mgdl, 180.1559) {
+		t.Fatalf("given %v but expected 180.1559", mgdl)
+	}
+	if mmol := ConvertGlucose(180.1559, UNITS_MGDL, UNITS_MMOLL); !near(mmol, 10) {
+		t.Fatalf("given %v but expected 10", mmol)
+	}
+	//stored values without units are mmol/L
+	if mgdl := ConvertGlucose(10, "", UNITS_MGDL); !near(mgdl, 180.1559) {
+		t.Fatalf("given %v but expected 180.1559", mgdl)
+	}
+	if same := ConvertGlucose(5.5, UNITS_MMOLL, UNITS_MMOLL); same != 5.5 {
+		t.Fatalf("given %v but expected 5.5", same)
+	}
+}
+
+func TestParseUnits(t *testing.T) {
+
+	if units, err := ParseUnits("MG/DL"); err != nil || units != UNITS_MGDL {
+		t.Fatalf("given %s but expected %s", units, UNITS_MGDL)
+	}
+	if _, err := ParseUnits("mg"); err == nil {
+		t.Fatal("mg should have given an error")
+	}
+}
+
+func TestStatsQuery_Validate(t *testing.T) {
+
+	if err := statsQuery(UNITS_MGDL).Validate(); err != nil {
+		t.Fatalf("the query should be valid but got %v", err)
+	}
+
+	backwards := statsQuery(UNITS_MGDL)
+	backwards.From, backwards.To = backwards.To, backwards.From
+	overlapping := statsQuery(UNITS_MGDL)
+	overlapping.Ranges.Low = 200
+	noUnits := statsQuery(UNITS_MGDL)
+	noUnits.Units = ""
+
+	for _, invalid := range []*StatsQuery{backwards, overlapping, noUnits} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("%v should have given an error", invalid)
+		}
+	}
+}
+
+func TestGlucoseSummary_Stats(t *testing.T) {
+
+	summary := NewGlucoseSummary("cbg", statsQuery(UNITS_MGDL))
+	//stored in mmol/L: one very low, one low, two in range (one right on the threshold) and one high
+	for _, mgdl := range []float64{50, 60, 100, 180, 200} {
+		summary.Add(mgdl/MGDL_PER_MMOLL, UNITS_MMOLL)
+	}
+
+	stats := summary.Stats()
+
+	if stats.Count != 5 || stats.Units != UNITS_MGDL || stats.From != "2015-01-01T00:00:00.000Z" {
+		t.Fatalf("given %v but expected 5 readings in mg/dL from 2015-01-01", stats)
+	}
+	if !near(*stats.Mean, 118) {
+		t.Fatalf("given mean %v but expected 118", *stats.Mean)
+	}
+	//the population standard deviation of the readings
+	if !near(*stats.StandardDeviation, math.Sqrt(3776)) || !near(*stats.CoefficientOfVariation, 100*math.Sqrt(3776)/118) {
+		t.Fatalf("given standard deviation %v and cv %v", *stats.StandardDeviation, *stats.CoefficientOfVariation)
+	}
+	if !near(*stats.GMI, 3.31+0.02392*118) || !near(*stats.EstimatedA1c, (118+46.7)/28.7) {
+		t.Fatalf("given gmi %v and estimated a1c %v", *stats.GMI, *stats.EstimatedA1c)
+	}
+
+	expected := TimeInRange{VeryLow: 20, Low: 20, Target: 40, High: 20}
+	if *stats.TimeInRange != expected {
+		t.Fatalf("given %v but expected %v", *stats.TimeInRange, expected)
+	}
+
+	//five readings in a day is very little wear
+	if !near(*stats.SensorWear, 100*5.0/288) {
+		t.Fatalf("given sensor wear %v but expected %v", *stats.SensorWear, 100*5.0/288)
+	}
+}
+
+func TestGlucoseSummary_NoReadings(t *testing.T) {
+
+	stats := NewGlucoseSummary("smbg", statsQuery(UNITS_MMOLL)).Stats()
+
+	if stats.Count != 0 || stats.Mean != nil || stats.TimeInRange != nil || stats.SensorWear != nil {
+		t.Fatalf("given %v but expected no statistics without readings", stats)
+	}
+	if stats.Thresholds != DefaultGlucoseRanges(UNITS_MMOLL) {
+		t.Fatalf("given thresholds %v but expected the defaults", stats.Thresholds)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"time"
+)
+
+const (
+	// the status of a job as it is run
+	JOB_QUEUED  = "queued"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+// Job is a query that is run in the background, its results are kept until it expires
+type Job struct {
+	Id string `json:"id"`
+	//the user who submitted it, no one else can see it
+	UserId string `json:"userid"`
+	Status string `json:"status"`
+	//the format of the results e.g. text/csv
+	ContentType string `json:"contentType"`
+	Created     string `json:"created"`
+	Started     string `json:"started,omitempty"`
+	Finished    string `json:"finished,omitempty"`
+	//when the job and its results are removed
+	Expires string `json:"expires,omitempty"`
+	//why it failed
+	Error string `json:"error,omitempty"`
+	//the users the query is for, the submitter must still be able to view their data to get the results
+	Groups []QueriedGroup `json:"groups,omitempty"`
+}
+
+// QueriedGroup is a user looked up by a field of the query along with the groupId their data is kept in
+type QueriedGroup struct {
+	Field     string `json:"field"`
+	QueriedId string `json:"queriedId"`
+	GroupId   string `json:"groupId"`
+}
+
+// NewJob for the user that is queued to run
+func NewJob(id, userId, contentType string, now time.Time) *Job {
+	return &Job{Id: id, UserId: userId, Status: JOB_QUEUED, ContentType: contentType, Created: now.UTC().Format(TIME_FORMAT)}
+}
+
+// Start running the job
+func (j *Job) Start(now time.Time) {
+	j.Status = JOB_RUNNING
+	j.Started = now.UTC().Format(TIME_FORMAT)
+}
+
+// Finish the job, it failed when there is an error. It expires once it has been finished for the ttl.
+func (j *Job) Finish(now time.Time, ttl time.Duration, err error) {
+	j.Status = JOB_DONE
+	if err != nil {
+		j.Status = JOB_FAILED
+		j.Error = err.Error()
+	}
+	j.Finished = now.UTC().Format(TIME_FORMAT)
+	j.Expires = now.Add(ttl).UTC().Format(TIME_FORMAT)
+}
+
+// IsFinished is true once the job is done or has failed
+func (j *Job) IsFinished() bool {
+	return j.Status == JOB_DONE || j.Status == JOB_FAILED
+}
+
+// IsExpired is true once the job has finished and its results have been kept for as long as they are
+func (j *Job) IsExpired(now time.Time) bool {
+	if j.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(TIME_FORMAT, j.Expires)
+	return err != nil || !now.Before(expires)
+}
@@ -0,0 +1,58 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJob_Finish(t *testing.T) {
+
+	now := time.Date(2015, 1, 13, 8, 44, 4, 0, time.UTC)
+	job := NewJob("abcd", "12d7bc90fa", "text/csv", now)
+
+	if job.Status != JOB_QUEUED || job.Created != "2015-01-13T08:44:04.000Z" || job.IsFinished() || job.IsExpired(now.AddDate(1, 0, 0)) {
+		t.Fatalf("given %v but expected a queued job that doesn't expire", job)
+	}
+
+	job.Start(now.Add(time.Minute))
+	if job.Status != JOB_RUNNING || job.Started != "2015-01-13T08:45:04.000Z" || job.IsFinished() {
+		t.Fatalf("given %v but expected a running job", job)
+	}
+
+	job.Finish(now.Add(2*time.Minute), 24*time.Hour, nil)
+	if job.Status != JOB_DONE || job.Finished != "2015-01-13T08:46:04.000Z" || job.Expires != "2015-01-14T08:46:04.000Z" || job.Error != "" {
+		t.Fatalf("given %v but expected a done job that expires in a day", job)
+	}
+	if job.IsExpired(now.Add(24*time.Hour)) || !job.IsExpired(now.Add(25*time.Hour)) {
+		t.Fatalf("%v should only be expired after %s", job, job.Expires)
+	}
+}
+
+func TestJob_Failed(t *testing.T) {
+
+	now := time.Date(2015, 1, 13, 8, 44, 4, 0, time.UTC)
+	job := NewJob("abcd", "12d7bc90fa", "application/json", now)
+
+	job.Finish(now, time.Hour, errors.New("the store is down"))
+	if job.Status != JOB_FAILED || job.Error != "the store is down" || !job.IsFinished() {
+		t.Fatalf("given %v but expected a failed job", job)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type (
+	tokenKind int
+
+	// Position is where a token starts in the raw query, Line and Column are 1 based
+	Position struct {
+		Offset int `json:"offset"`
+		Line   int `json:"line"`
+		Column int `json:"column"`
+	}
+
+	token struct {
+		kind tokenKind
+		text string
+		pos  Position
+	}
+
+	lexer struct {
+		input  []rune
+		offset int
+		line   int
+		column int
+	}
+)
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokOperator
+	tokComma
+	tokLParen
+	tokRParen
+	tokRegex
+	tokString
+	tokIllegal
+)
+
+const operator_chars = "<>=!"
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of query"
+	case tokWord:
+		return "word"
+	case tokOperator:
+		return "operator"
+	case tokComma:
+		return ","
+	case tokLParen:
+		return "("
+	case tokRParen:
+		return ")"
+	case tokRegex:
+		return "regex"
+	case tokString:
+		return "string"
+	case tokIllegal:
+		return "illegal"
+	default:
+		return "unknown"
+	}
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return t.kind.String()
+	}
+	return t.text
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d column %d", p.Line, p.Column)
+}
+
+func newLexer(raw string) *lexer {
+	return &lexer{input: []rune(raw), line: 1, column: 1}
+}
+
+func (l *lexer) position() Position {
+	return Position{Offset: l.offset, Line: l.line, Column: l.column}
+}
+
+func (l *lexer) peek() rune {
+	if l.offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.offset]
+}
+
+func (l *lexer) advance() rune {
+	r := l.input[l.offset]
+	l.offset++
+	if r == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return r
+}
+
+func (l *lexer) atEnd() bool {
+	return l.offset >= len(l.input)
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && r != ',' && r != '(' && r != ')' && r != '"' && r != '\'' && !strings.ContainsRune(operator_chars, r)
+}
+
+// next returns the following token, the final token is always tokEOF
+func (l *lexer) next() token {
+	for !l.atEnd() && unicode.IsSpace(l.peek()) {
+		l.advance()
+	}
+
+	start := l.position()
+
+	if l.atEnd() {
+		return token{kind: tokEOF, pos: start}
+	}
+
+	switch r := l.peek(); {
+	case r == ',':
+		l.advance()
+		return token{kind: tokComma, text: ",", pos: start}
+	case r == '(':
+		l.advance()
+		return token{kind: tokLParen, text: "(", pos: start}
+	case r == ')':
+		l.advance()
+		return token{kind: tokRParen, text: ")", pos: start}
+	case r == '/':
+		return l.regex(start)
+	case r == '"' || r == '\'':
+		return l.quoted(start)
+	case strings.ContainsRune(operator_chars, r):
+		for !l.atEnd() && strings.ContainsRune(operator_chars, l.peek()) {
+			l.advance()
+		}
+		return token{kind: tokOperator, text: string(l.input[start.Offset:l.offset]), pos: start}
+	default:
+		for !l.atEnd() && isWordRune(l.peek()) {
+			l.advance()
+		}
+		return token{kind: tokWord, text: string(l.input[start.Offset:l.offset]), pos: start}
+	}
+}
+
+// a /pattern/flags regex literal, a / within the pattern is escaped as \/
+func (l *lexer) regex(start Position) token {
+	l.advance()
+	for !l.atEnd() && l.peek() != '/' && l.peek() != '\n' {
+		if l.advance() == '\\' && !l.atEnd() {
+			l.advance()
+		}
+	}
+	if l.atEnd() || l.peek() != '/' {
+		return token{kind: tokIllegal, text: string(l.input[start.Offset:l.offset]), pos: start}
+	}
+	l.advance()
+	for !l.atEnd() && unicode.IsLetter(l.peek()) {
+		l.advance()
+	}
+	return token{kind: tokRegex, text: string(l.input[start.Offset:l.offset]), pos: start}
+}
+
+// a string in either single or double quotes, the quote or a \ within it is escaped with a \
+func (l *lexer) quoted(start Position) token {
+	quote := l.advance()
+	var text []rune
+	for !l.atEnd() && l.peek() != quote {
+		r := l.advance()
+		if r == '\\' && !l.atEnd() {
+			r = l.advance()
+		}
+		text = append(text, r)
+	}
+	if l.atEnd() {
+		return token{kind: tokIllegal, text: string(l.input[start.Offset:l.offset]), pos: start}
+	}
+	l.advance()
+	return token{kind: tokString, text: string(text), pos: start}
+}
+
+// tokenize the whole of the raw query
+func tokenize(raw string) []token {
+	l := newLexer(raw)
+	var tokens []token
+	for {
+		t := l.next()
+		tokens = append(tokens, t)
+		if t.kind == tokEOF {
+			return tokens
+		}
+	}
+}
@@ -0,0 +1,257 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how `time` is stored e.g. 2015-01-13T08:44:04.000Z
+	TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+	// how `deviceTime` is stored, it has no zone e.g. 2014-10-23T00:00:00
+	DEVICE_TIME_FORMAT = "2006-01-02T15:04:05"
+	// a time in a given zone e.g. 2015-01-13T00:44:04.000-08:00
+	LOCAL_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+	TIME_FIELD        = "time"
+	DEVICE_TIME_FIELD = "deviceTime"
+)
+
+const (
+	// the anchors a relative time is given from
+	ANCHOR_NOW            = "NOW"
+	ANCHOR_TODAY          = "TODAY"
+	ANCHOR_YESTERDAY      = "YESTERDAY"
+	ANCHOR_START_OF_WEEK  = "STARTOFWEEK"
+	ANCHOR_START_OF_MONTH = "STARTOFMONTH"
+)
+
+var (
+	number_literal = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+	// the fields other than the glucose fields that hold numbers, nested fields are dotted
+	numeric_fields = []string{"normal", "extended", "expectedNormal", "expectedExtended", "duration", "expectedDuration",
+		"rate", "percent", "carbInput", "insulinCarbRatio", "insulinOnBoard", "recommended.carb", "recommended.correction",
+		"recommended.net", "timezoneOffset", "conversionOffset", "clockDriftOffset", "_schemaVersion"}
+
+	// the fields that hold times, only values compared with these can be relative times
+	time_fields = []string{TIME_FIELD, DEVICE_TIME_FIELD, "localTime", "computerTime", "createdTime", "modifiedTime"}
+
+	time_anchors = []string{ANCHOR_NOW, ANCHOR_TODAY, ANCHOR_YESTERDAY, ANCHOR_START_OF_WEEK, ANCHOR_START_OF_MONTH}
+	// e.g. -14d or +8h
+	time_offset_literal = regexp.MustCompile(`^([-+])(\d+)([smhdw])$`)
+	// the offsets following an anchor e.g. -14d+8h
+	time_offset_split = regexp.MustCompile(`[-+][^-+]*`)
+
+	//zoned timestamps
+	timestamp_layouts = []string{time.RFC3339Nano}
+	//timestamps with no zone, the same as deviceTime
+	device_timestamp_layouts = []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"}
+)
+
+// Timestamp is an ISO 8601 literal. Stored times are strings so the Timestamp is
+// compared as a string in the same format as the field it's likely to be used with.
+type Timestamp struct {
+	Time time.Time
+	//when true no zone was given, so like deviceTime it isn't UTC
+	NoZone bool
+}
+
+// String gives the timestamp as it would be stored
+func (t Timestamp) String() string {
+	if t.NoZone {
+		return t.Time.Format(DEVICE_TIME_FORMAT)
+	}
+	return t.Time.UTC().Format(TIME_FORMAT)
+}
+
+func parseTimestamp(text string) (Timestamp, bool) {
+	for i := range timestamp_layouts {
+		if parsed, err := time.Parse(timestamp_layouts[i], text); err == nil {
+			return Timestamp{Time: parsed}, true
+		}
+	}
+	for i := range device_timestamp_layouts {
+		if parsed, err := time.Parse(device_timestamp_layouts[i], text); err == nil {
+			return Timestamp{Time: parsed, NoZone: true}, true
+		}
+	}
+	return Timestamp{}, false
+}
+
+type (
+	// RelativeTime is a time such as NOW - 14d or TODAY that is only known when the query is run
+	RelativeTime struct {
+		Anchor  string
+		Offsets []TimeOffset
+		//where days start, UTC when not given
+		Location *time.Location
+	}
+
+	// TimeOffset is an amount of s(econds), m(inutes), h(ours), d(ays) or w(eeks), negative is earlier
+	TimeOffset struct {
+		Amount int
+		Unit   string
+	}
+)
+
+// String gives the relative time as it would be written e.g. NOW-14d
+func (r RelativeTime) String() string {
+	text := r.Anchor
+	for i := range r.Offsets {
+		text += fmt.Sprintf("%+d%s", r.Offsets[i].Amount, r.Offsets[i].Unit)
+	}
+	return text
+}
+
+// At resolves the relative time against the given time, in the relative time's Location when it has one
+func (r RelativeTime) At(now time.Time) Timestamp {
+	if r.Location != nil {
+		now = now.In(r.Location)
+	}
+	at := now
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	switch r.Anchor {
+	case ANCHOR_TODAY:
+		at = midnight
+	case ANCHOR_YESTERDAY:
+		at = midnight.AddDate(0, 0, -1)
+	case ANCHOR_START_OF_WEEK:
+		//weeks start on a monday
+		at = midnight.AddDate(0, 0, -((int(now.Weekday()) + 6) % 7))
+	case ANCHOR_START_OF_MONTH:
+		at = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	}
+
+	for _, offset := range r.Offsets {
+		switch offset.Unit {
+		case "s":
+			at = at.Add(time.Duration(offset.Amount) * time.Second)
+		case "m":
+			at = at.Add(time.Duration(offset.Amount) * time.Minute)
+		case "h":
+			at = at.Add(time.Duration(offset.Amount) * time.Hour)
+		case "d":
+			at = at.AddDate(0, 0, offset.Amount)
+		case "w":
+			at = at.AddDate(0, 0, 7*offset.Amount)
+		}
+	}
+	return Timestamp{Time: at}
+}
+
+// Resolve the relative time against the clock
+func (r RelativeTime) Resolve() Timestamp {
+	return r.At(Now().UTC())
+}
+
+// IsTimeField when the field holds a time
+func IsTimeField(field string) bool {
+	for i := range time_fields {
+		if field == time_fields[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func isTimeAnchor(text string) bool {
+	for i := range time_anchors {
+		if strings.EqualFold(text, time_anchors[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse the offset e.g. -14d
+func parseTimeOffset(text string) (TimeOffset, bool) {
+	parts := time_offset_literal.FindStringSubmatch(strings.ToLower(text))
+	if parts == nil {
+		return TimeOffset{}, false
+	}
+	amount, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return TimeOffset{}, false
+	}
+	if parts[1] == "-" {
+		amount = -amount
+	}
+	return TimeOffset{Amount: amount, Unit: parts[3]}, true
+}
+
+// the typed value of a literal, a string unless it is a number, true, false or a timestamp.
+// Quoted literals are always strings.
+func literalValue(t token) interface{} {
+	if t.kind == tokString {
+		return t.text
+	}
+	if strings.EqualFold(t.text, "true") {
+		return true
+	}
+	if strings.EqualFold(t.text, "false") {
+		return false
+	}
+	if number_literal.MatchString(t.text) {
+		if number, err := strconv.ParseFloat(t.text, 64); err == nil {
+			return number
+		}
+	}
+	if ts, ok := parseTimestamp(t.text); ok {
+		return ts
+	}
+	return t.text
+}
+
+// IsNumericField when the field is known to hold a number
+func IsNumericField(field string) bool {
+	if IsGlucoseField(field) {
+		return true
+	}
+	for i := range numeric_fields {
+		if strings.EqualFold(field, numeric_fields[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// the typed value of a literal compared with the field. Ids such as 0123 or 12e4 look like numbers,
+// so the value is only a number when the field is known to hold them.
+func fieldValue(field string, t token) interface{} {
+	value := literalValue(t)
+	if _, isNumber := value.(float64); isNumber && !IsNumericField(field) {
+		return t.text
+	}
+	return value
+}
+
+// the typed values of an IN list for the field
+func literalValues(field string, tokens []token) []interface{} {
+	values := make([]interface{}, 0, len(tokens))
+	for i := range tokens {
+		values = append(values, fieldValue(field, tokens[i]))
+	}
+	return values
+}
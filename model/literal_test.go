@@ -0,0 +1,125 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLiteralValue(t *testing.T) {
+
+	literals := []struct {
+		given    token
+		expected interface{}
+	}{
+		{token{kind: tokWord, text: "180"}, float64(180)},
+		{token{kind: tokWord, text: "-2.5"}, float64(-2.5)},
+		{token{kind: tokWord, text: "1e3"}, float64(1000)},
+		{token{kind: tokWord, text: "TRUE"}, true},
+		{token{kind: tokWord, text: "false"}, false},
+		{token{kind: tokWord, text: "12d7bc90fa"}, "12d7bc90fa"},
+		{token{kind: tokWord, text: "inf"}, "inf"},
+		{token{kind: tokWord, text: "mg/dL"}, "mg/dL"},
+		{token{kind: tokString, text: "180"}, "180"},
+		{token{kind: tokString, text: "true"}, "true"},
+	}
+
+	for i := range literals {
+		if given := literalValue(literals[i].given); !reflect.DeepEqual(given, literals[i].expected) {
+			t.Fatalf("[%s] given %#v but expected %#v", literals[i].given.text, given, literals[i].expected)
+		}
+	}
+}
+
+func TestLiteralValue_Timestamps(t *testing.T) {
+
+	timestamps := map[string]string{
+		"2015-01-01T00:00:00.000Z":  "2015-01-01T00:00:00.000Z",
+		"2015-01-01T00:00:00Z":      "2015-01-01T00:00:00.000Z",
+		"2015-01-01T00:00:00.5Z":    "2015-01-01T00:00:00.500Z",
+		"2014-11-23T10:25:16":       "2014-11-23T10:25:16",
+		"2014-11-23":                "2014-11-23T00:00:00",
+		"2014-12-11T04:44:16+00:00": "2014-12-11T04:44:16.000Z",
+		"2014-12-11T04:44:16-08:00": "2014-12-11T12:44:16.000Z",
+		"2014-12-11T04:44:16+05:30": "2014-12-10T23:14:16.000Z",
+	}
+
+	for given, expected := range timestamps {
+		ts, ok := literalValue(token{kind: tokWord, text: given}).(Timestamp)
+		if !ok {
+			t.Fatalf("[%s] should be a Timestamp", given)
+		}
+		if ts.String() != expected {
+			t.Fatalf("[%s] given [%s] but expected [%s]", given, ts.String(), expected)
+		}
+	}
+}
+
+func TestTokenize_Quoted(t *testing.T) {
+
+	tokens := tokenize(`deviceId = "Paradigm Revel - 723-=-53571999" AND notes = 'it\'s'`)
+
+	if tokens[2].kind != tokString || tokens[2].text != "Paradigm Revel - 723-=-53571999" {
+		t.Fatalf("expected the quoted device id but got %v", tokens[2])
+	}
+
+	if tokens[6].kind != tokString || tokens[6].text != "it's" {
+		t.Fatalf("expected the escaped quote but got %v", tokens[6])
+	}
+
+	if unterminated := tokenize(`deviceId = "Paradigm`); unterminated[2].kind != tokIllegal {
+		t.Fatalf("expected an illegal token but got %v", unterminated[2])
+	}
+}
+
+func TestRelativeTime_At(t *testing.T) {
+
+	//a wednesday
+	now, _ := time.Parse(time.RFC3339, "2015-03-11T15:30:00Z")
+
+	relative := map[string]RelativeTime{
+		"2015-03-11T15:30:00.000Z": RelativeTime{Anchor: ANCHOR_NOW},
+		"2015-02-25T15:30:00.000Z": RelativeTime{Anchor: ANCHOR_NOW, Offsets: []TimeOffset{{Amount: -14, Unit: "d"}}},
+		"2015-03-11T00:00:00.000Z": RelativeTime{Anchor: ANCHOR_TODAY},
+		"2015-03-10T08:00:00.000Z": RelativeTime{Anchor: ANCHOR_YESTERDAY, Offsets: []TimeOffset{{Amount: 8, Unit: "h"}}},
+		"2015-03-09T00:00:00.000Z": RelativeTime{Anchor: ANCHOR_START_OF_WEEK},
+		"2015-02-23T00:00:00.000Z": RelativeTime{Anchor: ANCHOR_START_OF_WEEK, Offsets: []TimeOffset{{Amount: -2, Unit: "w"}}},
+		"2015-03-01T00:30:00.000Z": RelativeTime{Anchor: ANCHOR_START_OF_MONTH, Offsets: []TimeOffset{{Amount: 30, Unit: "m"}}},
+	}
+
+	for expected, rel := range relative {
+		if at := rel.At(now).String(); at != expected {
+			t.Fatalf("[%s] given [%s] but expected [%s]", rel, at, expected)
+		}
+	}
+}
+
+func TestRelativeTime_ResolvesWithClock(t *testing.T) {
+
+	now, _ := time.Parse(time.RFC3339, "2015-03-11T15:30:00Z")
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	rel := RelativeTime{Anchor: ANCHOR_NOW, Offsets: []TimeOffset{{Amount: -1, Unit: "h"}}}
+
+	if resolved := rel.Resolve().String(); resolved != "2015-03-11T14:30:00.000Z" {
+		t.Fatalf("given [%s] but expected the clock time less an hour", resolved)
+	}
+}
@@ -0,0 +1,998 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kw_metaquery = "METAQUERY"
+	kw_query     = "QUERY"
+	kw_where     = "WHERE"
+	kw_type      = "TYPE"
+	kw_in        = "IN"
+	kw_not       = "NOT"
+	kw_and       = "AND"
+	kw_or        = "OR"
+	kw_is        = "IS"
+	kw_contains  = "CONTAINS"
+	kw_between   = "BETWEEN"
+	kw_exists    = "EXISTS"
+	kw_matches   = "MATCHES"
+	kw_timezone  = "TIMEZONE"
+	kw_select    = "SELECT"
+	kw_order     = "ORDER"
+	kw_by        = "BY"
+	kw_asc       = "ASC"
+	kw_desc      = "DESC"
+	kw_limit     = "LIMIT"
+	kw_offset    = "OFFSET"
+	kw_group     = "GROUP"
+	kw_bucket    = "BUCKET"
+	kw_units     = "UNITS"
+
+	//placeholders for what we expected when it isn't a keyword
+	expect_field      = "<field>"
+	expect_value      = "<value>"
+	expect_type       = "<type>"
+	expect_regex      = "/<regex>/"
+	expect_offset     = "<offset e.g. 14d>"
+	expect_zone       = "<zone e.g. America/Los_Angeles>"
+	expect_number     = "<number>"
+	expect_aggregate  = "<aggregate e.g. COUNT(*)>"
+	expect_percentile = "<percentile from 0 to 100>"
+	expect_duration   = "<duration e.g. 15m, 1h or 1d>"
+	expect_bucket     = "<minutes that divide an hour, hours that divide a day or whole days e.g. 15m, 4h or 7d>"
+
+	//the flags allowed after a regex
+	regex_flags = "ims"
+)
+
+var (
+	//words that can't be used as a value in a list
+	reserved_words = []string{kw_metaquery, kw_query, kw_where, kw_type, kw_in, kw_not, kw_and, kw_or, kw_is, kw_contains, kw_between, kw_exists, kw_matches, kw_timezone, kw_select, kw_order, kw_limit, kw_offset, kw_group, kw_bucket}
+	//the words that start each clause following QUERY
+	clause_words = []string{kw_select, kw_type, kw_where, kw_in + " " + kw_timezone, kw_group + " " + kw_by, kw_bucket + " " + kw_by, kw_order + " " + kw_by, kw_limit, kw_offset, kw_units}
+
+	aggregate_functions = []string{AGGREGATE_COUNT, AGGREGATE_AVG, AGGREGATE_MIN, AGGREGATE_MAX, AGGREGATE_SUM, AGGREGATE_STDDEV, AGGREGATE_PERCENTILE}
+	truncate_functions  = []string{TRUNCATE_DAY, TRUNCATE_HOUR, TRUNCATE_MONTH}
+	// e.g. 15m
+	bucket_duration = regexp.MustCompile(`^(\d+)([mhd])$`)
+	bucket_units    = map[string]time.Duration{"m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+
+	comparison_operators = []string{"=", "!=", "<", "<=", ">", ">="}
+
+	//the fields a METAQUERY can look users up by
+	meta_fields = []string{META_USERID, META_EMAILS, META_USERNAME, META_FULL_NAME, META_MRN}
+)
+
+type (
+	parser struct {
+		tokens  []token
+		current int
+		errs    []error
+		//what we report when the clause being parsed is invalid
+		message string
+		//kept so we can say where the aggregates don't fit together
+		selected []token
+		group    token
+		bucket   token
+		order    token
+	}
+
+	// ParseError says where in the query we failed, the token we found there and what we expected instead
+	ParseError struct {
+		Message string `json:"message"`
+		Position
+		Token    string   `json:"token"`
+		Expected []string `json:"expected,omitempty"`
+	}
+)
+
+func (e *ParseError) Error() string {
+	found := e.Token
+	if found == "" {
+		found = tokEOF.String()
+	}
+	if len(e.Expected) > 0 {
+		return fmt.Sprintf("%s: expected %s but found [%s] at %s", e.Message, strings.Join(e.Expected, " or "), found, e.Position)
+	}
+	return fmt.Sprintf("%s: found [%s] at %s", e.Message, found, e.Position)
+}
+
+// Parse the raw query text into a Query, all errors found are returned
+func Parse(raw string) (*Query, []error) {
+	p := &parser{tokens: tokenize(raw)}
+	q := &Query{}
+
+	p.parseMetaQuery(q)
+	p.parseQuery(q)
+
+	return q, p.errs
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.current]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.current]
+	if t.kind != tokEOF {
+		p.current++
+	}
+	return t
+}
+
+func isKeyword(t token, words ...string) bool {
+	if t.kind != tokWord {
+		return false
+	}
+	for i := range words {
+		if strings.EqualFold(t.text, words[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func isReserved(t token) bool {
+	return isKeyword(t, reserved_words...)
+}
+
+func (p *parser) fail(t token, expected ...string) {
+	p.errs = append(p.errs, &ParseError{Message: p.message, Position: t.pos, Token: t.text, Expected: expected})
+}
+
+// skip forward to the next token that is one of the given keywords
+func (p *parser) skipTo(words ...string) {
+	for p.peek().kind != tokEOF && !isKeyword(p.peek(), words...) {
+		p.next()
+	}
+}
+
+// the QUERY clause that starts at the current token and how it's parsed, nil if there isn't one
+func (p *parser) clause() (string, func(*Query) bool) {
+	t := p.peek()
+	switch {
+	case isKeyword(t, kw_select):
+		return kw_select, p.parseSelect
+	case isKeyword(t, kw_type):
+		return kw_type, p.parseTypes
+	case isKeyword(t, kw_where):
+		return kw_where, p.parseWhere
+	case isKeyword(t, kw_in) && isKeyword(p.tokens[p.current+1], kw_timezone):
+		return kw_timezone, p.parseTimezone
+	case isKeyword(t, kw_order):
+		return kw_order, p.parseOrderBy
+	case isKeyword(t, kw_limit):
+		return kw_limit, p.parseLimit
+	case isKeyword(t, kw_offset):
+		return kw_offset, p.parseOffset
+	case isKeyword(t, kw_group):
+		return kw_group, p.parseGroupBy
+	case isKeyword(t, kw_bucket):
+		return kw_bucket, p.parseBucket
+	case isKeyword(t, kw_units):
+		return kw_units, p.parseUnits
+	}
+	return "", nil
+}
+
+// at the start of one of the QUERY clauses
+func (p *parser) atClause() bool {
+	_, parse := p.clause()
+	return parse != nil
+}
+
+// skip forward to the start of the next QUERY clause
+func (p *parser) skipToClause() {
+	for p.peek().kind != tokEOF && !p.atClause() {
+		p.next()
+	}
+}
+
+func (p *parser) expectKeyword(word string) (token, bool) {
+	if t := p.peek(); isKeyword(t, word) {
+		return p.next(), true
+	}
+	p.fail(p.peek(), word)
+	return p.peek(), false
+}
+
+// a literal value is either a word or a quoted string
+func isValue(t token) bool {
+	return t.kind == tokString || (t.kind == tokWord && !isReserved(t))
+}
+
+func (p *parser) expectValue() (token, bool) {
+	if t := p.peek(); isValue(t) {
+		return p.next(), true
+	}
+	p.fail(p.peek(), expect_value)
+	return p.peek(), false
+}
+
+// a literal value or, when compared with a time field, a relative time such as NOW - 14d.
+// The offsets can be written with or without spaces.
+func (p *parser) parseValue(field string) (interface{}, token, bool) {
+	t, ok := p.expectValue()
+	if !ok {
+		return nil, t, false
+	}
+	if t.kind != tokWord || !IsTimeField(field) {
+		return fieldValue(field, t), t, true
+	}
+
+	//the anchor can be followed by offsets with no spaces e.g. NOW-14d
+	anchor, offsets := t.text, ""
+	if i := strings.IndexAny(t.text, "+-"); i > 0 {
+		anchor, offsets = t.text[:i], t.text[i:]
+	}
+	if !isTimeAnchor(anchor) {
+		return fieldValue(field, t), t, true
+	}
+
+	rel := RelativeTime{Anchor: strings.ToUpper(anchor)}
+	for _, text := range time_offset_split.FindAllString(offsets, -1) {
+		offset, ok := parseTimeOffset(text)
+		if !ok {
+			p.fail(t, expect_offset)
+			return nil, t, false
+		}
+		rel.Offsets = append(rel.Offsets, offset)
+	}
+
+	for {
+		next := p.peek()
+		if next.kind != tokWord {
+			break
+		}
+		if offset, ok := parseTimeOffset(next.text); ok {
+			// e.g. NOW -14d
+			p.next()
+			rel.Offsets = append(rel.Offsets, offset)
+			continue
+		}
+		if next.text != "+" && next.text != "-" {
+			break
+		}
+		// e.g. NOW - 14d
+		p.next()
+		amount := p.peek()
+		offset, ok := parseTimeOffset(next.text + amount.text)
+		if amount.kind != tokWord || !ok {
+			p.fail(amount, expect_offset)
+			return nil, t, false
+		}
+		p.next()
+		rel.Offsets = append(rel.Offsets, offset)
+	}
+	return rel, t, true
+}
+
+func (p *parser) expectWord(what string) (token, bool) {
+	if t := p.peek(); t.kind == tokWord {
+		return p.next(), true
+	}
+	p.fail(p.peek(), what)
+	return p.peek(), false
+}
+
+// METAQUERY WHERE userid IS <id> | METAQUERY WHERE userid IN <id>, <id> | METAQUERY WHERE emails CONTAINS <email>
+// | METAQUERY WHERE username|fullName|mrn IS <value>
+func (p *parser) parseMetaQuery(q *Query) {
+
+	p.message = ERROR_METAQUERY_REQUIRED
+
+	failed := func(expected ...string) {
+		p.fail(p.peek(), expected...)
+		p.skipTo(kw_query)
+	}
+
+	start := p.peek()
+	if !isKeyword(start, kw_metaquery) {
+		failed(kw_metaquery)
+		return
+	}
+	p.next()
+	if !isKeyword(p.peek(), kw_where) {
+		failed(kw_where)
+		return
+	}
+	p.next()
+
+	field := metaField(p.peek())
+	if field == "" {
+		failed(meta_fields...)
+		return
+	}
+	p.next()
+
+	op := p.peek()
+	if field == META_USERID && !isKeyword(op, kw_is, kw_in) {
+		failed(kw_is, kw_in)
+		return
+	} else if field == META_EMAILS && !isKeyword(op, kw_contains) {
+		failed(kw_contains)
+		return
+	} else if field != META_USERID && field != META_EMAILS && !isKeyword(op, kw_is) {
+		failed(kw_is)
+		return
+	}
+	p.next()
+
+	if isKeyword(op, kw_in) {
+		p.parseCohort(q, start)
+		return
+	}
+
+	value := p.peek()
+	if !isValue(value) {
+		failed(expect_value)
+		return
+	}
+	p.next()
+
+	q.Meta = &MetaQuery{
+		Field:    field,
+		Operator: strings.ToUpper(op.text),
+		Value:    value.text,
+		Pos:      start.pos,
+	}
+}
+
+// the field a METAQUERY looks users up by as we name it, whatever case it was written in
+func metaField(t token) string {
+	for i := range meta_fields {
+		if isKeyword(t, meta_fields[i]) {
+			return meta_fields[i]
+		}
+	}
+	return ""
+}
+
+// the <id>, <id> of each user in the cohort following METAQUERY WHERE userid IN
+func (p *parser) parseCohort(q *Query, start token) {
+	first := p.peek()
+	ids, ok := p.parseList(expect_value, false)
+	if !ok {
+		p.skipTo(kw_query)
+		return
+	}
+
+	values := []string{}
+	seen := map[string]bool{}
+	for i := range ids {
+		if !seen[ids[i].text] {
+			seen[ids[i].text] = true
+			values = append(values, ids[i].text)
+		}
+	}
+	if len(values) > MAX_COHORT_SIZE {
+		p.message = ERROR_INVALID_COHORT
+		p.fail(first)
+		p.skipTo(kw_query)
+		return
+	}
+
+	q.Meta = &MetaQuery{
+		Field:    META_USERID,
+		Operator: kw_in,
+		Values:   values,
+		Pos:      start.pos,
+	}
+}
+
+// QUERY followed by each of its clauses in any order
+func (p *parser) parseQuery(q *Query) {
+
+	if !isKeyword(p.peek(), kw_query) {
+		p.message = ERROR_QUERY_REQUIRED
+		if p.peek().kind == tokEOF {
+			p.message = ERROR_TYPES_REQUIRED
+		}
+		p.fail(p.peek(), kw_query)
+		return
+	}
+	p.next()
+
+	seen := map[string]bool{}
+
+	for p.peek().kind != tokEOF {
+		t := p.peek()
+		clause, parse := p.clause()
+		if parse == nil {
+			p.message = ERROR_UNKNOWN_CLAUSE
+			p.fail(t, clause_words...)
+			p.next()
+			p.skipToClause()
+			continue
+		}
+		if seen[clause] {
+			p.message = ERROR_DUPLICATE_CLAUSE
+			p.fail(t)
+		}
+		seen[clause] = true
+		if !parse(q) {
+			p.skipToClause()
+		}
+	}
+
+	if q.Types == nil {
+		p.message = ERROR_TYPES_REQUIRED
+		p.fail(p.peek(), kw_type)
+	}
+
+	p.checkAggregates(q)
+	p.checkBucket(q)
+}
+
+// buckets are always the count, min, mean and max of each type so can't be combined with anything else that shapes the results
+func (p *parser) checkBucket(q *Query) {
+	if q.Bucket != 0 && (q.Select != nil || q.Aggregates != nil || q.GroupBy != nil || q.OrderBy != nil) {
+		p.message = ERROR_INVALID_BUCKET
+		p.fail(p.bucket)
+	}
+}
+
+// a GROUP BY needs an aggregate, and only the fields grouped on can be SELECTed or used to ORDER BY along with them
+func (p *parser) checkAggregates(q *Query) {
+	if q.GroupBy != nil && q.Aggregates == nil {
+		p.message = ERROR_INVALID_GROUP_BY
+		p.fail(p.group, expect_aggregate)
+		return
+	}
+	if q.Aggregates == nil {
+		return
+	}
+
+	grouped := map[string]bool{}
+	for i := range q.GroupBy {
+		grouped[q.GroupBy[i].Field] = true
+	}
+	p.message = ERROR_NOT_GROUPED
+	for i := range p.selected {
+		if !grouped[p.selected[i].text] {
+			p.fail(p.selected[i], expect_aggregate)
+		}
+	}
+	for i := range q.OrderBy {
+		if !grouped[q.OrderBy[i].Field] {
+			p.fail(p.order)
+			return
+		}
+	}
+}
+
+// IN TIMEZONE <zone> e.g. IN TIMEZONE America/Los_Angeles
+func (p *parser) parseTimezone(q *Query) bool {
+	p.message = ERROR_INVALID_TIMEZONE
+	p.next()
+	p.next()
+	zone, ok := p.expectValue()
+	if !ok {
+		return false
+	}
+	loc, err := time.LoadLocation(zone.text)
+	//Local would be wherever the server happens to be
+	if err != nil || zone.text == "" || zone.text == "Local" {
+		p.fail(zone, expect_zone)
+		return false
+	}
+	q.Timezone = loc
+	return true
+}
+
+// SELECT <field> [, <field> ...]
+func (p *parser) parseSelect(q *Query) bool {
+	p.message = ERROR_INVALID_SELECT
+	p.next()
+	for {
+		t := p.peek()
+		if !p.atField() {
+			p.fail(t, expect_field, expect_aggregate)
+			return false
+		}
+		p.next()
+		if p.peek().kind == tokLParen {
+			aggregate, ok := p.parseAggregate(t)
+			if !ok {
+				return false
+			}
+			q.Aggregates = append(q.Aggregates, aggregate)
+		} else {
+			q.Select = append(q.Select, t.text)
+			p.selected = append(p.selected, t)
+		}
+
+		if p.peek().kind != tokComma {
+			return true
+		}
+		p.next()
+	}
+}
+
+// a field that can be grouped on or aggregated, COUNT can also be of *
+func (p *parser) expectField(allowAll bool) (token, bool) {
+	t := p.peek()
+	if !p.atField() || (t.text == "*" && !allowAll) {
+		p.fail(t, expect_field)
+		return t, false
+	}
+	return p.next(), true
+}
+
+// the next token names a field, type is a field too unless it starts a TYPE IN
+func (p *parser) atField() bool {
+	t := p.peek()
+	if isKeyword(t, kw_type) {
+		return !isKeyword(p.tokens[p.current+1], kw_in)
+	}
+	return t.kind == tokWord && !isReserved(t) && isFieldName(t.text)
+}
+
+// a name that can't be taken as an operator by the store, no part of it starts with $ or holds a NUL
+func isFieldName(name string) bool {
+	if strings.ContainsRune(name, 0) {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if strings.HasPrefix(part, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) expectToken(kind tokenKind) bool {
+	if p.peek().kind != kind {
+		p.fail(p.peek(), kind.String())
+		return false
+	}
+	p.next()
+	return true
+}
+
+// <function>(<field>) or PERCENTILE(<field>, <percentile>)
+func (p *parser) parseAggregate(function token) (Aggregate, bool) {
+	if !isKeyword(function, aggregate_functions...) {
+		p.fail(function, aggregate_functions...)
+		return Aggregate{}, false
+	}
+	aggregate := Aggregate{Function: strings.ToUpper(function.text)}
+	p.next()
+
+	field, ok := p.expectField(aggregate.Function == AGGREGATE_COUNT)
+	if !ok {
+		return Aggregate{}, false
+	}
+	aggregate.Field = field.text
+
+	if aggregate.Function == AGGREGATE_PERCENTILE {
+		if !p.expectToken(tokComma) {
+			return Aggregate{}, false
+		}
+		t := p.peek()
+		percentile, err := strconv.ParseFloat(t.text, 64)
+		if t.kind != tokWord || err != nil || percentile < 0 || percentile > 100 {
+			p.fail(t, expect_percentile)
+			return Aggregate{}, false
+		}
+		p.next()
+		aggregate.Percentile = percentile
+	}
+
+	if !p.expectToken(tokRParen) {
+		return Aggregate{}, false
+	}
+	return aggregate, true
+}
+
+// GROUP BY <key> [, <key> ...] where a key is a field or the day(<field>), hour(<field>) or month(<field>) of a time
+func (p *parser) parseGroupBy(q *Query) bool {
+	p.message = ERROR_INVALID_GROUP_BY
+	p.group = p.next()
+	if _, ok := p.expectKeyword(kw_by); !ok {
+		return false
+	}
+	for {
+		t, ok := p.expectField(false)
+		if !ok {
+			return false
+		}
+		key := GroupKey{Field: t.text}
+
+		if p.peek().kind == tokLParen {
+			if !isKeyword(t, truncate_functions...) {
+				p.fail(t, truncate_functions...)
+				return false
+			}
+			p.next()
+			field, ok := p.expectField(false)
+			if !ok || !p.expectToken(tokRParen) {
+				return false
+			}
+			key = GroupKey{Field: field.text, Truncate: strings.ToUpper(t.text)}
+		}
+		q.GroupBy = append(q.GroupBy, key)
+
+		if p.peek().kind != tokComma {
+			return true
+		}
+		p.next()
+	}
+}
+
+// UNITS <units> e.g. UNITS mg/dL
+func (p *parser) parseUnits(q *Query) bool {
+	p.message = ERROR_INVALID_UNITS
+	p.next()
+	t := p.peek()
+	units, err := ParseUnits(t.text)
+	if !isValue(t) || err != nil {
+		p.fail(t, UNITS_MGDL, UNITS_MMOLL)
+		return false
+	}
+	p.next()
+	q.Units = units
+	return true
+}
+
+// BUCKET BY <duration> e.g. BUCKET BY 15m
+func (p *parser) parseBucket(q *Query) bool {
+	p.message = ERROR_INVALID_BUCKET
+	p.bucket = p.next()
+	if _, ok := p.expectKeyword(kw_by); !ok {
+		return false
+	}
+	t := p.peek()
+	parts := bucket_duration.FindStringSubmatch(strings.ToLower(t.text))
+	if t.kind != tokWord || parts == nil {
+		p.fail(t, expect_duration)
+		return false
+	}
+	amount, err := strconv.Atoi(parts[1])
+	if err != nil || amount < 1 {
+		p.fail(t, expect_duration)
+		return false
+	}
+	bucket := time.Duration(amount) * bucket_units[parts[2]]
+	if !isBucketSize(bucket) {
+		p.fail(t, expect_bucket)
+		return false
+	}
+	p.next()
+	q.Bucket = bucket
+	return true
+}
+
+// the buckets the store can group records into, those of more than a day are grouped a day at a time
+func isBucketSize(bucket time.Duration) bool {
+	day := 24 * time.Hour
+	return bucket%day == 0 || (day%bucket == 0 && bucket%time.Hour == 0) || time.Hour%bucket == 0
+}
+
+// ORDER BY <field> [ASC|DESC] [, <field> [ASC|DESC] ...]
+func (p *parser) parseOrderBy(q *Query) bool {
+	p.message = ERROR_INVALID_ORDER_BY
+	p.order = p.next()
+	if _, ok := p.expectKeyword(kw_by); !ok {
+		return false
+	}
+	for {
+		field := p.peek()
+		if !p.atField() {
+			p.fail(field, expect_field)
+			return false
+		}
+		p.next()
+		order := OrderBy{Field: field.text}
+		if t := p.peek(); isKeyword(t, kw_asc, kw_desc) {
+			p.next()
+			order.Descending = isKeyword(t, kw_desc)
+		}
+		q.OrderBy = append(q.OrderBy, order)
+
+		if p.peek().kind != tokComma {
+			return true
+		}
+		p.next()
+	}
+}
+
+// a whole number that is at least the given minimum
+func (p *parser) expectCount(minimum int) (int, bool) {
+	t := p.peek()
+	count, err := strconv.Atoi(t.text)
+	if t.kind != tokWord || err != nil || count < minimum {
+		p.fail(t, expect_number)
+		return 0, false
+	}
+	p.next()
+	return count, true
+}
+
+// LIMIT <number>
+func (p *parser) parseLimit(q *Query) bool {
+	p.message = ERROR_INVALID_LIMIT
+	p.next()
+	limit, ok := p.expectCount(1)
+	q.Limit = limit
+	return ok
+}
+
+// OFFSET <number>
+func (p *parser) parseOffset(q *Query) bool {
+	p.message = ERROR_INVALID_OFFSET
+	p.next()
+	offset, ok := p.expectCount(0)
+	q.Offset = offset
+	return ok
+}
+
+// TYPE IN <type> [, <type> ...]
+func (p *parser) parseTypes(q *Query) bool {
+	p.message = ERROR_INVALID_TYPES
+	p.next()
+	if _, ok := p.expectKeyword(kw_in); !ok {
+		return false
+	}
+	types, ok := p.parseList(expect_type, false)
+	if ok {
+		for i := range types {
+			q.Types = append(q.Types, types[i].text)
+		}
+	}
+	return ok
+}
+
+// a comma separated list of one or more values, optionally also space separated
+func (p *parser) parseList(what string, spaceSeparated bool) ([]token, bool) {
+	var values []token
+
+	first := p.peek()
+	if !isValue(first) {
+		p.fail(first, what)
+		return nil, false
+	}
+	values = append(values, p.next())
+
+	for {
+		t := p.peek()
+		if t.kind == tokComma {
+			p.next()
+			item := p.peek()
+			if !isValue(item) {
+				p.fail(item, what)
+				return nil, false
+			}
+			values = append(values, p.next())
+		} else if spaceSeparated && isValue(t) && !p.atClause() {
+			values = append(values, p.next())
+		} else {
+			return values, true
+		}
+	}
+}
+
+// WHERE <expression>
+func (p *parser) parseWhere(q *Query) bool {
+	p.message = ERROR_INVALID_WHERE
+	p.next()
+
+	where, ok := p.parseOr()
+	if ok {
+		q.Where = where
+	}
+	return ok
+}
+
+// <expression> [OR <expression> ...]
+func (p *parser) parseOr() (Expr, bool) {
+	first, ok := p.parseAnd()
+	if !ok {
+		return nil, false
+	}
+
+	terms := []Expr{first}
+	for isKeyword(p.peek(), kw_or) {
+		p.next()
+		term, ok := p.parseAnd()
+		if !ok {
+			return nil, false
+		}
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 1 {
+		return first, true
+	}
+	return &OrExpr{Terms: terms, Pos: first.Position()}, true
+}
+
+// <expression> [AND <expression> ...]
+func (p *parser) parseAnd() (Expr, bool) {
+	first, ok := p.parseUnary()
+	if !ok {
+		return nil, false
+	}
+
+	terms := []Expr{first}
+	for isKeyword(p.peek(), kw_and) {
+		p.next()
+		term, ok := p.parseUnary()
+		if !ok {
+			return nil, false
+		}
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 1 {
+		return first, true
+	}
+	return &AndExpr{Terms: terms, Pos: first.Position()}, true
+}
+
+// NOT <expression> | ( <expression> ) | <condition>
+func (p *parser) parseUnary() (Expr, bool) {
+	t := p.peek()
+	switch {
+	case isKeyword(t, kw_not):
+		p.next()
+		term, ok := p.parseUnary()
+		if !ok {
+			return nil, false
+		}
+		return &NotExpr{Term: term, Pos: t.pos}, true
+	case t.kind == tokLParen:
+		p.next()
+		inner, ok := p.parseOr()
+		if !ok {
+			return nil, false
+		}
+		if p.peek().kind != tokRParen {
+			p.fail(p.peek(), tokRParen.String(), kw_and, kw_or)
+			return nil, false
+		}
+		p.next()
+		return inner, true
+	}
+	return p.parseCondition()
+}
+
+// <field> <op> <value> | <field> [NOT] IN <values> | <field> BETWEEN <value> AND <value>
+// | <field> [NOT] EXISTS | <field> MATCHES /<regex>/
+func (p *parser) parseCondition() (Expr, bool) {
+	field, ok := p.expectWord(expect_field)
+	if !ok {
+		return nil, false
+	}
+	if !isFieldName(field.text) {
+		p.fail(field, expect_field)
+		return nil, false
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokOperator:
+		if !isComparisonOperator(t.text) {
+			p.fail(t, comparison_operators...)
+			return nil, false
+		}
+		p.next()
+		value, _, ok := p.parseValue(field.text)
+		if !ok {
+			return nil, false
+		}
+		return &Comparison{Field: field.text, Operator: t.text, Value: value, Pos: field.pos}, true
+
+	case isKeyword(t, kw_between):
+		p.next()
+		low, _, ok := p.parseValue(field.text)
+		if !ok {
+			return nil, false
+		}
+		if _, ok := p.expectKeyword(kw_and); !ok {
+			return nil, false
+		}
+		high, highToken, ok := p.parseValue(field.text)
+		if !ok {
+			return nil, false
+		}
+		//BETWEEN is inclusive of both the values
+		return &AndExpr{Terms: []Expr{
+			&Comparison{Field: field.text, Operator: ">=", Value: low, Pos: field.pos},
+			&Comparison{Field: field.text, Operator: "<=", Value: high, Pos: highToken.pos},
+		}, Pos: field.pos}, true
+
+	case isKeyword(t, kw_exists):
+		p.next()
+		return &Existence{Field: field.text, Pos: field.pos}, true
+
+	case isKeyword(t, kw_matches):
+		p.next()
+		r := p.peek()
+		if r.kind != tokRegex {
+			p.fail(r, expect_regex)
+			return nil, false
+		}
+		pattern, ok := regexPattern(r.text)
+		if !ok {
+			p.fail(r, expect_regex)
+			return nil, false
+		}
+		p.next()
+		return &Match{Field: field.text, Pattern: pattern, Pos: field.pos}, true
+
+	case isKeyword(t, kw_in, kw_not):
+		negated := isKeyword(t, kw_not)
+		p.next()
+		if negated && isKeyword(p.peek(), kw_exists) {
+			p.next()
+			return &Existence{Field: field.text, Negated: true, Pos: field.pos}, true
+		}
+		if negated {
+			if _, ok := p.expectKeyword(kw_in); !ok {
+				return nil, false
+			}
+		}
+		values, ok := p.parseList(expect_value, true)
+		if !ok {
+			return nil, false
+		}
+		return &Membership{Field: field.text, Negated: negated, Values: literalValues(field.text, values), Pos: field.pos}, true
+	}
+
+	expected := append([]string{}, comparison_operators...)
+	p.fail(t, append(expected, kw_in, kw_not+" "+kw_in, kw_between, kw_exists, kw_not+" "+kw_exists, kw_matches)...)
+	return nil, false
+}
+
+func isComparisonOperator(op string) bool {
+	for i := range comparison_operators {
+		if comparison_operators[i] == op {
+			return true
+		}
+	}
+	return false
+}
+
+// the pattern from a /pattern/flags literal with any flags given inline e.g. /abc/i is (?i)abc
+func regexPattern(literal string) (string, bool) {
+	end := strings.LastIndex(literal, "/")
+	pattern := strings.Replace(literal[1:end], `\/`, "/", -1)
+	flags := literal[end+1:]
+
+	for _, f := range flags {
+		if !strings.ContainsRune(regex_flags, f) {
+			return "", false
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", false
+	}
+	return pattern, true
+}
@@ -0,0 +1,236 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+
+	tokens := tokenize("WHERE time>=2015-01-01T00:00:00.000Z\n AND uploadId IN (a,b)")
+
+	expected := []struct {
+		kind tokenKind
+		text string
+		line int
+		col  int
+	}{
+		{tokWord, "WHERE", 1, 1},
+		{tokWord, "time", 1, 7},
+		{tokOperator, ">=", 1, 11},
+		{tokWord, "2015-01-01T00:00:00.000Z", 1, 13},
+		{tokWord, "AND", 2, 2},
+		{tokWord, "uploadId", 2, 6},
+		{tokWord, "IN", 2, 15},
+		{tokLParen, "(", 2, 18},
+		{tokWord, "a", 2, 19},
+		{tokComma, ",", 2, 20},
+		{tokWord, "b", 2, 21},
+		{tokRParen, ")", 2, 22},
+		{tokEOF, "", 2, 23},
+	}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected [%d] tokens but got [%d] %v", len(expected), len(tokens), tokens)
+	}
+
+	for i := range expected {
+		got := tokens[i]
+		if got.kind != expected[i].kind || got.text != expected[i].text || got.pos.Line != expected[i].line || got.pos.Column != expected[i].col {
+			t.Fatalf("token [%d] expected %v but got %v", i, expected[i], got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	q, errs := Parse(QUERY_WHERE_AND)
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if q.Meta == nil || q.Meta.Field != "userid" || q.Meta.Operator != "IS" || q.Meta.Value != "12d7bc90fa" {
+		t.Fatalf("metaquery doesn't match %v", q.Meta)
+	}
+
+	and, ok := q.Where.(*AndExpr)
+	if !ok || len(and.Terms) != 2 {
+		t.Fatalf("where should be two AND'ed terms but got %#v", q.Where)
+	}
+
+	first, ok := and.Terms[0].(*Comparison)
+	if !ok || first.Field != "time" || first.Operator != ">" || !isTimestamp(first.Value, "2015-01-01T00:00:00.000Z") {
+		t.Fatalf("first term doesn't match %#v", and.Terms[0])
+	}
+
+	if first.Pos.Line != 1 || first.Pos.Column != 76 {
+		t.Fatalf("first term position should be line 1 column 76 but got %v", first.Pos)
+	}
+}
+
+func TestParse_Membership(t *testing.T) {
+
+	q, errs := Parse(QUERY_WHERE_IN)
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	in, ok := q.Where.(*Membership)
+	if !ok || in.Field != "updateId" || !in.Negated || len(in.Values) != 3 {
+		t.Fatalf("where doesn't match %#v", q.Where)
+	}
+}
+
+func TestParse_ContinuesAfterError(t *testing.T) {
+
+	q, errs := Parse("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time ! 2015-01-01 TYPE IN smbg")
+
+	if len(errs) != 2 {
+		t.Fatalf("expected an error for the WHERE and another for the second TYPE IN but got %v", errs)
+	}
+
+	if q.Where != nil {
+		t.Fatalf("the bad WHERE should not have been set but got %#v", q.Where)
+	}
+}
+
+func TestParse_ErrorPosition(t *testing.T) {
+
+	_, errs := Parse("METAQUERY WHERE userid IS 12d7bc90fa\nQUERY TYPE IN cbg\nWHERE time => 2015-01-01T00:00:00.000Z")
+
+	if len(errs) != 1 {
+		t.Fatalf("there should be one error but got %v", errs)
+	}
+
+	pe, ok := errs[0].(*ParseError)
+	if !ok {
+		t.Fatalf("expected a *ParseError but got %#v", errs[0])
+	}
+
+	if pe.Message != ERROR_INVALID_WHERE {
+		t.Fatalf("message [%s] should be [%s]", pe.Message, ERROR_INVALID_WHERE)
+	}
+
+	if pe.Line != 3 || pe.Column != 12 || pe.Token != "=>" {
+		t.Fatalf("expected [=>] at line 3 column 12 but got [%s] at %v", pe.Token, pe.Position)
+	}
+
+	if len(pe.Expected) != len(comparison_operators) || pe.Expected[0] != "=" {
+		t.Fatalf("expected should list the comparison operators but got %v", pe.Expected)
+	}
+}
+
+func TestParse_ErrorAtEnd(t *testing.T) {
+
+	_, errs := Parse("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN")
+
+	if len(errs) != 2 {
+		t.Fatalf("expected a bad TYPE IN and then a missing TYPE IN but got %v", errs)
+	}
+
+	pe := errs[0].(*ParseError)
+
+	if pe.Token != "" || pe.Column != 51 || len(pe.Expected) != 1 || pe.Expected[0] != expect_type {
+		t.Fatalf("expected %s at the end of the query but got %#v", expect_type, pe)
+	}
+}
+
+func TestParse_Precedence(t *testing.T) {
+
+	q, errs := Parse("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE a > 1 OR b > 2 AND NOT c > 3")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	or, ok := q.Where.(*OrExpr)
+	if !ok || len(or.Terms) != 2 {
+		t.Fatalf("AND should bind tighter than OR but got %#v", q.Where)
+	}
+
+	and, ok := or.Terms[1].(*AndExpr)
+	if !ok || len(and.Terms) != 2 {
+		t.Fatalf("second OR term should be an AND but got %#v", or.Terms[1])
+	}
+
+	if _, ok := and.Terms[1].(*NotExpr); !ok {
+		t.Fatalf("NOT should bind tightest but got %#v", and.Terms[1])
+	}
+}
+
+func TestParse_ComparisonValuesTypedByField(t *testing.T) {
+
+	expected := map[string]interface{}{
+		"deviceId = 0123":   "0123",
+		"deviceId = 12e4":   "12e4",
+		"uploadId != 12e4":  "12e4",
+		"value = 0123":      float64(123),
+		"normal < 2.5":      float64(2.5),
+		"deviceId = true":   true,
+		"deviceId = abc123": "abc123",
+	}
+
+	for where, value := range expected {
+		q, errs := Parse("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE " + where)
+
+		if len(errs) != 0 {
+			t.Fatalf("[%s] should have no errors but got %v", where, errs)
+		}
+
+		cmp, ok := q.Where.(*Comparison)
+		if !ok || cmp.Value != value {
+			t.Fatalf("[%s] given %#v but expected the value %#v", where, q.Where, value)
+		}
+	}
+
+	//the same as when the field is compared with a list
+	q, _ := Parse("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId BETWEEN 0100 AND 0200")
+	and, ok := q.Where.(*AndExpr)
+	if !ok || and.Terms[0].(*Comparison).Value != "0100" || and.Terms[1].(*Comparison).Value != "0200" {
+		t.Fatalf("the deviceIds should be kept as they were written but got %#v", q.Where)
+	}
+}
+
+func TestParse_OperatorFieldNames(t *testing.T) {
+
+	invalid := map[string]string{
+		"QUERY TYPE IN cbg WHERE $where = x":                    "$where",
+		"QUERY TYPE IN cbg WHERE payload.$gt EXISTS":            "payload.$gt",
+		"QUERY TYPE IN cbg WHERE dev\x00iceId = x":              "dev\x00iceId",
+		"QUERY TYPE IN cbg SELECT time, $value":                 "$value",
+		"QUERY TYPE IN cbg SELECT COUNT(*) GROUP BY $foo":       "$foo",
+		"QUERY TYPE IN cbg SELECT AVG($value) GROUP BY type":    "$value",
+		"QUERY TYPE IN cbg ORDER BY $natural DESC":              "$natural",
+		"QUERY TYPE IN cbg SELECT COUNT(*) GROUP BY day($time)": "$time",
+	}
+
+	for query, field := range invalid {
+		_, errs := Parse("METAQUERY WHERE userid IS 12d7bc90fa " + query)
+
+		//the first error is for the field, it can leave the rest of the query invalid too
+		if len(errs) == 0 {
+			t.Fatalf("[%s] should have an error", query)
+		}
+		if pe, ok := errs[0].(*ParseError); !ok || pe.Token != field || len(pe.Expected) == 0 || pe.Expected[0] != expect_field {
+			t.Fatalf("[%s] expected a field in place of [%s] but got %v", query, field, errs[0])
+		}
+	}
+}
@@ -18,30 +18,96 @@ not, you can obtain one from Tidepool Project at tidepool.org.
 package model
 
 import (
-	"errors"
 	"log"
-	"regexp"
-	"strings"
+	"sort"
+	"time"
 )
 
 const (
-	ERROR_METAQUERY_REQUIRED = "Missing required METAQUERY e.g. METAQUERY WHERE userid IS 12d7bc90 or  METAQUERY WHERE emails CONTAINS foo@bar.org"
+	ERROR_METAQUERY_REQUIRED = "Missing required METAQUERY e.g. METAQUERY WHERE userid IS 12d7bc90, METAQUERY WHERE emails CONTAINS foo@bar.org or METAQUERY WHERE mrn IS 0012345"
 	ERROR_TYPES_REQUIRED     = "Missing required TYPE IN e.g. TYPE IN cbg, smbg"
-	INWHERE_PAT              = `(?i)\bQUERY.+\bWHERE +([^ ]*) +(?:(NOT IN|IN) +)(.*)`
+	ERROR_QUERY_REQUIRED     = "Missing required QUERY following the METAQUERY"
+	ERROR_INVALID_TYPES      = "Invalid TYPE IN e.g. TYPE IN cbg, smbg"
+	ERROR_INVALID_WHERE      = "Invalid WHERE e.g. WHERE time > 2015-01-01T00:00:00.000Z or WHERE uploadId IN abcd, efgh"
+	ERROR_UNKNOWN_CLAUSE     = "Unknown QUERY clause"
+	ERROR_DUPLICATE_CLAUSE   = "Each QUERY clause can only be given once"
+	ERROR_INVALID_TIMEZONE   = "Invalid IN TIMEZONE e.g. IN TIMEZONE America/Los_Angeles"
+	ERROR_INVALID_SELECT     = "Invalid SELECT e.g. SELECT time, value, units or SELECT type, COUNT(*), AVG(value), PERCENTILE(value, 90)"
+	ERROR_INVALID_GROUP_BY   = "Invalid GROUP BY e.g. GROUP BY type, day(time) along with an aggregate such as SELECT COUNT(*)"
+	ERROR_NOT_GROUPED        = "Only the fields in the GROUP BY can be SELECTed or used to ORDER BY along with aggregates"
+	ERROR_INVALID_BUCKET     = "Invalid BUCKET BY e.g. BUCKET BY 1h, it can't be used with SELECT, GROUP BY or ORDER BY"
+	ERROR_INVALID_UNITS      = "Invalid UNITS e.g. UNITS mg/dL or UNITS mmol/L"
+	ERROR_INVALID_ORDER_BY   = "Invalid ORDER BY e.g. ORDER BY time DESC"
+	ERROR_INVALID_LIMIT      = "Invalid LIMIT, it must be a whole number greater than 0 e.g. LIMIT 100"
+	ERROR_INVALID_OFFSET     = "Invalid OFFSET, it must be a whole number e.g. OFFSET 100"
+	ERROR_INVALID_COHORT     = "Invalid METAQUERY WHERE userid IN, it can be at most 100 users e.g. METAQUERY WHERE userid IN 12d7bc90, 5a8c1e2f"
 	ANYID                    = "anyid" // as an we can use either the userid or an email as an 'id' here
+
+	//the fields a METAQUERY can look the user up by
+	META_USERID    = "userid"
+	META_EMAILS    = "emails"
+	META_USERNAME  = "username"
+	META_FULL_NAME = "fullName"
+	META_MRN       = "mrn"
+
+	CONDITION_AND = "AND"
+	CONDITION_OR  = "OR"
+	CONDITION_NOT = "NOT"
+
+	AGGREGATE_COUNT      = "COUNT"
+	AGGREGATE_AVG        = "AVG"
+	AGGREGATE_MIN        = "MIN"
+	AGGREGATE_MAX        = "MAX"
+	AGGREGATE_SUM        = "SUM"
+	AGGREGATE_STDDEV     = "STDDEV"
+	AGGREGATE_PERCENTILE = "PERCENTILE"
+
+	TRUNCATE_DAY   = "DAY"
+	TRUNCATE_HOUR  = "HOUR"
+	TRUNCATE_MONTH = "MONTH"
+
+	//the fields of each bucket
+	BUCKET_TYPE  = "type"
+	BUCKET_TIME  = "time"
+	BUCKET_COUNT = "count"
+	BUCKET_MIN   = "min"
+	BUCKET_MEAN  = "mean"
+	BUCKET_MAX   = "max"
+	//the field that is summarised in each bucket
+	BUCKET_VALUE_FIELD = "value"
+
+	//the most users a METAQUERY WHERE userid IN can be for
+	MAX_COHORT_SIZE = 100
+	//each record of a cohort is given the pseudonymous id of its user in place of their _groupId
+	SUBJECT_ID_FIELD = "subjectId"
 )
 
 type (
 	QueryData struct {
 		MetaQuery       map[string]string
-		WhereConditions []WhereCondition
+		MetaQueryField  string            //what the user in the MetaQuery is looked up by, one of the META_ fields
+		Cohort          []string          //the userids when the METAQUERY is for a cohort of users rather than one
+		Subjects        map[string]string //for a cohort, the subjectId given to the records of each groupId
+		WhereConditions []WhereCondition  //all of these must be met
 		Types           []string
-		InList          []string
+		Fields          []string       //when given only these fields are returned
+		Aggregates      []Aggregate    //when given these are returned for each group rather than the records
+		GroupBy         []GroupKey     //the groups the Aggregates are for, all the records are one group when there are none
+		Bucket          time.Duration  //when given the count, min, mean and max of each type for each bucket of this long are returned
+		OrderBy         []OrderBy      //when given the results are sorted on these rather than by the index
+		Limit           int            //the most records to return, 0 for no limit
+		Offset          int            //the number of records to skip
+		Timezone        *time.Location //when given times without a zone are in this zone
+		Units           string         //when given glucose values are in these units rather than the mmol/L they are stored in
 	}
+	// WhereCondition is either a test on the named field or, when the Condition is
+	// one of AND, OR or NOT, a group that combines its Terms
 	WhereCondition struct {
 		Name      string
-		Value     string
+		Value     interface{} //a string, float64, bool or Timestamp
 		Condition string
+		Values    []interface{} //the list for IN or NOT IN
+		Terms     []WhereCondition
 	}
 )
 
@@ -53,135 +119,201 @@ func (qd *QueryData) SetMetaQueryId(anyid string) {
 	qd.MetaQuery[ANYID] = anyid
 }
 
-func (qd *QueryData) buildMetaQuery(raw string) error {
-
-	const USERID, EMAILS = "userid", "emails"
+// IsCohort is true when the query is for the data of a cohort of users rather than one
+func (qd *QueryData) IsCohort() bool {
+	return len(qd.Cohort) != 0
+}
 
-	useridMeta := regexp.MustCompile(`(?i)\bMETAQUERY WHERE (.*) IS (.*) \bQUERY`)
-	useridData := useridMeta.FindStringSubmatch(raw)
+// AddSubject adds the user with the groupId to those whose data the cohort query is for. The subjectId is the
+// pseudonym their records are given, a keyed hash of the groupId so it can't be worked out from it.
+func (qd *QueryData) AddSubject(groupId, subjectId string) {
+	if qd.Subjects == nil {
+		qd.Subjects = map[string]string{}
+	}
+	qd.Subjects[groupId] = subjectId
+}
 
-	if len(useridData) == 3 && useridData[1] == USERID {
-		qd.MetaQuery = map[string]string{ANYID: useridData[2]}
-		return nil
-	} else {
-		//if it is not a userid see if its an email
-		emailsMeta := regexp.MustCompile(`(?i)\bMETAQUERY WHERE (.*) CONTAINS (.*) \bQUERY`)
-		emailsData := emailsMeta.FindStringSubmatch(raw)
+// GroupIds gives the groupId of each of the cohort's users that have been added
+func (qd *QueryData) GroupIds() []string {
+	groupIds := make([]string, 0, len(qd.Subjects))
+	for groupId := range qd.Subjects {
+		groupIds = append(groupIds, groupId)
+	}
+	sort.Strings(groupIds)
+	return groupIds
+}
 
-		if len(emailsData) == 3 && emailsData[1] == EMAILS {
-			qd.MetaQuery = map[string]string{ANYID: emailsData[2]}
-			return nil
+// Selects is true when the field is one of those SELECTed
+func (qd *QueryData) Selects(field string) bool {
+	for i := range qd.Fields {
+		if qd.Fields[i] == field {
+			return true
 		}
-		log.Printf("buildMetaQuery from %v gives error [%s]", emailsData, ERROR_METAQUERY_REQUIRED)
-		return errors.New(ERROR_METAQUERY_REQUIRED)
 	}
+	return false
 }
 
-func (qd *QueryData) buildTypes(raw string) error {
-	typesMatch := regexp.MustCompile(`(?i)\bQUERY TYPE IN (.*) \bWHERE`)
-	typesData := typesMatch.FindStringSubmatch(raw)
+// IsAggregate is true when the results are the aggregates for each group rather than the records
+func (qd *QueryData) IsAggregate() bool {
+	return len(qd.Aggregates) != 0 || qd.Bucket != 0
+}
 
-	if len(typesData) != 2 {
-		typesMatch = regexp.MustCompile(`(?i)\bQUERY TYPE IN (.*)`)
-		typesData = typesMatch.FindStringSubmatch(raw)
+// Columns are the fields of each result, nil when they are whatever each record has
+func (qd *QueryData) Columns() []string {
+	if !qd.IsAggregate() {
+		if qd.IsCohort() && len(qd.Fields) > 0 && !qd.Selects(SUBJECT_ID_FIELD) {
+			return append([]string{SUBJECT_ID_FIELD}, qd.Fields...)
+		}
+		return qd.Fields
 	}
-
-	if len(typesData) == 2 {
-		types := strings.Split(typesData[1], ",")
-
-		for i := range types {
-			qd.Types = append(qd.Types, strings.TrimSpace(types[i]))
+	if qd.Bucket != 0 {
+		columns := []string{BUCKET_TYPE, BUCKET_TIME, BUCKET_COUNT, BUCKET_MIN, BUCKET_MEAN, BUCKET_MAX}
+		if qd.Timezone != nil {
+			columns = append(columns, "localTime")
 		}
-		return nil
+		return columns
 	}
-
-	log.Printf("buildTypes from %v gives error [%s]", raw, ERROR_TYPES_REQUIRED)
-	return errors.New(ERROR_TYPES_REQUIRED)
+	columns := make([]string, 0, len(qd.GroupBy)+len(qd.Aggregates))
+	for i := range qd.GroupBy {
+		columns = append(columns, qd.GroupBy[i].Name())
+	}
+	for i := range qd.Aggregates {
+		columns = append(columns, qd.Aggregates[i].Name())
+	}
+	return columns
 }
 
-func (qd *QueryData) isTimeWhere(raw string) bool {
-	where := regexp.MustCompile(`(?i)(?:^METAQUERY.+)?QUERY.+\bWHERE (.*) (.*) (.*) (AND (.*) (.*) (.*) )?`)
-	indices := where.FindStringIndex(raw)
-	return indices != nil
+// IsGroup is true when the condition combines its Terms rather than testing a field
+func (wc WhereCondition) IsGroup() bool {
+	switch wc.Condition {
+	case CONDITION_AND, CONDITION_OR, CONDITION_NOT:
+		return true
+	}
+	return false
 }
 
-func (qd *QueryData) isInWhere(raw string) bool {
-	where := regexp.MustCompile(INWHERE_PAT)
-	indices := where.FindStringIndex(raw)
-	return indices != nil
+// the WHERE as a flat list of AND'ed expressions
+func whereTerms(where Expr) []Expr {
+	if and, ok := where.(*AndExpr); ok {
+		var terms []Expr
+		for i := range and.Terms {
+			terms = append(terms, whereTerms(and.Terms[i])...)
+		}
+		return terms
+	}
+	return []Expr{where}
 }
 
-func (qd *QueryData) buildTimeWhere(raw string) {
-	where := regexp.MustCompile(`(?i)[^METAQUERY] \bWHERE (.*) (.*) (.*) AND (.*) (.*) (.*)`)
-	whereData := where.FindStringSubmatch(raw)
-
-	if len(whereData) == 7 {
-
-		qd.WhereConditions = append(qd.WhereConditions,
-			WhereCondition{
-				Name:      whereData[1],
-				Condition: whereData[2],
-				Value:     whereData[3],
-			}, WhereCondition{
-				Name:      whereData[4],
-				Condition: whereData[5],
-				Value:     whereData[6],
-			})
-
-		return
-	} else {
-		where = regexp.MustCompile(`(?i)[^METAQUERY] \bWHERE (.*) (.*) (.*)`)
-		whereData = where.FindStringSubmatch(raw)
+func buildConditions(terms []Expr) []WhereCondition {
+	conditions := make([]WhereCondition, 0, len(terms))
+	for i := range terms {
+		conditions = append(conditions, buildCondition(terms[i]))
+	}
+	return conditions
+}
 
-		if len(whereData) == 4 {
-			qd.WhereConditions = append(qd.WhereConditions,
-				WhereCondition{
-					Name:      whereData[1],
-					Condition: whereData[2],
-					Value:     whereData[3],
-				})
-			return
+func buildCondition(e Expr) WhereCondition {
+	switch term := e.(type) {
+	case *Membership:
+		return WhereCondition{
+			Name:      term.Field,
+			Condition: term.condition(),
+			Value:     "NOT USED",
+			Values:    term.Values,
+		}
+	case *Comparison:
+		return WhereCondition{
+			Name:      term.Field,
+			Condition: term.Operator,
+			Value:     term.Value,
+		}
+	case *Existence:
+		return WhereCondition{
+			Name:      term.Field,
+			Condition: term.condition(),
 		}
+	case *Match:
+		return WhereCondition{
+			Name:      term.Field,
+			Condition: "MATCHES",
+			Value:     term.Pattern,
+		}
+	case *AndExpr:
+		return WhereCondition{Condition: CONDITION_AND, Terms: buildConditions(term.Terms)}
+	case *OrExpr:
+		return WhereCondition{Condition: CONDITION_OR, Terms: buildConditions(term.Terms)}
+	case *NotExpr:
+		return WhereCondition{Condition: CONDITION_NOT, Terms: buildConditions([]Expr{term.Term})}
 	}
-
-	log.Printf("buildTimeWhere from [%s] shows incorrect or no where clause", raw)
+	return WhereCondition{}
 }
 
-func (qd *QueryData) buildInWhere(raw string) {
-	where := regexp.MustCompile(INWHERE_PAT)
-	whereData := where.FindStringSubmatch(raw)
-
-	if len(whereData) == 4 {
-
-		listre := regexp.MustCompile("[ ,]+")
-		qd.InList = listre.Split(whereData[3], -1)
+// set the WHERE conditions, all of them must be met
+func (qd *QueryData) buildWhere(where Expr) {
+	qd.WhereConditions = buildConditions(whereTerms(where))
+}
 
-		qd.WhereConditions = append(qd.WhereConditions,
-			WhereCondition{
-				Name:      whereData[1],
-				Condition: whereData[2],
-				Value:     "NOT USED",
-			})
-		return
+// times without a zone are in the given zone, other than for deviceTime which is always stored without one
+func localiseValue(field string, value interface{}, loc *time.Location) interface{} {
+	switch v := value.(type) {
+	case Timestamp:
+		if v.NoZone && field != DEVICE_TIME_FIELD {
+			t := v.Time
+			return Timestamp{Time: time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)}
+		}
+	case RelativeTime:
+		v.Location = loc
+		return v
 	}
+	return value
+}
 
-	log.Printf("buildInWhere from [%s] shows incorrect or no where clause", raw)
+func localise(conditions []WhereCondition, loc *time.Location) {
+	for i := range conditions {
+		c := &conditions[i]
+		c.Value = localiseValue(c.Name, c.Value, loc)
+		for j := range c.Values {
+			c.Values[j] = localiseValue(c.Name, c.Values[j], loc)
+		}
+		localise(c.Terms, loc)
+	}
 }
 
+// BuildQuery parses the raw query and returns the QueryData the store will run along with any errors found
 func BuildQuery(raw string) (parseErrs []error, qd *QueryData) {
 
 	qd = &QueryData{}
 
-	if metaErr := qd.buildMetaQuery(raw); metaErr != nil {
-		parseErrs = append(parseErrs, metaErr)
+	q, parseErrs := Parse(raw)
+
+	if q.Meta != nil && len(q.Meta.Values) > 0 {
+		qd.Cohort = q.Meta.Values
+	} else if q.Meta != nil {
+		qd.MetaQuery = map[string]string{ANYID: q.Meta.Value}
+		qd.MetaQueryField = q.Meta.Field
+	}
+	qd.Types = q.Types
+	qd.Fields = q.Select
+	qd.Aggregates = q.Aggregates
+	qd.GroupBy = q.GroupBy
+	qd.Bucket = q.Bucket
+	qd.OrderBy = q.OrderBy
+	qd.Limit = q.Limit
+	qd.Offset = q.Offset
+	if q.Where != nil {
+		qd.buildWhere(q.Where)
 	}
-	if typeErr := qd.buildTypes(raw); typeErr != nil {
-		parseErrs = append(parseErrs, typeErr)
+	if q.Timezone != nil {
+		qd.Timezone = q.Timezone
+		localise(qd.WhereConditions, q.Timezone)
 	}
-	if qd.isInWhere(raw) {
-		qd.buildInWhere(raw)
-	} else if qd.isTimeWhere(raw) {
-		qd.buildTimeWhere(raw)
+	if q.Units != "" {
+		qd.Units = q.Units
+		storedUnits(qd.WhereConditions, q.Units)
+	}
+
+	if len(parseErrs) != 0 {
+		log.Printf("BuildQuery from [%s] gives errors %v", raw, parseErrs)
 	}
 
 	return parseErrs, qd
@@ -18,7 +18,11 @@ not, you can obtain one from Tidepool Project at tidepool.org.
 package model
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -28,24 +32,28 @@ const (
 	QUERY_WHERE_IN   = "METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE updateId NOT IN abcd, efgh, ijkl"
 )
 
+// the value should be a Timestamp for the given ISO 8601 time
+func isTimestamp(value interface{}, iso string) bool {
+	ts, ok := value.(Timestamp)
+	return ok && ts.String() == iso
+}
+
 func TestMetaQuery_GivesError_WhenNoWhere(t *testing.T) {
-	qd := &QueryData{}
 
-	noWhereErr := qd.buildMetaQuery("not right")
+	errs, _ := BuildQuery("not right")
 
-	if noWhereErr.Error() != ERROR_METAQUERY_REQUIRED {
-		t.Fatalf("got err [%s] expected err [%s]", noWhereErr.Error(), ERROR_METAQUERY_REQUIRED)
+	if len(errs) == 0 || !strings.HasPrefix(errs[0].Error(), ERROR_METAQUERY_REQUIRED) {
+		t.Fatalf("got errs %v expected err [%s]", errs, ERROR_METAQUERY_REQUIRED)
 	}
 
 }
 
 func TestMetaQuery_GivesError_WhenNoWhereIs(t *testing.T) {
-	qd := &QueryData{}
 
-	noWhereErr := qd.buildMetaQuery("METAQUERY WHERE userid QUERY TYPE IN update")
+	errs, _ := BuildQuery("METAQUERY WHERE userid QUERY TYPE IN update")
 
-	if noWhereErr.Error() != ERROR_METAQUERY_REQUIRED {
-		t.Fatalf("got err [%s] expected err [%s]", noWhereErr.Error(), ERROR_METAQUERY_REQUIRED)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), ERROR_METAQUERY_REQUIRED) {
+		t.Fatalf("got errs %v expected err [%s]", errs, ERROR_METAQUERY_REQUIRED)
 	}
 
 }
@@ -54,9 +62,7 @@ func TestMetaQueryWhere(t *testing.T) {
 
 	const givenId = "12d7bc90fa"
 
-	qd := &QueryData{}
-
-	qd.buildMetaQuery(QUERY_WHERE)
+	_, qd := BuildQuery(QUERY_WHERE)
 
 	if qd.GetMetaQueryId() == "" {
 		t.Fatalf("should be a userid set on [%v]", qd.MetaQuery)
@@ -72,9 +78,7 @@ func TestMetaQueryWhere_Emails(t *testing.T) {
 
 	const givenEmail = "foo@bar.com"
 
-	qd := &QueryData{}
-
-	qd.buildMetaQuery(METAQUERY_EMAILS)
+	_, qd := BuildQuery(METAQUERY_EMAILS)
 
 	if qd.GetMetaQueryId() == "" {
 		t.Fatalf("should be a emails set on [%v]", qd.MetaQuery)
@@ -86,13 +90,102 @@ func TestMetaQueryWhere_Emails(t *testing.T) {
 
 }
 
+func TestMetaQueryWhere_Fields(t *testing.T) {
+
+	metaQueries := map[string][]string{
+		"METAQUERY WHERE UserID IS 12d7bc90fa":           {META_USERID, "12d7bc90fa"},
+		"METAQUERY WHERE EMAILS CONTAINS foo@bar.com":    {META_EMAILS, "foo@bar.com"},
+		"METAQUERY WHERE username IS jamie":              {META_USERNAME, "jamie"},
+		"METAQUERY WHERE FULLNAME IS 'Jamie Smith'":      {META_FULL_NAME, "Jamie Smith"},
+		"METAQUERY WHERE mrn IS 0012345":                 {META_MRN, "0012345"},
+		"METAQUERY WHERE fullName is \"Jamie O'Connor\"": {META_FULL_NAME, "Jamie O'Connor"},
+	}
+
+	for metaQuery, expected := range metaQueries {
+		errs, qd := BuildQuery(metaQuery + " QUERY TYPE IN cbg")
+		if len(errs) != 0 {
+			t.Fatalf("[%s] unexpected errors %v", metaQuery, errs)
+		}
+		if qd.MetaQueryField != expected[0] || qd.GetMetaQueryId() != expected[1] {
+			t.Fatalf("[%s] given %s %s but expected %v", metaQuery, qd.MetaQueryField, qd.GetMetaQueryId(), expected)
+		}
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE username CONTAINS jamie QUERY TYPE IN cbg",
+		"METAQUERY WHERE mrn IN 0012345, 0067890 QUERY TYPE IN cbg",
+		"METAQUERY WHERE birthday IS 2001-01-01 QUERY TYPE IN cbg",
+	}
+	for _, raw := range invalid {
+		if errs, _ := BuildQuery(raw); len(errs) == 0 {
+			t.Fatalf("the meta query [%s] was badly formed and should have given an error", raw)
+		}
+	}
+}
+
+func TestMetaQueryWhere_Cohort(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IN 12d7bc90fa, 5a8c1e2f, 12d7bc90fa QUERY TYPE IN cbg")
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	//each user only once
+	expected := []string{"12d7bc90fa", "5a8c1e2f"}
+	if !qd.IsCohort() || !reflect.DeepEqual(qd.Cohort, expected) {
+		t.Fatalf("given cohort %v but expected %v", qd.Cohort, expected)
+	}
+	if qd.MetaQuery != nil {
+		t.Fatalf("a cohort has no single user but given %v", qd.MetaQuery)
+	}
+}
+
+func TestMetaQueryWhere_CohortBad(t *testing.T) {
+
+	tooMany := make([]string, MAX_COHORT_SIZE+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user%d", i)
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE userid IN QUERY TYPE IN cbg",
+		"METAQUERY WHERE userid IN 12d7bc90fa, QUERY TYPE IN cbg",
+		"METAQUERY WHERE emails IN foo@bar.com, bar@foo.com QUERY TYPE IN cbg",
+		"METAQUERY WHERE userid IN " + strings.Join(tooMany, ", ") + " QUERY TYPE IN cbg",
+	}
+	for _, raw := range invalid {
+		if errs, qd := BuildQuery(raw); len(errs) == 0 {
+			t.Fatalf("the meta query [%s] was badly formed and should have given an error but given %v", raw, qd.Cohort)
+		}
+	}
+}
+
+func TestQueryData_Subjects(t *testing.T) {
+
+	_, qd := BuildQuery("METAQUERY WHERE userid IN 12d7bc90fa, 5a8c1e2f QUERY SELECT time, value TYPE IN cbg")
+
+	qd.AddSubject("group2", "subject2")
+	qd.AddSubject("group1", "subject1")
+
+	if groupIds := qd.GroupIds(); !reflect.DeepEqual(groupIds, []string{"group1", "group2"}) {
+		t.Fatalf("given %v but expected [group1 group2]", groupIds)
+	}
+
+	if !reflect.DeepEqual(qd.Subjects, map[string]string{"group1": "subject1", "group2": "subject2"}) {
+		t.Fatalf("given subjects %v", qd.Subjects)
+	}
+
+	//so the rows can be told apart
+	if columns := qd.Columns(); !reflect.DeepEqual(columns, []string{SUBJECT_ID_FIELD, "time", "value"}) {
+		t.Fatalf("given columns %v", columns)
+	}
+}
+
 func TestMetaQueryWhere_Bad(t *testing.T) {
 
 	const METAQUERY_BAD = "METAQUERY WHERE bad IS wrong QUERY TYPE IN update, cbg, smbg WHERE time >= 2015-01-01T00:00:00.000Z"
 
-	qd := &QueryData{}
-
-	if err := qd.buildMetaQuery(METAQUERY_BAD); err == nil {
+	if errs, qd := BuildQuery(METAQUERY_BAD); len(errs) == 0 {
 		t.Fatalf("the meta query [%s] was badly formed and should have given an error", qd.MetaQuery)
 	}
 
@@ -102,9 +195,7 @@ func TestQueryWhereAnd(t *testing.T) {
 
 	//WHERE time > starttime AND time < endtime
 
-	qd := &QueryData{}
-
-	qd.buildTimeWhere(QUERY_WHERE_AND)
+	_, qd := BuildQuery(QUERY_WHERE_AND)
 
 	if len(qd.WhereConditions) != 2 {
 		t.Fatalf("there should be two where conditions got %v", qd.WhereConditions)
@@ -113,20 +204,18 @@ func TestQueryWhereAnd(t *testing.T) {
 	first := qd.WhereConditions[0]
 	second := qd.WhereConditions[1]
 
-	if first.Name != "time" || first.Condition != ">" || first.Value != "2015-01-01T00:00:00.000Z" {
+	if first.Name != "time" || first.Condition != ">" || !isTimestamp(first.Value, "2015-01-01T00:00:00.000Z") {
 		t.Fatalf("first where  %v doesn't match ", first)
 	}
 
-	if second.Name != "time" || second.Condition != "<" || second.Value != "2015-01-01T01:00:00.000Z" {
+	if second.Name != "time" || second.Condition != "<" || !isTimestamp(second.Value, "2015-01-01T01:00:00.000Z") {
 		t.Fatalf("second where  %v doesn't match ", second)
 	}
 }
 
 func TestQueryWhere_WithGte(t *testing.T) {
 
-	qd := &QueryData{}
-
-	qd.buildTimeWhere(QUERY_WHERE)
+	_, qd := BuildQuery(QUERY_WHERE)
 
 	if len(qd.WhereConditions) != 1 {
 		t.Fatalf("there should be two where conditions got %v", qd.WhereConditions)
@@ -134,7 +223,7 @@ func TestQueryWhere_WithGte(t *testing.T) {
 
 	first := qd.WhereConditions[0]
 
-	if first.Name != "time" || first.Condition != ">=" || first.Value != "2015-01-01T00:00:00.000Z" {
+	if first.Name != "time" || first.Condition != ">=" || !isTimestamp(first.Value, "2015-01-01T00:00:00.000Z") {
 		t.Fatalf("first where  %v doesn't match ", first)
 	}
 
@@ -142,9 +231,7 @@ func TestQueryWhere_WithGte(t *testing.T) {
 
 func TestQueryWhereIn(t *testing.T) {
 
-	qd := &QueryData{}
-
-	qd.buildInWhere(QUERY_WHERE_IN)
+	_, qd := BuildQuery(QUERY_WHERE_IN)
 
 	if len(qd.WhereConditions) != 1 {
 		t.Fatalf("there should be two where conditions got %v", qd.WhereConditions)
@@ -165,20 +252,18 @@ func TestQueryWhereIn(t *testing.T) {
 }
 
 func TestTypes_GivesError_WhenNoTypes(t *testing.T) {
-	qd := &QueryData{}
 
-	noTypesErr := qd.buildTypes("METAQUERY WHERE userid QUERY")
+	errs, _ := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY")
 
-	if noTypesErr.Error() != ERROR_TYPES_REQUIRED {
-		t.Fatalf("got err [%s] expected err [%s]", noTypesErr.Error(), ERROR_TYPES_REQUIRED)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), ERROR_TYPES_REQUIRED) {
+		t.Fatalf("got errs %v expected err [%s]", errs, ERROR_TYPES_REQUIRED)
 	}
 
 }
 
 func TestTypes(t *testing.T) {
-	qd := &QueryData{}
 
-	qd.buildTypes(QUERY_WHERE_AND)
+	_, qd := BuildQuery(QUERY_WHERE_AND)
 
 	if len(qd.Types) != 3 {
 		t.Fatalf("should listed the three types from query got [%v]", qd.Types)
@@ -232,11 +317,11 @@ func TestBuildQuery_WithWhereAnd(t *testing.T) {
 		t.Fatalf("there should be 2 conditions but got [%d]", len(qd.WhereConditions))
 	}
 
-	if qd.WhereConditions[0].Name != "time" || qd.WhereConditions[0].Condition != ">" || qd.WhereConditions[0].Value != "2015-01-01T00:00:00.000Z" {
+	if qd.WhereConditions[0].Name != "time" || qd.WhereConditions[0].Condition != ">" || !isTimestamp(qd.WhereConditions[0].Value, "2015-01-01T00:00:00.000Z") {
 		t.Fatalf("first where  %v doesn't match ", qd.WhereConditions[0])
 	}
 
-	if qd.WhereConditions[1].Name != "time" || qd.WhereConditions[1].Condition != "<" || qd.WhereConditions[1].Value != "2015-01-01T01:00:00.000Z" {
+	if qd.WhereConditions[1].Name != "time" || qd.WhereConditions[1].Condition != "<" || !isTimestamp(qd.WhereConditions[1].Value, "2015-01-01T01:00:00.000Z") {
 		t.Fatalf("second where  %v doesn't match ", qd.WhereConditions[1])
 	}
 
@@ -278,7 +363,7 @@ func TestBuildQuery_WithWhere(t *testing.T) {
 
 	first := qd.WhereConditions[0]
 
-	if first.Name != "time" || first.Condition != ">=" || first.Value != "2015-01-01T00:00:00.000Z" {
+	if first.Name != "time" || first.Condition != ">=" || !isTimestamp(first.Value, "2015-01-01T00:00:00.000Z") {
 		t.Fatalf("first where  %v doesn't match ", first)
 	}
 
@@ -331,3 +416,606 @@ func TestExtractQueryData_AccumulatesErrors(t *testing.T) {
 	}
 
 }
+
+func TestBuildQuery_IgnoresCaseAndWhitespace(t *testing.T) {
+
+	errs, qd := BuildQuery("metaquery\n\twhere USERID is 12d7bc90fa\nquery\n\ttype in cbg,smbg\n\twhere time>2015-01-01T00:00:00.000Z")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if qd.GetMetaQueryId() != "12d7bc90fa" {
+		t.Fatalf("userid should be 12d7bc90fa but %v", qd.MetaQuery)
+	}
+
+	if len(qd.Types) != 2 || qd.Types[0] != "cbg" || qd.Types[1] != "smbg" {
+		t.Fatalf("types should be [cbg smbg] but got %v", qd.Types)
+	}
+
+	if len(qd.WhereConditions) != 1 {
+		t.Fatalf("there should be 1 conditions but got [%d]", len(qd.WhereConditions))
+	}
+}
+
+func TestBuildQuery_WhereBeforeTypes(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY WHERE time >= 2015-01-01T00:00:00.000Z TYPE IN cbg")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if len(qd.Types) != 1 || qd.Types[0] != "cbg" {
+		t.Fatalf("types should be [cbg] but got %v", qd.Types)
+	}
+
+	if len(qd.WhereConditions) != 1 || qd.WhereConditions[0].Condition != ">=" {
+		t.Fatalf("where should be time >= but got %v", qd.WhereConditions)
+	}
+}
+
+func TestBuildQuery_InWhereSpaceSeparated(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE uploadId IN abcd efgh")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if len(qd.WhereConditions[0].Values) != 2 || qd.WhereConditions[0].Values[0] != "abcd" || qd.WhereConditions[0].Values[1] != "efgh" {
+		t.Fatalf("in list should be [abcd efgh] but got %v", qd.WhereConditions[0].Values)
+	}
+
+	if qd.WhereConditions[0].Condition != "IN" {
+		t.Fatalf("condition [%s] doesn't match [IN]", qd.WhereConditions[0].Condition)
+	}
+}
+
+func TestBuildQuery_RejectsMalformedWhere(t *testing.T) {
+
+	malformed := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > ",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time => 2015-01-01T00:00:00.000Z",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > 2015-01-01T00:00:00.000Z time < 2015-01-02T00:00:00.000Z",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > 2015-01-01T00:00:00.000Z AND",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE uploadId NOT abcd",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg SORT BY time",
+	}
+
+	for i := range malformed {
+		if errs, qd := BuildQuery(malformed[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error but gave %v", malformed[i], qd.WhereConditions)
+		}
+	}
+}
+
+func TestBuildQuery_WithWhereInAndTime(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE uploadId IN abcd, efgh AND time > 2015-01-01T00:00:00.000Z AND time < 2015-01-02T00:00:00.000Z AND deviceId NOT IN ijkl")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if len(qd.WhereConditions) != 4 {
+		t.Fatalf("there should be 4 conditions but got [%d]", len(qd.WhereConditions))
+	}
+
+	uploads := qd.WhereConditions[0]
+	if uploads.Name != "uploadId" || uploads.Condition != "IN" || len(uploads.Values) != 2 || uploads.Values[1] != "efgh" {
+		t.Fatalf("first where %v doesn't match", uploads)
+	}
+
+	if qd.WhereConditions[1].Name != "time" || qd.WhereConditions[1].Condition != ">" || !isTimestamp(qd.WhereConditions[1].Value, "2015-01-01T00:00:00.000Z") {
+		t.Fatalf("second where %v doesn't match", qd.WhereConditions[1])
+	}
+
+	if qd.WhereConditions[2].Name != "time" || qd.WhereConditions[2].Condition != "<" || !isTimestamp(qd.WhereConditions[2].Value, "2015-01-02T00:00:00.000Z") {
+		t.Fatalf("third where %v doesn't match", qd.WhereConditions[2])
+	}
+
+	devices := qd.WhereConditions[3]
+	if devices.Name != "deviceId" || devices.Condition != "NOT IN" || len(devices.Values) != 1 || devices.Values[0] != "ijkl" {
+		t.Fatalf("fourth where %v doesn't match", devices)
+	}
+}
+
+func TestBuildQuery_WithWhereIn_NumericLookingIds(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, bolus WHERE deviceId IN 12e4, 0123 AND normal IN 1, 2.5")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	devices := qd.WhereConditions[0]
+	if len(devices.Values) != 2 || devices.Values[0] != "12e4" || devices.Values[1] != "0123" {
+		t.Fatalf("the deviceIds should be kept as they were written but got %#v", devices.Values)
+	}
+
+	normals := qd.WhereConditions[1]
+	if len(normals.Values) != 2 || normals.Values[0] != float64(1) || normals.Values[1] != float64(2.5) {
+		t.Fatalf("the values of a numeric field should be numbers but got %#v", normals.Values)
+	}
+}
+
+func TestBuildQuery_WithBooleanWhere(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN bolus, wizard WHERE time > 2015-01-01T00:00:00.000Z AND ((type IN bolus AND normal > 5) OR NOT type IN bolus)")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if len(qd.WhereConditions) != 2 {
+		t.Fatalf("there should be 2 conditions but got %v", qd.WhereConditions)
+	}
+
+	or := qd.WhereConditions[1]
+	if !or.IsGroup() || or.Condition != CONDITION_OR || len(or.Terms) != 2 {
+		t.Fatalf("second where should be an OR of two terms but got %v", or)
+	}
+
+	and := or.Terms[0]
+	if and.Condition != CONDITION_AND || len(and.Terms) != 2 || and.Terms[1].Name != "normal" || and.Terms[1].Condition != ">" {
+		t.Fatalf("first OR term should be an AND with normal > 5 but got %v", and)
+	}
+
+	not := or.Terms[1]
+	if not.Condition != CONDITION_NOT || len(not.Terms) != 1 || not.Terms[0].Name != "type" || not.Terms[0].Condition != "IN" {
+		t.Fatalf("second OR term should be NOT type IN bolus but got %v", not)
+	}
+}
+
+func TestBuildQuery_WithNotInIsNotANot(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE NOT uploadId NOT IN abcd")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	not := qd.WhereConditions[0]
+	if not.Condition != CONDITION_NOT || not.Terms[0].Condition != "NOT IN" {
+		t.Fatalf("where should be NOT of uploadId NOT IN but got %v", not)
+	}
+}
+
+func TestBuildQuery_UnbalancedParentheses(t *testing.T) {
+
+	unbalanced := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE (time > 2015-01-01T00:00:00.000Z",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > 2015-01-01T00:00:00.000Z)",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE ()",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > 2015-01-01T00:00:00.000Z OR",
+	}
+
+	for i := range unbalanced {
+		if errs, _ := BuildQuery(unbalanced[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", unbalanced[i])
+		}
+	}
+}
+
+func TestBuildQuery_WithOperators(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId = abc AND uploadId != def AND annotations EXISTS AND suppressed NOT EXISTS AND deviceId MATCHES /^paradigm\\/revel/i")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	expected := []WhereCondition{
+		WhereCondition{Name: "deviceId", Condition: "=", Value: "abc"},
+		WhereCondition{Name: "uploadId", Condition: "!=", Value: "def"},
+		WhereCondition{Name: "annotations", Condition: "EXISTS"},
+		WhereCondition{Name: "suppressed", Condition: "NOT EXISTS"},
+		WhereCondition{Name: "deviceId", Condition: "MATCHES", Value: "(?i)^paradigm/revel"},
+	}
+
+	if len(qd.WhereConditions) != len(expected) {
+		t.Fatalf("there should be %d conditions but got %v", len(expected), qd.WhereConditions)
+	}
+
+	for i := range expected {
+		given := qd.WhereConditions[i]
+		if given.Name != expected[i].Name || given.Condition != expected[i].Condition || given.Value != expected[i].Value {
+			t.Fatalf("where [%d] given %v but expected %v", i, given, expected[i])
+		}
+	}
+}
+
+func TestBuildQuery_WithBetween(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time BETWEEN 2015-01-01T00:00:00.000Z AND 2015-01-02T00:00:00.000Z AND uploadId IN abcd")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if len(qd.WhereConditions) != 3 {
+		t.Fatalf("there should be 3 conditions but got %v", qd.WhereConditions)
+	}
+
+	if qd.WhereConditions[0].Condition != ">=" || !isTimestamp(qd.WhereConditions[0].Value, "2015-01-01T00:00:00.000Z") {
+		t.Fatalf("first where should be the inclusive start but got %v", qd.WhereConditions[0])
+	}
+
+	if qd.WhereConditions[1].Condition != "<=" || !isTimestamp(qd.WhereConditions[1].Value, "2015-01-02T00:00:00.000Z") {
+		t.Fatalf("second where should be the inclusive end but got %v", qd.WhereConditions[1])
+	}
+
+	if qd.WhereConditions[2].Name != "uploadId" {
+		t.Fatalf("third where should be the uploadId but got %v", qd.WhereConditions[2])
+	}
+}
+
+func TestBuildQuery_RejectsUnknownOperators(t *testing.T) {
+
+	unknown := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId == abc",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId <> abc",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId LIKE abc",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId MATCHES abc",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId MATCHES /abc",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId MATCHES /(abc/",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE deviceId MATCHES /abc/q",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time BETWEEN 2015-01-01T00:00:00.000Z",
+	}
+
+	for i := range unknown {
+		if errs, qd := BuildQuery(unknown[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error but gave %v", unknown[i], qd.WhereConditions)
+		}
+	}
+}
+
+func TestBuildQuery_WithTypedValues(t *testing.T) {
+
+	errs, qd := BuildQuery(`METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg, bolus WHERE value > 10.5 AND normal <= 5 AND suspended = false AND deviceId = "Paradigm Revel - 723" AND uploadId IN "1234", 5678`)
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	expected := []interface{}{float64(10.5), float64(5), false, "Paradigm Revel - 723"}
+	for i := range expected {
+		if qd.WhereConditions[i].Value != expected[i] {
+			t.Fatalf("where [%d] given %#v but expected %#v", i, qd.WhereConditions[i].Value, expected[i])
+		}
+	}
+
+	uploads := qd.WhereConditions[4].Values
+	if len(uploads) != 2 || uploads[0] != "1234" || uploads[1] != "5678" {
+		t.Fatalf("uploadIds should be the strings 1234 and 5678 but got %#v", uploads)
+	}
+}
+
+func TestBuildQuery_WithRelativeTimes(t *testing.T) {
+
+	relative := map[string]string{
+		"time > NOW - 14d":                 "NOW-14d",
+		"time > now -14d":                  "NOW-14d",
+		"time > NOW-14d+12h":               "NOW-14d+12h",
+		"time >= TODAY":                    "TODAY",
+		"time < startOfMonth + 1w - 2h":    "STARTOFMONTH+1w-2h",
+		"time BETWEEN startOfWeek AND NOW": "STARTOFWEEK",
+	}
+
+	for where, expected := range relative {
+		errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE " + where)
+
+		if len(errs) != 0 {
+			t.Fatalf("[%s] should have no errors but got %v", where, errs)
+		}
+
+		rel, ok := qd.WhereConditions[0].Value.(RelativeTime)
+		if !ok || rel.String() != expected {
+			t.Fatalf("[%s] given %#v but expected %s", where, qd.WhereConditions[0].Value, expected)
+		}
+	}
+
+	invalid := []string{
+		"time > NOW - 14",
+		"time > NOW - 14y",
+		"time > NOW-14x",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE " + invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestBuildQuery_RelativeTimesOnlyForTimeFields(t *testing.T) {
+
+	words := map[string]string{
+		"deviceId = today":           "today",
+		"deviceId = now-123":         "now-123",
+		"uploadId != Yesterday":      "Yesterday",
+		"deviceId BETWEEN a AND now": "a",
+	}
+
+	for where, expected := range words {
+		errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE " + where)
+
+		if len(errs) != 0 {
+			t.Fatalf("[%s] should have no errors but got %v", where, errs)
+		}
+
+		first := qd.WhereConditions[0]
+		if first.IsGroup() {
+			first = first.Terms[0]
+		}
+		if first.Value != expected {
+			t.Fatalf("[%s] given %#v but expected the string %s", where, first.Value, expected)
+		}
+	}
+
+	for _, field := range []string{"deviceTime", "createdTime", "modifiedTime"} {
+		_, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE " + field + " > NOW - 1d")
+		if _, ok := qd.WhereConditions[0].Value.(RelativeTime); !ok {
+			t.Fatalf("[%s] given %#v but expected a relative time", field, qd.WhereConditions[0].Value)
+		}
+	}
+}
+
+func TestBuildQuery_InTimezone(t *testing.T) {
+
+	now, _ := time.Parse(time.RFC3339, "2015-03-11T15:30:00Z")
+	SetClock(func() time.Time { return now })
+	defer SetClock(nil)
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time >= 2015-03-01 AND deviceTime >= 2015-03-01 AND time < TODAY AND time > 2015-03-01T00:00:00Z IN TIMEZONE America/Los_Angeles")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if qd.Timezone == nil || qd.Timezone.String() != "America/Los_Angeles" {
+		t.Fatalf("given timezone %v but expected America/Los_Angeles", qd.Timezone)
+	}
+
+	if !isTimestamp(qd.WhereConditions[0].Value, "2015-03-01T08:00:00.000Z") {
+		t.Fatalf("the start of the local day should be in UTC but got %v", qd.WhereConditions[0].Value)
+	}
+
+	if !isTimestamp(qd.WhereConditions[1].Value, "2015-03-01T00:00:00") {
+		t.Fatalf("deviceTime should be left as given but got %v", qd.WhereConditions[1].Value)
+	}
+
+	today, ok := qd.WhereConditions[2].Value.(RelativeTime)
+	if !ok || today.Resolve().String() != "2015-03-11T07:00:00.000Z" {
+		t.Fatalf("TODAY should start at midnight in Los Angeles but got %v", qd.WhereConditions[2].Value)
+	}
+
+	if !isTimestamp(qd.WhereConditions[3].Value, "2015-03-01T00:00:00.000Z") {
+		t.Fatalf("a time with a zone should be unchanged but got %v", qd.WhereConditions[3].Value)
+	}
+}
+
+func TestBuildQuery_InvalidTimezone(t *testing.T) {
+
+	invalid := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg IN TIMEZONE Mars/Olympus_Mons",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg IN TIMEZONE",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg IN TIMEZONE Local",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg IN TIMEZONE UTC IN TIMEZONE America/New_York",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery(invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+
+	errs, _ := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg IN TIMEZONE Mars/Olympus_Mons WHERE time > TODAY")
+	if len(errs) != 1 || errs[0].(*ParseError).Message != ERROR_INVALID_TIMEZONE {
+		t.Fatalf("should only have the timezone error but got %v", errs)
+	}
+}
+
+func TestBuildQuery_WithSelect(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT time, value, units TYPE IN cbg WHERE time > 2015-01-01T00:00:00.000Z")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	expected := []string{"time", "value", "units"}
+	if strings.Join(qd.Fields, ",") != strings.Join(expected, ",") {
+		t.Fatalf("given fields %v but expected %v", qd.Fields, expected)
+	}
+
+	if _, qd := BuildQuery(QUERY_WHERE); qd.Fields != nil {
+		t.Fatalf("there should be no fields when there is no SELECT but got %v", qd.Fields)
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT TYPE IN cbg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT time, TYPE IN cbg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT time SELECT value TYPE IN cbg",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery(invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestBuildQuery_WithOrderLimitOffset(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > NOW - 1d ORDER BY time ASC, value desc LIMIT 100 OFFSET 200")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	expected := []OrderBy{{Field: "time"}, {Field: "value", Descending: true}}
+	if len(qd.OrderBy) != 2 || qd.OrderBy[0] != expected[0] || qd.OrderBy[1] != expected[1] {
+		t.Fatalf("given order %v but expected %v", qd.OrderBy, expected)
+	}
+
+	if qd.Limit != 100 || qd.Offset != 200 {
+		t.Fatalf("given limit %d offset %d but expected 100 and 200", qd.Limit, qd.Offset)
+	}
+
+	if _, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg ORDER BY time"); qd.OrderBy[0].Descending {
+		t.Fatal("ORDER BY should be ascending when no direction is given")
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg ORDER time",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg ORDER BY LIMIT 5",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 0",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT ten",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 10.5",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg OFFSET -1",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg LIMIT 10 LIMIT 20",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery(invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestBuildQuery_WithAggregates(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT type, COUNT(*), AVG(value), PERCENTILE(value, 90) TYPE IN cbg, smbg GROUP BY type, day(time) ORDER BY type DESC")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if !qd.IsAggregate() {
+		t.Fatal("the query should be an aggregate")
+	}
+
+	expected := []string{"type", "day(time)", "count(*)", "avg(value)", "percentile(value,90)"}
+	if strings.Join(qd.Columns(), ",") != strings.Join(expected, ",") {
+		t.Fatalf("given columns %v but expected %v", qd.Columns(), expected)
+	}
+
+	if qd.GroupBy[1] != (GroupKey{Field: "time", Truncate: TRUNCATE_DAY}) {
+		t.Fatalf("given group key %v but expected day(time)", qd.GroupBy[1])
+	}
+
+	if qd.Aggregates[2].Function != AGGREGATE_PERCENTILE || qd.Aggregates[2].Percentile != 90 {
+		t.Fatalf("given aggregate %v but expected the 90th percentile", qd.Aggregates[2])
+	}
+
+	if _, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT MAX(value) TYPE IN cbg"); len(qd.GroupBy) != 0 || !qd.IsAggregate() {
+		t.Fatalf("an aggregate without a GROUP BY should be over every record but got %v", qd)
+	}
+
+	if _, qd := BuildQuery(QUERY_WHERE); qd.IsAggregate() {
+		t.Fatal("a query without aggregates shouldn't be an aggregate")
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg GROUP BY type",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT value, AVG(value) TYPE IN cbg GROUP BY type",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT AVG(value) TYPE IN cbg GROUP BY type ORDER BY value",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT MEDIAN(value) TYPE IN cbg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT AVG(*) TYPE IN cbg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT PERCENTILE(value, 101) TYPE IN cbg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT PERCENTILE(value) TYPE IN cbg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT COUNT(*) TYPE IN cbg GROUP BY week(time)",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery(invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestBuildQuery_WithBucket(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE time > NOW - 90d BUCKET BY 1h")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if qd.Bucket != time.Hour || !qd.IsAggregate() {
+		t.Fatalf("given bucket %v but expected an hour", qd.Bucket)
+	}
+
+	expected := []string{"type", "time", "count", "min", "mean", "max"}
+	if strings.Join(qd.Columns(), ",") != strings.Join(expected, ",") {
+		t.Fatalf("given columns %v but expected %v", qd.Columns(), expected)
+	}
+
+	buckets := map[string]time.Duration{"15m": 15 * time.Minute, "4H": 4 * time.Hour, "1d": 24 * time.Hour, "60m": time.Hour, "7d": 7 * 24 * time.Hour}
+	for text, expected := range buckets {
+		if _, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY " + text); qd.Bucket != expected {
+			t.Fatalf("[%s] given bucket %v but expected %v", text, qd.Bucket, expected)
+		}
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET 1h",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 0h",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 1y",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY hour",
+		//those the store can't group into
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 7m",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 90m",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 5h",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 36h",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT time TYPE IN cbg BUCKET BY 1h",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT COUNT(*) TYPE IN cbg BUCKET BY 1h",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg BUCKET BY 1h ORDER BY time",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery(invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestBuildQuery_WithUnits(t *testing.T) {
+
+	errs, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY SELECT time, value, units TYPE IN cbg WHERE value > 180 AND (type IN cbg OR bgInput <= 70) UNITS mg/dL")
+
+	if len(errs) != 0 {
+		t.Fatalf("there should be no errors but got %v", errs)
+	}
+
+	if qd.Units != UNITS_MGDL || strings.Join(qd.Fields, ",") != "time,value,units" {
+		t.Fatalf("given units %s and fields %v but expected mg/dL and time, value, units", qd.Units, qd.Fields)
+	}
+
+	//the bounds are compared with what is stored
+	if qd.WhereConditions[0].Condition != ">=" || !near(qd.WhereConditions[0].Value.(float64), 180.5/MGDL_PER_MMOLL) {
+		t.Fatalf("given %v but expected value >= 180.5 mg/dL in mmol/L", qd.WhereConditions[0])
+	}
+	if bgInput := qd.WhereConditions[1].Terms[1]; bgInput.Condition != "<" || !near(bgInput.Value.(float64), 70.5/MGDL_PER_MMOLL) {
+		t.Fatalf("given %v but expected bgInput < 70.5 mg/dL in mmol/L", bgInput)
+	}
+
+	if _, qd := BuildQuery("METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg WHERE uploadId IN abcd efgh UNITS 'MMOL/L'"); qd.Units != UNITS_MMOLL || len(qd.WhereConditions[0].Values) != 2 {
+		t.Fatalf("given units %s and %v but expected mmol/L and a list of two", qd.Units, qd.WhereConditions)
+	}
+
+	invalid := []string{
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg UNITS",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg UNITS mg",
+		"METAQUERY WHERE userid IS 12d7bc90fa QUERY TYPE IN cbg UNITS mg/dL UNITS mmol/L",
+	}
+
+	for i := range invalid {
+		if errs, _ := BuildQuery(invalid[i]); len(errs) == 0 {
+			t.Fatalf("[%s] should have given an error", invalid[i])
+		}
+	}
+}
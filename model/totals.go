@@ -0,0 +1,148 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"time"
+)
+
+type (
+	// TotalsQuery is the period the daily totals are for and the zone the days are in
+	TotalsQuery struct {
+		From     time.Time
+		To       time.Time
+		Location *time.Location
+	}
+
+	// DailyTotal is the insulin, in units, and carbs, in grams, for a day or the whole period
+	DailyTotal struct {
+		Date         string  `json:"date,omitempty"`
+		Bolus        float64 `json:"bolus"`
+		Basal        float64 `json:"basal"`
+		TotalInsulin float64 `json:"totalInsulin"`
+		Carbs        float64 `json:"carbs"`
+		// the percentage of the insulin that was basal or bolus, left out when there was none
+		BasalPercentage *float64 `json:"basalPercentage,omitempty"`
+		BolusPercentage *float64 `json:"bolusPercentage,omitempty"`
+	}
+
+	// TotalsReport has every day in the period in order, and the totals for the whole period
+	TotalsReport struct {
+		From     string       `json:"from"`
+		To       string       `json:"to"`
+		Timezone string       `json:"timezone"`
+		Days     []DailyTotal `json:"days"`
+		Total    DailyTotal   `json:"total"`
+	}
+
+	// DailyTotals adds up the boluses, basals and carbs for each local day
+	DailyTotals struct {
+		query *TotalsQuery
+		days  map[string]*DailyTotal
+	}
+)
+
+// Validate the query before it is run
+func (q *TotalsQuery) Validate() error {
+	if q.Location == nil {
+		return error_invalid_location
+	}
+	if !q.From.Before(q.To) {
+		return error_invalid_period
+	}
+	return nil
+}
+
+// NewDailyTotals for the query
+func NewDailyTotals(query *TotalsQuery) *DailyTotals {
+	return &DailyTotals{query: query, days: map[string]*DailyTotal{}}
+}
+
+// the total for the local day the time is in
+func (d *DailyTotals) day(at time.Time) *DailyTotal {
+	date := at.In(d.query.Location).Format("2006-01-02")
+	if d.days[date] == nil {
+		d.days[date] = &DailyTotal{Date: date}
+	}
+	return d.days[date]
+}
+
+// AddBolus of the given units, the normal and extended parts together
+func (d *DailyTotals) AddBolus(at time.Time, units float64) {
+	d.day(at).Bolus += units
+}
+
+// AddBasal at the given rate in units an hour, split between the days it was delivered on and clipped to the period
+func (d *DailyTotals) AddBasal(at time.Time, duration time.Duration, rate float64) {
+	end := at.Add(duration)
+	if end.After(d.query.To) {
+		end = d.query.To
+	}
+	start := at
+	if start.Before(d.query.From) {
+		start = d.query.From
+	}
+	for start.Before(end) {
+		local := start.In(d.query.Location)
+		nextMidnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, d.query.Location)
+		until := end
+		if nextMidnight.Before(end) {
+			until = nextMidnight
+		}
+		d.day(start).Basal += rate * until.Sub(start).Hours()
+		start = until
+	}
+}
+
+// AddCarbs of the given grams
+func (d *DailyTotals) AddCarbs(at time.Time, grams float64) {
+	d.day(at).Carbs += grams
+}
+
+// the total insulin and how it is split between basal and bolus
+func (t *DailyTotal) finish() {
+	t.TotalInsulin = t.Basal + t.Bolus
+	if t.TotalInsulin > 0 {
+		basal := 100 * t.Basal / t.TotalInsulin
+		bolus := 100 - basal
+		t.BasalPercentage, t.BolusPercentage = &basal, &bolus
+	}
+}
+
+// Report the totals for each day of the period, days without any records have totals of 0
+func (d *DailyTotals) Report() *TotalsReport {
+	report := &TotalsReport{
+		From:     d.query.From.UTC().Format(TIME_FORMAT),
+		To:       d.query.To.UTC().Format(TIME_FORMAT),
+		Timezone: d.query.Location.String(),
+		Days:     []DailyTotal{},
+	}
+
+	first := d.query.From.In(d.query.Location)
+	for date := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, d.query.Location); date.Before(d.query.To); date = date.AddDate(0, 0, 1) {
+		total := d.day(date)
+		total.finish()
+		report.Days = append(report.Days, *total)
+
+		report.Total.Bolus += total.Bolus
+		report.Total.Basal += total.Basal
+		report.Total.Carbs += total.Carbs
+	}
+	report.Total.finish()
+	return report
+}
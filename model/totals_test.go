@@ -0,0 +1,94 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTotalsQuery_Validate(t *testing.T) {
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := (&TotalsQuery{From: from, To: from.AddDate(0, 0, 1), Location: time.UTC}).Validate(); err != nil {
+		t.Fatalf("the query should be valid but got %v", err)
+	}
+
+	invalid := []*TotalsQuery{
+		{From: from, To: from, Location: time.UTC},
+		{From: from, To: from.AddDate(0, 0, 1)},
+	}
+	for i := range invalid {
+		if err := invalid[i].Validate(); err == nil {
+			t.Fatalf("%v should have given an error", invalid[i])
+		}
+	}
+}
+
+func TestDailyTotals_Report(t *testing.T) {
+
+	la, _ := time.LoadLocation("America/Los_Angeles")
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, la)
+	totals := NewDailyTotals(&TotalsQuery{From: from, To: from.AddDate(0, 0, 3), Location: la})
+
+	//a basal of 1u/hr from 22:00 on the 1st to 02:00 on the 2nd
+	totals.AddBasal(from.Add(22*time.Hour), 4*time.Hour, 1)
+	//10:00 on the 2nd in LA is still the 2nd in UTC but 20:00 is the 3rd in UTC
+	totals.AddBolus(from.Add(34*time.Hour), 3)
+	totals.AddBolus(from.Add(44*time.Hour), 1)
+	totals.AddCarbs(from.Add(34*time.Hour), 45)
+	//a basal that runs past the end of the period only counts up to the end
+	totals.AddBasal(from.Add(71*time.Hour), 3*time.Hour, 2)
+	//and one that started before the period only counts from the start
+	totals.AddBasal(from.Add(-2*time.Hour), 3*time.Hour, 1)
+
+	report := totals.Report()
+
+	if len(report.Days) != 3 || report.Timezone != "America/Los_Angeles" || report.From != "2015-01-01T08:00:00.000Z" {
+		t.Fatalf("given %v but expected 3 days in America/Los_Angeles from 2015-01-01T08:00:00.000Z", report)
+	}
+
+	first, second, third := report.Days[0], report.Days[1], report.Days[2]
+	if first.Date != "2015-01-01" || first.Basal != 3 || first.Bolus != 0 || *first.BasalPercentage != 100 {
+		t.Fatalf("given %v but expected a basal of 3 on 2015-01-01", first)
+	}
+	if second.Date != "2015-01-02" || second.Basal != 2 || second.Bolus != 4 || second.TotalInsulin != 6 || second.Carbs != 45 {
+		t.Fatalf("given %v but expected a basal of 2, bolus of 4 and 45g of carbs on 2015-01-02", second)
+	}
+	if !near(*second.BasalPercentage, 100.0/3) || !near(*second.BolusPercentage, 200.0/3) {
+		t.Fatalf("given %v%% basal and %v%% bolus", *second.BasalPercentage, *second.BolusPercentage)
+	}
+	if third.Date != "2015-01-03" || third.Basal != 2 {
+		t.Fatalf("given %v but expected a basal of 2 on 2015-01-03", third)
+	}
+
+	if report.Total.Date != "" || report.Total.Basal != 7 || report.Total.Bolus != 4 || report.Total.TotalInsulin != 11 || report.Total.Carbs != 45 {
+		t.Fatalf("given total %v but expected 7u basal, 4u bolus and 45g carbs", report.Total)
+	}
+}
+
+func TestDailyTotals_NoInsulin(t *testing.T) {
+
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := NewDailyTotals(&TotalsQuery{From: from, To: from.AddDate(0, 0, 2), Location: time.UTC}).Report()
+
+	if len(report.Days) != 2 || report.Days[1].Date != "2015-01-02" || report.Days[1].TotalInsulin != 0 || report.Days[1].BasalPercentage != nil {
+		t.Fatalf("given %v but expected two empty days", report.Days)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"math"
+	"strings"
+)
+
+var (
+	// the fields of each type that hold a glucose value, nested fields are dotted
+	glucose_fields = map[string][]string{
+		"cbg":    {"value"},
+		"smbg":   {"value"},
+		"wizard": {"bgInput", "bgTarget.low", "bgTarget.high", "bgTarget.target", "bgTarget.range", "insulinSensitivity"},
+	}
+)
+
+// GlucoseFields of the given type, none when it doesn't have any
+func GlucoseFields(recordType string) []string {
+	return glucose_fields[recordType]
+}
+
+// IsGlucoseField when the field holds a glucose value in any of the types
+func IsGlucoseField(field string) bool {
+	for _, fields := range glucose_fields {
+		for i := range fields {
+			if strings.EqualFold(field, fields[i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ToUnits converts a stored glucose value, which is always mmol/L, to the given units.
+// mg/dL are given as whole numbers as that is how meters show them.
+func ToUnits(stored float64, units string) float64 {
+	if units != UNITS_MGDL {
+		return stored
+	}
+	return math.Floor(ConvertGlucose(stored, UNITS_MMOLL, UNITS_MGDL) + 0.5)
+}
+
+// the stored values that are shown as the given whole number of mg/dL, from low up to but not including high
+func storedRange(mgdl float64) (low, high float64) {
+	return ConvertGlucose(mgdl-0.5, UNITS_MGDL, UNITS_MMOLL), ConvertGlucose(mgdl+0.5, UNITS_MGDL, UNITS_MMOLL)
+}
+
+// the condition that a field is shown as the given whole number of mg/dL
+func isShownAs(field string, mgdl float64) WhereCondition {
+	if mgdl != math.Floor(mgdl) {
+		return WhereCondition{Name: field, Condition: "=", Value: ConvertGlucose(mgdl, UNITS_MGDL, UNITS_MMOLL)}
+	}
+	low, high := storedRange(mgdl)
+	return WhereCondition{Condition: CONDITION_AND, Terms: []WhereCondition{
+		{Name: field, Condition: ">=", Value: low},
+		{Name: field, Condition: "<", Value: high},
+	}}
+}
+
+// a comparison of a glucose field with a value in mg/dL as one on the stored mmol/L value, matching the records whose
+// value would be shown, rounded to a whole number, as meeting it e.g. value > 180 is value >= 180.5 mg/dL in mmol/L
+func storedComparison(c WhereCondition, mgdl float64) WhereCondition {
+	switch c.Condition {
+	case ">=":
+		low, _ := storedRange(math.Ceil(mgdl))
+		return WhereCondition{Name: c.Name, Condition: ">=", Value: low}
+	case ">":
+		_, high := storedRange(math.Floor(mgdl))
+		return WhereCondition{Name: c.Name, Condition: ">=", Value: high}
+	case "<=":
+		_, high := storedRange(math.Floor(mgdl))
+		return WhereCondition{Name: c.Name, Condition: "<", Value: high}
+	case "<":
+		low, _ := storedRange(math.Ceil(mgdl))
+		return WhereCondition{Name: c.Name, Condition: "<", Value: low}
+	case "=":
+		return isShownAs(c.Name, mgdl)
+	case "!=":
+		return WhereCondition{Condition: CONDITION_NOT, Terms: []WhereCondition{isShownAs(c.Name, mgdl)}}
+	}
+	return c
+}
+
+// the values of an IN or NOT IN as the ranges of stored values they are shown as, false if they aren't all numbers
+func storedMembership(c WhereCondition) (WhereCondition, bool) {
+	in := WhereCondition{Condition: CONDITION_OR}
+	for i := range c.Values {
+		mgdl, ok := c.Values[i].(float64)
+		if !ok {
+			return c, false
+		}
+		in.Terms = append(in.Terms, isShownAs(c.Name, mgdl))
+	}
+	if c.Condition == "NOT IN" {
+		return WhereCondition{Condition: CONDITION_NOT, Terms: []WhereCondition{in}}, true
+	}
+	return in, true
+}
+
+// convert the numbers compared with glucose fields from the given units to how they are stored
+func storedUnits(conditions []WhereCondition, units string) {
+	if units != UNITS_MGDL {
+		return
+	}
+	for i := range conditions {
+		c := &conditions[i]
+		if c.IsGroup() {
+			storedUnits(c.Terms, units)
+			continue
+		}
+		if !IsGlucoseField(c.Name) {
+			continue
+		}
+		if mgdl, ok := c.Value.(float64); ok {
+			*c = storedComparison(*c, mgdl)
+		} else if c.Values != nil {
+			*c, _ = storedMembership(*c)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+== BSD2 LICENSE ==
+Copyright (c) 2015, Tidepool Project
+
+This program is free software; you can redistribute it and/or modify it under
+the terms of the associated License, which is identical to the BSD 2-Clause
+License as published by the Open Source Initiative at opensource.org.
+
+This program is distributed in the hope that it will be useful, but WITHOUT
+ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+FOR A PARTICULAR PURPOSE. See the License for more details.
+
+You should have received a copy of the License along with this program; if
+not, you can obtain one from Tidepool Project at tidepool.org.
+== BSD2 LICENSE ==
+*/
+
+package model
+
+import (
+	"testing"
+)
+
+func TestToUnits(t *testing.T) {
+
+	//the stored value for 180 mg/dL
+	stored := 180 / MGDL_PER_MMOLL
+
+	if mgdl := ToUnits(stored, UNITS_MGDL); mgdl != 180 {
+		t.Fatalf("given %v but expected 180", mgdl)
+	}
+	if mgdl := ToUnits(5.55, UNITS_MGDL); mgdl != 100 {
+		t.Fatalf("given %v but expected 5.55 mmol/L to be shown as 100", mgdl)
+	}
+	if mmol := ToUnits(5.55, UNITS_MMOLL); mmol != 5.55 {
+		t.Fatalf("given %v but expected mmol/L to be as stored", mmol)
+	}
+}
+
+func TestIsGlucoseField(t *testing.T) {
+
+	for _, field := range []string{"value", "bgInput", "bgTarget.high", "insulinSensitivity"} {
+		if !IsGlucoseField(field) {
+			t.Fatalf("%s should be a glucose field", field)
+		}
+	}
+	for _, field := range []string{"rate", "bgTarget", "carbInput"} {
+		if IsGlucoseField(field) {
+			t.Fatalf("%s shouldn't be a glucose field", field)
+		}
+	}
+}
+
+func TestStoredUnits(t *testing.T) {
+
+	low, high := 179.5/MGDL_PER_MMOLL, 180.5/MGDL_PER_MMOLL
+
+	comparisons := map[string]WhereCondition{
+		">=": {Name: "value", Condition: ">=", Value: low},
+		">":  {Name: "value", Condition: ">=", Value: high},
+		"<=": {Name: "value", Condition: "<", Value: high},
+		"<":  {Name: "value", Condition: "<", Value: low},
+	}
+	for op, expected := range comparisons {
+		conditions := []WhereCondition{{Name: "value", Condition: op, Value: 180.0}}
+		storedUnits(conditions, UNITS_MGDL)
+		if !near(conditions[0].Value.(float64), expected.Value.(float64)) || conditions[0].Condition != expected.Condition {
+			t.Fatalf("value %s 180 given %v but expected %v", op, conditions[0], expected)
+		}
+	}
+
+	//values shown as 180 mg/dL
+	conditions := []WhereCondition{{Name: "bgInput", Condition: "!=", Value: 180.0}}
+	storedUnits(conditions, UNITS_MGDL)
+	not := conditions[0]
+	if not.Condition != CONDITION_NOT || not.Terms[0].Condition != CONDITION_AND || !near(not.Terms[0].Terms[0].Value.(float64), low) || !near(not.Terms[0].Terms[1].Value.(float64), high) {
+		t.Fatalf("given %v but expected NOT (bgInput >= %v AND bgInput < %v)", not, low, high)
+	}
+
+	conditions = []WhereCondition{{Name: "value", Condition: "IN", Values: []interface{}{70.0, 180.0}}}
+	storedUnits(conditions, UNITS_MGDL)
+	if in := conditions[0]; in.Condition != CONDITION_OR || len(in.Terms) != 2 || in.Terms[1].Terms[1].Value.(float64) != high {
+		t.Fatalf("given %v but expected an OR of the two ranges", in)
+	}
+
+	//only numbers compared with glucose fields are converted
+	untouched := []WhereCondition{
+		{Name: "rate", Condition: ">", Value: 1.5},
+		{Name: "value", Condition: "=", Value: "high"},
+		{Condition: CONDITION_OR, Terms: []WhereCondition{{Name: "duration", Condition: ">", Value: 1000.0}}},
+	}
+	storedUnits(untouched, UNITS_MGDL)
+	if untouched[0].Value != 1.5 || untouched[1].Value != "high" || untouched[2].Terms[0].Value != 1000.0 {
+		t.Fatalf("given %v but expected them to be unchanged", untouched)
+	}
+
+	//mmol/L is how they are stored
+	conditions = []WhereCondition{{Name: "value", Condition: ">", Value: 10.0}}
+	storedUnits(conditions, UNITS_MMOLL)
+	if conditions[0].Value != 10.0 || conditions[0].Condition != ">" {
+		t.Fatalf("given %v but expected value > 10", conditions[0])
+	}
+}
@@ -40,6 +40,10 @@ type (
 		clients.Config
 		Service disc.ServiceListing `json:"service"`
 		sc.StoreConfig
+		Deidentify sc.DeidentifyConfig `json:"deidentify"`
+		Jobs       sc.JobsConfig       `json:"jobs"`
+		//the longest period in days the stats are given for
+		MaxPeriodDays int `json:"maxPeriodDays"`
 	}
 )
 
@@ -82,24 +86,42 @@ func main() {
 		log.Fatal(err)
 	}
 
+	seagullHosts := config.SeagullConfig.ToHostGetter(hakkenClient)
 	seagullClient := clients.NewSeagullClientBuilder().
-		WithHostGetter(config.SeagullConfig.ToHostGetter(hakkenClient)).
+		WithHostGetter(seagullHosts).
 		WithHttpClient(httpClient).
 		Build()
 
+	gatekeeperHosts := config.GatekeeperConfig.ToHostGetter(hakkenClient)
 	gatekeeperClient := clients.NewGatekeeperClientBuilder().
-		WithHostGetter(config.GatekeeperConfig.ToHostGetter(hakkenClient)).
+		WithHostGetter(gatekeeperHosts).
 		WithHttpClient(httpClient).
 		WithTokenProvider(shorelineClient).
 		Build()
 
+	/*
+	 * Jobs setup
+	 */
+	jobStore, err := sc.NewDiskJobStore(config.Jobs.Directory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs, err := api.NewJobRunner(store, jobStore, &config.Jobs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	rtr := mux.NewRouter()
 	api := api.InitApi(
 		shorelineClient,
-		seagullClient,
-		gatekeeperClient,
+		//with the group and profile lookups our go-common version lacks
+		api.NewSeagullAdapter(seagullClient, seagullHosts, httpClient),
+		api.NewGatekeeperAdapter(gatekeeperClient, gatekeeperHosts, httpClient, shorelineClient),
 		store,
 	)
+	api.Deidentify = &config.Deidentify
+	api.Jobs = jobs
+	api.MaxPeriodDays = config.MaxPeriodDays
 	api.SetHandlers("", rtr)
 
 	/*
@@ -134,6 +156,7 @@ func main() {
 
 			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
 				server.Close()
+				jobs.Stop()
 				done <- true
 			}
 		}